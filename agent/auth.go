@@ -0,0 +1,85 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"smart-agent/auth"
+	"smart-agent/config"
+	"smart-agent/protocol"
+)
+
+// clientRecord is a client connected to this agent.
+type clientRecord struct {
+	out   *connWriter
+	token string
+}
+
+// authorize checks the credential of reg and whether it may talk to the
+// peers it names.
+func (ser *AgentServer) authorize(reg *protocol.Register) *protocol.Error {
+	ctx, cancel := context.WithTimeout(context.Background(), protocol.HandshakeTimeout)
+	defer cancel()
+	if err := ser.verifier.Verify(ctx, reg.ClientId, reg.Credential); err != nil {
+		log.Printf("reject client %s: %v\n", reg.ClientId, err)
+		return &protocol.Error{Code: protocol.ErrCodeUnauthenticated, Message: "invalid credential"}
+	}
+	return ser.permit(reg)
+}
+
+// permit checks whether the client of reg may talk to the peers it names.
+func (ser *AgentServer) permit(reg *protocol.Register) *protocol.Error {
+	if reg.Role == config.RoleSender {
+		if !ser.acl.Allow(reg.ClientId, auth.ActionSend, reg.Receiver) {
+			return forbidden(reg.ClientId, auth.ActionSend, reg.Receiver)
+		}
+	} else {
+		for _, sender := range reg.Senders {
+			if !ser.acl.Allow(reg.ClientId, auth.ActionRecv, sender) {
+				return forbidden(reg.ClientId, auth.ActionRecv, sender)
+			}
+		}
+	}
+	return nil
+}
+
+func forbidden(client, action, peer string) *protocol.Error {
+	log.Printf("reject client %s: may not %s %s\n", client, action, peer)
+	return &protocol.Error{Code: protocol.ErrCodeForbidden, Message: fmt.Sprintf("%s may not %s %s", client, action, peer)}
+}
+
+// claimClient records out as the connection of clientId. A client already
+// connected is only replaced by one presenting its session token, which is
+// the same client coming back; anyone else is rejected.
+func (ser *AgentServer) claimClient(clientId, token string, out *connWriter) *protocol.Error {
+	ser.mu.Lock()
+	defer ser.mu.Unlock()
+	if old, ok := ser.clients[clientId]; ok {
+		if token == "" || token != old.token {
+			log.Printf("reject client %s: already connected\n", clientId)
+			return &protocol.Error{Code: protocol.ErrCodeDuplicateClient, Message: clientId + " is already connected"}
+		}
+		log.Printf("client %s reconnected, close its old conn\n", clientId)
+		old.out.conn.Close()
+	}
+	ser.clients[clientId] = clientRecord{out: out, token: token}
+	return nil
+}
+
+// bindSession stores the session token issued to the client on out.
+func (ser *AgentServer) bindSession(clientId, token string, out *connWriter) {
+	ser.mu.Lock()
+	defer ser.mu.Unlock()
+	if ser.clients[clientId].out == out {
+		ser.clients[clientId] = clientRecord{out: out, token: token}
+	}
+}
+
+// releaseClient forgets out unless clientId has reconnected meanwhile.
+func (ser *AgentServer) releaseClient(clientId string, out *connWriter) {
+	ser.mu.Lock()
+	defer ser.mu.Unlock()
+	if ser.clients[clientId].out == out {
+		delete(ser.clients, clientId)
+	}
+}
@@ -0,0 +1,147 @@
+package agent
+
+import (
+	"context"
+	"log"
+	"smart-agent/protocol"
+	"time"
+)
+
+const (
+	// times a broken stream to the receiver's agent is reopened and replayed
+	retransmitAttempts = 3
+	// times in a row the registry may fail to tell where a receiver is
+	// before the conn of its sender is given up
+	registryAttempts = 5
+	// pause before loss and delay to peers are measured again after a failure
+	probeRetryInterval = 5 * time.Second
+	// how long an exiting sender waits for the receiver to ack its last frame
+	exitAckTimeout = 5 * time.Second
+)
+
+// pending frames of a sender live in their own stream on the sender's
+// agent until the receiver acks them
+func pendingKey(senderId string) string {
+	return "pending:" + senderId
+}
+
+func (ser *AgentServer) pushPending(senderId string, m *protocol.Data) error {
+	return ser.pushData(pendingKey(senderId), m)
+}
+
+// trimPending drops the frames of senderId up to and including seq from the
+// head of the pending stream, unless it is in transit.
+func (ser *AgentServer) trimPending(senderId string, seq uint64) error {
+	key := pendingKey(senderId)
+	if ser.inTransit(key) {
+		// the frames go to the next agent as they are, it trims them there
+		return nil
+	}
+	return ser.store.Trim(context.Background(), key, seq)
+}
+
+// resendPending hands the pending frames of senderId after seq to send again.
+// A frame without a seq goes with the numbered frame before it.
+func (ser *AgentServer) resendPending(senderId string, seq uint64, send func(*protocol.Data) error) error {
+	n := 0
+	after := seq == 0
+	err := ser.rangeData(pendingKey(senderId), func(m *protocol.Data) error {
+		if m.Seq != 0 {
+			after = m.Seq > seq
+		}
+		if !after {
+			return nil
+		}
+		n++
+		return send(m)
+	})
+	log.Printf("retransmit %d pending frames of %s after seq %d\n", n, senderId, seq)
+	return err
+}
+
+// routeAck passes an ack of the receiver on to the sender.
+func (ser *AgentServer) routeAck(ack *protocol.Ack) {
+	if bf, ok := ser.routeToSender(ack.Sender, ack); ok {
+		offerAck(bf.ackCh, ack.Seq)
+	}
+}
+
+// routeCredit passes a credit of the receiver on to the sender, and keeps it
+// for a sender that opens its relay later.
+func (ser *AgentServer) routeCredit(c *protocol.Credit) {
+	ser.mu.Lock()
+	if c.Seq > ser.credits[c.Sender] {
+		ser.credits[c.Sender] = c.Seq
+	}
+	ser.mu.Unlock()
+	if bf, ok := ser.routeToSender(c.Sender, c); ok {
+		offerAck(bf.creditCh, c.Seq)
+	}
+}
+
+// routeToSender sends m of the receiver back over the relay conn of the
+// agent of sender. It returns the sender instead when this agent serves it.
+func (ser *AgentServer) routeToSender(sender string, m protocol.Message) (SenderBuffer, bool) {
+	ser.mu.Lock()
+	relay, remote := ser.relayMap[sender]
+	bf, local := ser.bufferMap[sender]
+	ser.mu.Unlock()
+	if remote {
+		if err := relay.Send(m); err != nil {
+			log.Printf("Failed to relay message type %d of %s: %v\n", m.Type(), sender, err)
+		}
+	} else if !local {
+		log.Printf("drop message type %d for %s, sender is gone\n", m.Type(), sender)
+	}
+	return bf, local && !remote
+}
+
+// forgetCredits drops the credits a receiver that left granted its senders.
+func (ser *AgentServer) forgetCredits(senderIds []string) {
+	ser.mu.Lock()
+	defer ser.mu.Unlock()
+	for _, id := range senderIds {
+		delete(ser.credits, id)
+	}
+}
+
+// grantedCredit returns the last credit a receiver here granted senderId.
+func (ser *AgentServer) grantedCredit(senderId string) (uint64, bool) {
+	ser.mu.Lock()
+	defer ser.mu.Unlock()
+	seq, ok := ser.credits[senderId]
+	return seq, ok
+}
+
+// offerAck hands seq to a size-1 ack or credit channel without blocking.
+// Both are cumulative, so an older value still queued is replaced by the
+// newer one.
+func offerAck(ch chan uint64, seq uint64) {
+	for {
+		select {
+		case ch <- seq:
+			return
+		default:
+		}
+		select {
+		case old := <-ch:
+			if old > seq {
+				seq = old
+			}
+		default:
+		}
+	}
+}
+
+// retry calls f up to n times until it succeeds.
+func retry(n int, f func() error) error {
+	var err error
+	for i := 0; i < n; i++ {
+		err = f()
+		if err == nil {
+			break
+		}
+		time.Sleep(time.Millisecond * 200)
+	}
+	return err
+}
@@ -0,0 +1,77 @@
+package agent
+
+import (
+	"context"
+	"log"
+	"smart-agent/protocol"
+	"time"
+)
+
+// how often a draining agent looks whether moved clients were taken over
+const migrationPollInterval = 100 * time.Millisecond
+
+func (ser *AgentServer) isDraining() bool {
+	select {
+	case <-ser.draining:
+		return true
+	default:
+		return false
+	}
+}
+
+// drainClients tells every connected client to move to another agent, a
+// slow client does not hold up the others.
+func (ser *AgentServer) drainClients(ctx context.Context) {
+	ser.mu.Lock()
+	outs := make(map[string]*connWriter, len(ser.clients))
+	for id, c := range ser.clients {
+		outs[id] = c.out
+	}
+	ser.mu.Unlock()
+	log.Printf("draining, %d clients to move\n", len(outs))
+	for id, out := range outs {
+		go func(id string, out *connWriter) {
+			if err := out.SendContext(ctx, &protocol.Drain{}); err != nil {
+				log.Printf("Failed to tell %s to move: %v\n", id, err)
+			}
+		}(id, out)
+	}
+}
+
+// expectMigration keeps the agent up until the streams at keys, of a client
+// that left for another agent, have been migrated.
+func (ser *AgentServer) expectMigration(keys ...string) {
+	ser.mu.Lock()
+	defer ser.mu.Unlock()
+	for _, key := range keys {
+		ser.migrating[key] = true
+	}
+}
+
+func (ser *AgentServer) migrated(key string) {
+	ser.mu.Lock()
+	defer ser.mu.Unlock()
+	delete(ser.migrating, key)
+	// what was taken over of the stream left with it
+	delete(ser.takenOver, key)
+}
+
+// waitMigrations waits until every stream expected to be migrated has been.
+func (ser *AgentServer) waitMigrations(ctx context.Context) error {
+	ticker := time.NewTicker(migrationPollInterval)
+	defer ticker.Stop()
+	for {
+		ser.mu.Lock()
+		n := len(ser.migrating)
+		ser.mu.Unlock()
+		if n == 0 {
+			return nil
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			log.Printf("%d streams were not taken over by other agents\n", n)
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"runtime/debug"
+	"smart-agent/protocol"
+	"sync"
+)
+
+// ConnError is why the agent ended a conn. The peer gets Code in an Error
+// frame with the message of the code, Err may tell about the agent and its
+// dependencies and is only logged.
+type ConnError struct {
+	Code uint16
+	Err  error
+}
+
+func (e *ConnError) Error() string { return e.Err.Error() }
+func (e *ConnError) Unwrap() error { return e.Err }
+
+func connError(code uint16, format string, a ...any) error {
+	return &ConnError{Code: code, Err: fmt.Errorf(format, a...)}
+}
+
+// names of the codes in the metrics
+var errCodeNames = map[uint16]string{
+	protocol.ErrCodeUnauthenticated: "unauthenticated",
+	protocol.ErrCodeForbidden:       "forbidden",
+	protocol.ErrCodeDuplicateClient: "duplicate_client",
+	protocol.ErrCodeBadRequest:      "bad_request",
+	protocol.ErrCodeUnavailable:     "unavailable",
+	protocol.ErrCodeInternal:        "internal",
+}
+
+// what the peer is told of a ConnError
+var errCodeMessages = map[uint16]string{
+	protocol.ErrCodeBadRequest:  "bad request",
+	protocol.ErrCodeUnavailable: "agent unavailable, try again later",
+	protocol.ErrCodeInternal:    "internal agent error",
+}
+
+// endConn reports err, the failure a conn of kind ended with: it is logged
+// and counted, and sent to the peer unless it is the conn itself that
+// failed. conn is nil when the failure came before the protocol handshake.
+func endConn(kind string, conn *protocol.Conn, err error) {
+	if err == nil {
+		return
+	}
+	if conn == nil {
+		reportFailure(kind, nil, err)
+		return
+	}
+	if frame := reportFailure(kind, conn.RemoteAddr(), err); frame != nil {
+		if err := conn.Send(frame); err != nil {
+			log.Printf("Failed to report failure to %s: %v\n", conn.RemoteAddr(), err)
+		}
+	}
+}
+
+// reportFailure logs and counts err, the failure a conn of kind with the
+// peer at remote ended with, and returns the Error frame telling the peer,
+// nil when the conn itself failed.
+func reportFailure(kind string, remote net.Addr, err error) *protocol.Error {
+	var frame *protocol.Error
+	var cerr *ConnError
+	if errors.As(err, &frame) {
+		// refusals are sent as they are
+	} else if errors.As(err, &cerr) {
+		frame = &protocol.Error{Code: cerr.Code, Message: errCodeMessages[cerr.Code]}
+	}
+	reason := "conn"
+	if frame != nil {
+		reason = errCodeNames[frame.Code]
+	}
+	connFailures.Add(kind+"."+reason, 1)
+	if remote == nil {
+		log.Printf("%s conn failed: %v\n", kind, err)
+	} else {
+		log.Printf("%s conn %s failed: %v\n", kind, remote, err)
+	}
+	return frame
+}
+
+// recoverConn ends the conn of kind whose handler panicked, deferred at the
+// goroutine boundary of the handler. *conn is the conn once the protocol
+// handshake is done.
+func recoverConn(kind string, conn **protocol.Conn) {
+	if r := recover(); r != nil {
+		handlerPanics.Add(1)
+		log.Printf("panic in %s handler: %v\n%s", kind, r, debug.Stack())
+		endConn(kind, *conn, &ConnError{Code: protocol.ErrCodeInternal, Err: fmt.Errorf("panic: %v", r)})
+	}
+}
+
+// spawn runs fn in a goroutine of a conn. A panic in it closes the conn,
+// which ends the handler, instead of the agent.
+func spawn(kind string, conn io.Closer, fn func()) {
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				handlerPanics.Add(1)
+				log.Printf("panic in %s goroutine: %v\n%s", kind, r, debug.Stack())
+				conn.Close()
+			}
+		}()
+		fn()
+	}()
+}
+
+// failer lets the goroutines of a client conn end it. The first failure is
+// reported to the client through its writer and the conn closed, which ends
+// the handler.
+type failer struct {
+	once   sync.Once
+	kind   string
+	out    *connWriter
+	failed bool
+	mu     sync.Mutex
+}
+
+func (f *failer) fail(err error) {
+	f.once.Do(func() {
+		conn := f.out.conn
+		if frame := reportFailure(f.kind, conn.RemoteAddr(), err); frame != nil {
+			if err := f.out.Send(frame); err != nil {
+				log.Printf("Failed to report failure to %s: %v\n", conn.RemoteAddr(), err)
+			}
+		}
+		f.mu.Lock()
+		f.failed = true
+		f.mu.Unlock()
+		conn.Close()
+	})
+}
+
+// hasFailed reports whether the conn was ended by fail, which has reported
+// the failure already.
+func (f *failer) hasFailed() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.failed
+}
@@ -0,0 +1,333 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"smart-agent/config"
+	"smart-agent/protocol"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// clientMeta is the session of a client as it is pushed to the agent the
+// client moves to.
+type clientMeta struct {
+	role     string
+	priority int32
+	weight   uint32
+	receiver string
+	senders  []string
+	// cluster ip of the agent the client said it moves to
+	movedTo string
+}
+
+// the registry points the next agent of a client to the agent a shutting
+// down agent pushed the client's streams to
+func handoverKey(clientId string) string {
+	return "handover." + clientId
+}
+
+// rememberClient records the session of the client reg registers.
+func (ser *AgentServer) rememberClient(reg *protocol.Register) {
+	ser.mu.Lock()
+	defer ser.mu.Unlock()
+	ser.metas[reg.ClientId] = clientMeta{
+		role:     reg.Role,
+		priority: reg.Priority,
+		weight:   reg.Weight,
+		receiver: reg.Receiver,
+		senders:  reg.Senders,
+	}
+}
+
+// adoptSession fills in what reg leaves out of the session of its client
+// from the one known here, pushed by the agent the client was at. It
+// reports whether the peers reg names came from there.
+func (ser *AgentServer) adoptSession(reg *protocol.Register) bool {
+	ser.mu.Lock()
+	meta, ok := ser.metas[reg.ClientId]
+	ser.mu.Unlock()
+	if !ok || meta.role != reg.Role {
+		return false
+	}
+	if reg.Priority == 0 {
+		reg.Priority = meta.priority
+	}
+	if reg.Weight == 0 {
+		reg.Weight = meta.weight
+	}
+	adopted := false
+	if reg.Receiver == "" && meta.receiver != "" {
+		reg.Receiver = meta.receiver
+		adopted = true
+	}
+	if len(reg.Senders) == 0 && len(meta.senders) > 0 {
+		reg.Senders = meta.senders
+		adopted = true
+	}
+	return adopted
+}
+
+// moveClient records the agent clientId said it moves to.
+func (ser *AgentServer) moveClient(clientId, clusterIp string) {
+	ser.mu.Lock()
+	defer ser.mu.Unlock()
+	meta := ser.metas[clientId]
+	meta.movedTo = clusterIp
+	ser.metas[clientId] = meta
+}
+
+func (ser *AgentServer) meta(clientId string) clientMeta {
+	ser.mu.Lock()
+	defer ser.mu.Unlock()
+	return ser.metas[clientId]
+}
+
+// handOverClient pushes the state of clientId to the agent at clusterIp it
+// moves to: its session and its stream, its pending frames when it is a
+// sender and the streams of its senders when it is a receiver.
+func (ser *AgentServer) handOverClient(clientId, clusterIp string) {
+	meta := ser.meta(clientId)
+	keys := []string{clientId}
+	switch meta.role {
+	case config.RoleSender:
+		keys = append(keys, pendingKey(clientId))
+	case config.RoleReceiver:
+		keys = append(keys, meta.senders...)
+	}
+	if err := ser.handOver(clientId, clusterIp, keys); err != nil {
+		log.Printf("Failed to push %s to %s: %v\n", clientId, clusterIp, err)
+	}
+}
+
+// handOver pushes the session of clientId with the first of keys, and the
+// streams at keys, to the agent at clusterIp. The other empty streams are
+// skipped.
+func (ser *AgentServer) handOver(clientId, clusterIp string, keys []string) error {
+	var errs []error
+	for i, key := range keys {
+		if i > 0 {
+			if last, err := ser.store.Last(context.Background(), key); err == nil && last == nil {
+				ser.migrated(key)
+				continue
+			}
+		}
+		if err := ser.pushStream(clientId, clusterIp, key); err != nil {
+			errs = append(errs, fmt.Errorf("push %s data: %w", key, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (ser *AgentServer) pushStream(clientId, clusterIp, key string) error {
+	conn, err := ser.dialAgent(clusterIp)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	meta := ser.meta(clientId)
+	sender := strings.TrimPrefix(key, pendingKey(""))
+	err = conn.Send(&protocol.Handover{
+		ClientId: clientId,
+		Role:     meta.role,
+		Priority: meta.priority,
+		Weight:   meta.weight,
+		Receiver: meta.receiver,
+		Senders:  meta.senders,
+		Sender:   sender,
+		Pending:  sender != key,
+	})
+	if err != nil {
+		return err
+	}
+	return ser.handOff(conn, clientId, key, "", clusterIp)
+}
+
+// serveHandover takes over the state of a client another agent pushes with
+// m, ahead of the client.
+func (ser *AgentServer) serveHandover(conn *protocol.Conn, m *protocol.Handover) error {
+	ser.mu.Lock()
+	// a client that got here first knows its session best
+	if _, ok := ser.clients[m.ClientId]; !ok && m.Role != "" {
+		ser.metas[m.ClientId] = clientMeta{
+			role:     m.Role,
+			priority: m.Priority,
+			weight:   m.Weight,
+			receiver: m.Receiver,
+			senders:  m.Senders,
+		}
+	}
+	ser.mu.Unlock()
+	key := m.Sender
+	var held uint64
+	if m.Pending {
+		key = pendingKey(m.Sender)
+		var err error
+		if held, err = ser.lastPendingSeq(m.Sender); err != nil {
+			return connError(protocol.ErrCodeUnavailable, "take over %s data: %w", key, err)
+		}
+	}
+	peer := conn.RemoteAddr().String()
+	log.Printf("take over %s data of %s from %s\n", key, m.ClientId, peer)
+	_, err := ser.recvStream(conn, m.ClientId, key, "", peer, func(data *protocol.Data) error {
+		// pending frames this agent still holds from an earlier stay are
+		// kept
+		if m.Pending && data.Seq != 0 && data.Seq <= held {
+			return nil
+		}
+		return ser.pushData(key, data)
+	})
+	if err != nil {
+		return fmt.Errorf("take over %s data: %w", key, err)
+	}
+	if !m.Pending {
+		// a receiver served here gets what was pushed for it
+		ser.mu.Lock()
+		token := ser.cursors[m.Sender].token
+		ser.mu.Unlock()
+		ser.deliverStored(m.Sender, token, false)
+	}
+	return nil
+}
+
+// pushAway pushes the streams still stored once the clients have left a
+// shutting down agent: those of a client that said where it moved to
+// there, the others to another agent of the namespace, which the registry
+// points the next agent of the client to.
+func (ser *AgentServer) pushAway(ctx context.Context) {
+	keys, err := ser.store.Keys(ctx)
+	if err != nil {
+		log.Println("Failed to list stored streams:", err)
+		return
+	}
+	byClient := make(map[string][]string)
+	for _, key := range keys {
+		if last, err := ser.store.Last(ctx, key); err != nil || last == nil {
+			continue
+		}
+		clientId := ser.streamOwner(key)
+		byClient[clientId] = append(byClient[clientId], key)
+	}
+	if len(byClient) == 0 {
+		return
+	}
+	log.Printf("push the data of %d clients to other agents\n", len(byClient))
+	peers := ser.peers()
+	var wg sync.WaitGroup
+	for clientId, keys := range byClient {
+		target := ser.meta(clientId).movedTo
+		if target == "" {
+			if len(peers) == 0 {
+				log.Printf("no agent to push %s data to\n", clientId)
+				continue
+			}
+			target = pickPeer(peers, clientId)
+			if err := ser.registry.EtcdPut(handoverKey(clientId), target); err != nil {
+				log.Printf("Failed to publish where %s data goes: %v\n", clientId, err)
+				continue
+			}
+		}
+		wg.Add(1)
+		go func(clientId, target string, keys []string) {
+			defer wg.Done()
+			if err := ser.handOver(clientId, target, keys); err != nil {
+				log.Printf("Failed to push %s to %s: %v\n", clientId, target, err)
+			}
+		}(clientId, target, keys)
+	}
+	if err := wait(ctx, &wg); err != nil {
+		log.Println("Failed to push all data to other agents:", err)
+	}
+}
+
+// streamOwner returns the client whose next agent takes the stream at key:
+// a sender's pending frames are its own, the stream of a sender is its
+// receiver's.
+func (ser *AgentServer) streamOwner(key string) string {
+	if senderId := strings.TrimPrefix(key, pendingKey("")); senderId != key {
+		return senderId
+	}
+	ser.mu.Lock()
+	defer ser.mu.Unlock()
+	for clientId, meta := range ser.metas {
+		if meta.role != config.RoleReceiver {
+			continue
+		}
+		for _, senderId := range meta.senders {
+			if senderId == key {
+				return clientId
+			}
+		}
+	}
+	if receiverId := ser.metas[key].receiver; receiverId != "" {
+		return receiverId
+	}
+	if sr, ok := ser.senderMap[key]; ok && sr.receiverId != "" {
+		return sr.receiverId
+	}
+	// whose it is is not known here, it goes where its sender goes
+	return key
+}
+
+// peers returns the pod ips of the other agents of the namespace.
+func (ser *AgentServer) peers() []string {
+	if ser.discovery == nil {
+		return nil
+	}
+	pods, err := ser.discovery.GetNameSpacePods(config.Namespace)
+	if err != nil {
+		log.Println("Failed to list agents:", err)
+		return nil
+	}
+	var ips []string
+	for _, pod := range pods {
+		if pod.PodIP != "" && !ser.isSelf(pod.PodIP) {
+			ips = append(ips, pod.PodIP)
+		}
+	}
+	sort.Strings(ips)
+	return ips
+}
+
+// pickPeer spreads clients over peers, a client always goes to the same
+// one.
+func pickPeer(peers []string, clientId string) string {
+	h := fnv.New32a()
+	h.Write([]byte(clientId))
+	return peers[h.Sum32()%uint32(len(peers))]
+}
+
+// isSelf reports whether ip is the cluster ip or a pod ip of this agent.
+func (ser *AgentServer) isSelf(ip string) bool {
+	return ip == ser.clusterIp() || getIPsForInterface("eth0")[ip]
+}
+
+// previousAgents returns the agents that may hold streams of the client of
+// reg: the one it was at, and the one that agent pushed them to if it shut
+// down before the client moved.
+func (ser *AgentServer) previousAgents(reg *protocol.Register) []string {
+	var ips []string
+	if reg.PrevClusterIp != "" && !ser.isSelf(reg.PrevClusterIp) {
+		ips = append(ips, reg.PrevClusterIp)
+	}
+	at, err := ser.registry.EtcdGet(handoverKey(reg.ClientId))
+	if err != nil {
+		log.Printf("Failed to look up where %s data was pushed: %v\n", reg.ClientId, err)
+		return ips
+	}
+	if at == "" {
+		return ips
+	}
+	// the pointer is followed once
+	if err := ser.registry.EtcdPut(handoverKey(reg.ClientId), ""); err != nil {
+		log.Printf("Failed to clear where %s data was pushed: %v\n", reg.ClientId, err)
+	}
+	if at != reg.PrevClusterIp && !ser.isSelf(at) {
+		ips = append(ips, at)
+	}
+	return ips
+}
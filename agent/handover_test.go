@@ -0,0 +1,169 @@
+package agent
+
+import (
+	"context"
+	"smart-agent/auth"
+	"smart-agent/config"
+	"smart-agent/protocol"
+	"smart-agent/service"
+	"smart-agent/transport"
+	"strings"
+	"testing"
+	"time"
+)
+
+type fakeDiscovery struct {
+	pods []service.Pod
+}
+
+func (d fakeDiscovery) GetNameSpacePods(namespace string) ([]service.Pod, error) {
+	return d.pods, nil
+}
+
+// startPeers runs the agents a, whose clients connect like to the agent of
+// startAgent, and b on one in-memory transport, where they dial each other
+// by their names. opts change the config of a.
+func startPeers(t *testing.T, opts ...func(*Config)) (a, b *AgentServer, mem *transport.Memory, regA *fakeRegistry) {
+	t.Helper()
+	mem = transport.NewMemory()
+	peer := func(name, listen string) func(*Config) {
+		return func(cfg *Config) {
+			cfg.ClientTransport, cfg.PeerTransport = mem, mem
+			cfg.ListenAddr = listen
+			cfg.TransferAddr = name + ":7000"
+			cfg.PeerPort = 7000
+		}
+	}
+	a, _, regA = startAgent(t, append([]func(*Config){peer("a", "agent")}, opts...)...)
+	b, _, _ = startAgent(t, peer("b", "agent-b"))
+	// both listen before the test goes on
+	dialTransfer(t, mem, "a:7000").Close()
+	dialTransfer(t, mem, "b:7000").Close()
+	return a, b, mem, regA
+}
+
+// waitStored waits until the stream at key of ser holds n frames.
+func waitStored(t *testing.T, ser *AgentServer, key string, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for stored(t, ser, key) != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d frames of %s stored, want %d", stored(t, ser, key), key, n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHandoverOnExit(t *testing.T) {
+	a, b, mem, _ := startPeers(t)
+	conn := register(t, mem, &protocol.Register{ClientId: "s1", Role: config.RoleSender, Receiver: "r1", Priority: 5, ClusterIp: "a"})
+	go discard(conn)
+	for seq := uint64(1); seq <= 3; seq++ {
+		if err := conn.Send(&protocol.Data{Seq: seq, Payload: []byte("payload")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitStored(t, a, pendingKey("s1"), 3)
+	if err := conn.Send(&protocol.Exit{Moving: true, To: "b"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the pending frames are on the next agent before the sender is
+	waitStored(t, b, pendingKey("s1"), 3)
+	waitStored(t, a, pendingKey("s1"), 0)
+	// and so is its session
+	reg := &protocol.Register{ClientId: "s1", Role: config.RoleSender}
+	b.adoptSession(reg)
+	if reg.Receiver != "r1" || reg.Priority != 5 {
+		t.Fatalf("session handed over as %+v", reg)
+	}
+}
+
+func TestHandoverOnDrain(t *testing.T) {
+	a, b, _, regA := startPeers(t, func(cfg *Config) {
+		cfg.Discovery = fakeDiscovery{pods: []service.Pod{{PodName: "agent-b", PodIP: "b"}}}
+	})
+	for seq := uint64(1); seq <= 2; seq++ {
+		if err := a.pushData("c1", &protocol.Data{Sender: "c1", Seq: seq}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := a.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// the data of a client that is not here outlives the agent
+	if n := stored(t, b, "c1"); n != 2 {
+		t.Fatalf("%d frames of c1 pushed, want 2", n)
+	}
+	if n := stored(t, a, "c1"); n != 0 {
+		t.Fatalf("%d frames of c1 left after the push", n)
+	}
+	// and the next agent of the client learns where it went
+	if got := a.previousAgents(&protocol.Register{ClientId: "c1"}); len(got) != 1 || got[0] != "b" {
+		t.Fatalf("previous agents of c1 = %v, want b", got)
+	}
+	if at, _ := regA.EtcdGet(handoverKey("c1")); at != "" {
+		t.Fatalf("pointer to %s not cleared", at)
+	}
+}
+
+func TestHandoverOnDrainToReceiver(t *testing.T) {
+	a, b, _, regA := startPeers(t, func(cfg *Config) {
+		cfg.Discovery = fakeDiscovery{pods: []service.Pod{{PodName: "agent-b", PodIP: "b"}}}
+	})
+	// the stream of s1 kept for r1, which left without saying where to
+	a.mu.Lock()
+	a.metas["r1"] = clientMeta{role: config.RoleReceiver, senders: []string{"s1"}}
+	a.mu.Unlock()
+	for seq := uint64(1); seq <= 2; seq++ {
+		if err := a.pushData("s1", &protocol.Data{Sender: "s1", Seq: seq}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := a.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := stored(t, b, "s1"); n != 2 {
+		t.Fatalf("%d frames of s1 pushed, want 2", n)
+	}
+	// the next agent of the receiver finds them, not that of the sender
+	if at, _ := regA.EtcdGet(handoverKey("s1")); at != "" {
+		t.Fatalf("stream of s1 published for s1 at %s", at)
+	}
+	if got := a.previousAgents(&protocol.Register{ClientId: "r1"}); len(got) != 1 || got[0] != "b" {
+		t.Fatalf("previous agents of r1 = %v, want b", got)
+	}
+}
+
+func TestHandedOverSessionChecked(t *testing.T) {
+	acl, err := auth.ParseACL(strings.NewReader("s1 send r2\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ser, mem, reg := startAgent(t, func(cfg *Config) { cfg.ACL = acl })
+	// a session pushed here names a receiver the sender may not send to
+	ser.mu.Lock()
+	ser.metas["s1"] = clientMeta{role: config.RoleSender, receiver: "r1"}
+	ser.mu.Unlock()
+
+	conn := dial(t, mem)
+	if err := conn.Send(&protocol.Register{ClientId: "s1", Role: config.RoleSender, ClusterIp: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	expectError(t, conn, protocol.ErrCodeForbidden)
+	if at, _ := reg.EtcdGet("s1"); at != "" {
+		t.Fatalf("rejected client published at %s", at)
+	}
+
+	// one that may is served, and the agent publishes where
+	register(t, mem, &protocol.Register{ClientId: "s1", Role: config.RoleSender, Receiver: "r2", ClusterIp: "a"})
+	if at, _ := reg.EtcdGet("s1"); at != "a" {
+		t.Fatalf("s1 published at %q, want a", at)
+	}
+}
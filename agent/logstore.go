@@ -0,0 +1,734 @@
+package agent
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"smart-agent/protocol"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// bytes a segment grows to before the next one is started
+const defaultSegmentSize = 8 << 20
+
+// frames read from disk at once
+const logPageSize = 128
+
+// how often the consumer groups are saved when every append is synced, a
+// crash delivers what was delivered since then again
+const stateSaveInterval = time.Second
+
+// A record is [length u32][crc32 u32][id u64][at u64][frame], little endian
+// like the wire, at is when it was appended in unix milliseconds. The length
+// counts what follows the crc, the crc covers it. Frames came in over a
+// Conn, a record longer than it accepts is garbage.
+const (
+	recordHeaderSize = 8
+	recordMetaSize   = 16
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// errBadFrame is a record written whole whose frame this build cannot read,
+// it is skipped and the records after it are kept
+var errBadFrame = errors.New("unreadable frame")
+
+// LogStorage keeps every stream in a directory of its own under dir, as an
+// append-only log split into segments. Offsets are the decimal ids of the
+// frames, counted per stream from 1 like MemoryStorage does.
+//
+// Every record is checksummed. Opening a stream after a crash cuts a segment
+// at its first torn or corrupt record, so what the agent reads back is what
+// it had written whole. A segment is removed once every frame in it is
+// trimmed. A state that cannot be read back is rebuilt from the segments,
+// the frames trimmed from those left and not acked by the groups are
+// delivered again.
+//
+// Each stream has a lock of its own, reading one does not hold up appends
+// to the others.
+type LogStorage struct {
+	dir          string
+	segmentSize  int64
+	syncInterval time.Duration
+	// closed to stop syncing
+	stop     chan struct{}
+	stopOnce sync.Once
+	// guards streams, not what is in them
+	mu      sync.Mutex
+	streams map[string]*logStream
+}
+
+type logStream struct {
+	mu sync.Mutex
+	// set once the stream is deleted or closed, whoever waited for mu
+	// looks it up again
+	closed bool
+	// appended to since the last sync
+	dirty bool
+	// the groups moved since the state was saved
+	stateDirty bool
+	dir        string
+	segments   []*logSegment
+	// frames not trimmed yet, oldest first
+	entries []logEntry
+	// id of the next frame appended
+	next  uint64
+	state logState
+}
+
+// logState is kept next to the segments of a stream.
+type logState struct {
+	// id of the first frame not trimmed
+	Head   uint64
+	Groups map[string]*logGroup
+}
+
+// logGroup is a consumer group, the frames after Acked up to Delivered are
+// pending.
+type logGroup struct {
+	Delivered uint64
+	Acked     uint64
+}
+
+type logSegment struct {
+	// id of its first frame
+	base uint64
+	f    *os.File
+	size int64
+}
+
+// logEntry is where a frame is on disk, and what the retention looks at.
+type logEntry struct {
+	id   uint64
+	seq  uint64
+	seg  *logSegment
+	pos  int64
+	size int
+	info frameInfo
+}
+
+// NewLogStorage keeps the streams under dir, in segments of segmentSize
+// bytes, or of 8MiB when it is not positive. Every append is synced to disk
+// before it returns when syncInterval is 0, otherwise what was appended is
+// synced every syncInterval and a crash loses at most that much.
+func NewLogStorage(dir string, segmentSize int64, syncInterval time.Duration) (*LogStorage, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create log storage: %w", err)
+	}
+	if segmentSize <= 0 {
+		segmentSize = defaultSegmentSize
+	}
+	s := &LogStorage{
+		dir:          dir,
+		segmentSize:  segmentSize,
+		syncInterval: syncInterval,
+		stop:         make(chan struct{}),
+		streams:      make(map[string]*logStream),
+	}
+	go s.syncLoop()
+	return s, nil
+}
+
+// syncLoop syncs the streams appended to and saves the groups moved every
+// syncInterval, or stateSaveInterval when appends are synced, until the
+// storage is closed.
+func (s *LogStorage) syncLoop() {
+	interval := s.syncInterval
+	if interval <= 0 {
+		interval = stateSaveInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.stop:
+			return
+		}
+		s.mu.Lock()
+		streams := make([]*logStream, 0, len(s.streams))
+		for _, st := range s.streams {
+			streams = append(streams, st)
+		}
+		s.mu.Unlock()
+		for _, st := range streams {
+			st.mu.Lock()
+			if !st.closed {
+				if err := st.sync(); err != nil {
+					log.Printf("Failed to sync %s: %v\n", st.dir, err)
+				}
+				if err := st.flushState(); err != nil {
+					log.Printf("Failed to save state of %s: %v\n", st.dir, err)
+				}
+			}
+			st.mu.Unlock()
+		}
+	}
+}
+
+// locked returns the stream at key like stream does, with its lock held.
+func (s *LogStorage) locked(key string, create bool) (*logStream, error) {
+	for {
+		s.mu.Lock()
+		st, err := s.stream(key, create)
+		s.mu.Unlock()
+		if err != nil || st == nil {
+			return nil, err
+		}
+		st.mu.Lock()
+		if !st.closed {
+			return st, nil
+		}
+		st.mu.Unlock()
+	}
+}
+
+// forget drops st from the streams once it is closed.
+func (s *LogStorage) forget(key string, st *logStream) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.streams[key] == st {
+		delete(s.streams, key)
+	}
+}
+
+// stream returns the stream at key, opening it from disk. It is created when
+// create is set, otherwise a missing stream is nil. s.mu is held.
+func (s *LogStorage) stream(key string, create bool) (*logStream, error) {
+	if st, ok := s.streams[key]; ok {
+		return st, nil
+	}
+	// keys are client ids, escaped so none can leave dir
+	dir := filepath.Join(s.dir, "stream-"+url.PathEscape(key))
+	if _, err := os.Stat(dir); errors.Is(err, os.ErrNotExist) {
+		if !create {
+			return nil, nil
+		}
+		if err := os.Mkdir(dir, 0o755); err != nil {
+			return nil, fmt.Errorf("create stream %s: %w", key, err)
+		}
+		if err := syncDir(s.dir); err != nil {
+			return nil, fmt.Errorf("create stream %s: %w", key, err)
+		}
+	}
+	st, err := openLogStream(dir)
+	if err != nil {
+		return nil, fmt.Errorf("open stream %s: %w", key, err)
+	}
+	s.streams[key] = st
+	return st, nil
+}
+
+// openLogStream reads the state and the segments of the stream in dir back.
+func openLogStream(dir string) (*logStream, error) {
+	st := &logStream{dir: dir}
+	raw, err := os.ReadFile(filepath.Join(dir, "state"))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(raw, &st.state); err != nil {
+			log.Printf("rebuild state of %s from its segments: %v\n", dir, err)
+			st.state = logState{}
+		}
+	}
+	if st.state.Groups == nil {
+		st.state.Groups = make(map[string]*logGroup)
+	}
+	names, err := filepath.Glob(filepath.Join(dir, "*.log"))
+	if err != nil {
+		return nil, err
+	}
+	// the names are zero padded base ids
+	sort.Strings(names)
+	last := uint64(0)
+	for _, name := range names {
+		var base uint64
+		if _, err := fmt.Sscanf(filepath.Base(name), "%d.log", &base); err != nil {
+			log.Printf("skip unknown file %s in log storage\n", name)
+			continue
+		}
+		f, err := os.OpenFile(name, os.O_RDWR|os.O_APPEND, 0o644)
+		if err != nil {
+			st.close()
+			return nil, err
+		}
+		seg := &logSegment{base: base, f: f}
+		st.segments = append(st.segments, seg)
+		if err := st.recover(seg, &last); err != nil {
+			st.close()
+			return nil, err
+		}
+	}
+	st.next = last + 1
+	if st.state.Head > st.next {
+		st.next = st.state.Head
+	}
+	// the ids of records cut off are given out again, the groups have not
+	// got the frames that get them
+	for _, g := range st.state.Groups {
+		if g.Delivered >= st.next {
+			g.Delivered = st.next - 1
+		}
+		if g.Acked > g.Delivered {
+			g.Acked = g.Delivered
+		}
+	}
+	return st, nil
+}
+
+// recover reads the records of seg, cutting it at the first one that is not
+// whole, and raises *last to the greatest id found.
+func (st *logStream) recover(seg *logSegment, last *uint64) error {
+	var pos int64
+	for {
+		e, _, err := readRecord(seg, pos)
+		if err == io.EOF {
+			break
+		}
+		if errors.Is(err, errBadFrame) {
+			log.Printf("skip record at %d of %s: %v\n", pos, seg.f.Name(), err)
+			if e.id > *last {
+				*last = e.id
+			}
+			pos += int64(e.size)
+			continue
+		}
+		if err != nil {
+			log.Printf("cut %s at %d: %v\n", seg.f.Name(), pos, err)
+			if err := seg.f.Truncate(pos); err != nil {
+				return err
+			}
+			break
+		}
+		if e.id > *last {
+			*last = e.id
+		}
+		if e.id >= st.state.Head {
+			st.entries = append(st.entries, e)
+		}
+		pos += int64(e.size)
+	}
+	seg.size = pos
+	return nil
+}
+
+// readRecord reads the record at pos of seg, io.EOF at the end of it.
+func readRecord(seg *logSegment, pos int64) (logEntry, *protocol.Data, error) {
+	var hdr [recordHeaderSize]byte
+	if n, err := seg.f.ReadAt(hdr[:], pos); err != nil {
+		if err == io.EOF && n == 0 {
+			return logEntry{}, nil, io.EOF
+		}
+		return logEntry{}, nil, fmt.Errorf("torn record header: %w", err)
+	}
+	length := binary.LittleEndian.Uint32(hdr[0:4])
+	if length < recordMetaSize || length > recordMetaSize+protocol.DefaultMaxFrameSize {
+		return logEntry{}, nil, fmt.Errorf("bad record length %d", length)
+	}
+	body := make([]byte, length)
+	if _, err := seg.f.ReadAt(body, pos+recordHeaderSize); err != nil {
+		return logEntry{}, nil, fmt.Errorf("torn record: %w", err)
+	}
+	if crc32.Checksum(body, crcTable) != binary.LittleEndian.Uint32(hdr[4:8]) {
+		return logEntry{}, nil, errors.New("record checksum mismatch")
+	}
+	msg, err := protocol.Unmarshal(protocol.TypeData, body[recordMetaSize:])
+	if err != nil {
+		e := logEntry{id: binary.LittleEndian.Uint64(body[0:8]), size: recordHeaderSize + int(length)}
+		return e, nil, fmt.Errorf("%w: %v", errBadFrame, err)
+	}
+	m := msg.(*protocol.Data)
+	at := int64(binary.LittleEndian.Uint64(body[8:16]))
+	e := logEntry{
+		id:   binary.LittleEndian.Uint64(body[0:8]),
+		seq:  m.Seq,
+		seg:  seg,
+		pos:  pos,
+		size: recordHeaderSize + int(length),
+		info: frameInfo{at: time.UnixMilli(at), bytes: int64(len(m.Payload)), expires: m.Expires},
+	}
+	return e, m, nil
+}
+
+// read returns the frames of ents still in st, the trimmed ones are skipped.
+func (st *logStream) read(ents []logEntry) ([]memFrame, error) {
+	list := make([]memFrame, 0, len(ents))
+	for _, e := range ents {
+		if len(st.entries) == 0 || e.id < st.entries[0].id {
+			continue
+		}
+		_, m, err := readRecord(e.seg, e.pos)
+		if err != nil {
+			return nil, fmt.Errorf("read %s at %d: %w", e.seg.f.Name(), e.pos, err)
+		}
+		list = append(list, memFrame{id: e.id, m: m})
+	}
+	return list, nil
+}
+
+// saveState replaces the state file of st, a crash leaves the old or the new
+// one.
+func (st *logStream) saveState() error {
+	raw, err := json.Marshal(&st.state)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(st.dir, "state.tmp")
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(raw)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(st.dir, "state")); err != nil {
+		return err
+	}
+	if err := syncDir(st.dir); err != nil {
+		return err
+	}
+	st.stateDirty = false
+	return nil
+}
+
+// flushState saves the state if the groups moved since it was saved.
+func (st *logStream) flushState() error {
+	if !st.stateDirty {
+		return nil
+	}
+	return st.saveState()
+}
+
+// syncDir writes the entries of dir to disk, the files created or renamed in
+// it survive a crash once it returns.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// trim drops the first n frames, and the segments holding none of the
+// frames left but the one appended to.
+func (st *logStream) trim(n int) error {
+	if n == 0 {
+		return nil
+	}
+	st.entries = st.entries[n:]
+	st.state.Head = st.next
+	if len(st.entries) > 0 {
+		st.state.Head = st.entries[0].id
+	}
+	if err := st.saveState(); err != nil {
+		return err
+	}
+	for len(st.segments) > 1 && st.segments[1].base <= st.state.Head {
+		seg := st.segments[0]
+		seg.f.Close()
+		if err := os.Remove(seg.f.Name()); err != nil {
+			log.Printf("Failed to remove segment %s: %v\n", seg.f.Name(), err)
+		}
+		st.segments = st.segments[1:]
+	}
+	return nil
+}
+
+// head returns how many frames at the head of st are up to and including
+// seq.
+func (st *logStream) head(seq uint64) int {
+	n := 0
+	for n < len(st.entries) && st.entries[n].seq <= seq {
+		n++
+	}
+	return n
+}
+
+// sync writes what was appended to the last segment to disk.
+func (st *logStream) sync() error {
+	if !st.dirty || len(st.segments) == 0 {
+		return nil
+	}
+	if err := st.segments[len(st.segments)-1].f.Sync(); err != nil {
+		return err
+	}
+	st.dirty = false
+	return nil
+}
+
+func (st *logStream) close() {
+	st.closed = true
+	for _, seg := range st.segments {
+		seg.f.Close()
+	}
+}
+
+func (s *LogStorage) Append(ctx context.Context, key string, m *protocol.Data) (string, error) {
+	st, err := s.locked(key, true)
+	if err != nil {
+		return "", err
+	}
+	defer st.mu.Unlock()
+	id := st.next
+	at := time.Now()
+	frame := protocol.Marshal(m)
+	rec := make([]byte, recordHeaderSize+recordMetaSize+len(frame))
+	binary.LittleEndian.PutUint32(rec[0:4], uint32(recordMetaSize+len(frame)))
+	binary.LittleEndian.PutUint64(rec[8:16], id)
+	binary.LittleEndian.PutUint64(rec[16:24], uint64(at.UnixMilli()))
+	copy(rec[24:], frame)
+	binary.LittleEndian.PutUint32(rec[4:8], crc32.Checksum(rec[8:], crcTable))
+
+	var seg *logSegment
+	if n := len(st.segments); n > 0 {
+		seg = st.segments[n-1]
+	}
+	if seg == nil || (seg.size > 0 && seg.size+int64(len(rec)) > s.segmentSize) {
+		if seg != nil {
+			// a full segment is never written again
+			if err := st.sync(); err != nil {
+				return "", err
+			}
+		}
+		name := filepath.Join(st.dir, fmt.Sprintf("%020d.log", id))
+		f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0o644)
+		if err != nil {
+			return "", fmt.Errorf("create segment of %s: %w", key, err)
+		}
+		if err := syncDir(st.dir); err != nil {
+			f.Close()
+			os.Remove(name)
+			return "", fmt.Errorf("create segment of %s: %w", key, err)
+		}
+		seg = &logSegment{base: id, f: f}
+		st.segments = append(st.segments, seg)
+	}
+	if _, err := seg.f.Write(rec); err != nil {
+		// the next append goes where this one started
+		seg.f.Truncate(seg.size)
+		return "", fmt.Errorf("append to %s: %w", key, err)
+	}
+	st.dirty = true
+	if s.syncInterval == 0 {
+		if err := st.sync(); err != nil {
+			seg.f.Truncate(seg.size)
+			return "", fmt.Errorf("sync %s: %w", key, err)
+		}
+	}
+	st.entries = append(st.entries, logEntry{
+		id:   id,
+		seq:  m.Seq,
+		seg:  seg,
+		pos:  seg.size,
+		size: len(rec),
+		info: frameInfo{at: at, bytes: int64(len(m.Payload)), expires: m.Expires},
+	})
+	seg.size += int64(len(rec))
+	st.next++
+	return formatOffset(id), nil
+}
+
+// Range reads the stream page by page without holding it locked while fn
+// runs.
+func (s *LogStorage) Range(ctx context.Context, key, after string, fn func(string, *protocol.Data) error) error {
+	from, err := parseOffset(after)
+	if err != nil {
+		return err
+	}
+	for {
+		st, err := s.locked(key, false)
+		if err != nil || st == nil {
+			return err
+		}
+		var ents []logEntry
+		for _, e := range st.entries {
+			if e.id > from {
+				ents = append(ents, e)
+				if len(ents) == logPageSize {
+					break
+				}
+			}
+		}
+		page, err := st.read(ents)
+		st.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		if err := each(page, fn); err != nil {
+			return err
+		}
+		if len(ents) < logPageSize {
+			return nil
+		}
+		from = ents[len(ents)-1].id
+	}
+}
+
+func (s *LogStorage) Consume(ctx context.Context, key, group string, redeliver bool, fn func(string, *protocol.Data) error) error {
+	st, err := s.locked(key, true)
+	if err != nil {
+		return err
+	}
+	g, ok := st.state.Groups[group]
+	if !ok {
+		g = &logGroup{}
+		st.state.Groups[group] = g
+	}
+	var ents []logEntry
+	for _, e := range st.entries {
+		if e.id > g.Delivered || (redeliver && e.id > g.Acked) {
+			ents = append(ents, e)
+		}
+	}
+	if n := len(st.entries); n > 0 && st.entries[n-1].id > g.Delivered {
+		// handed to the group from now on, saved with the next sync
+		g.Delivered = st.entries[n-1].id
+		st.stateDirty = true
+	}
+	list, err := st.read(ents)
+	st.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return each(list, fn)
+}
+
+func (s *LogStorage) Ack(ctx context.Context, key, group string, seq uint64) error {
+	st, err := s.locked(key, false)
+	if err != nil || st == nil {
+		return err
+	}
+	defer st.mu.Unlock()
+	n := st.head(seq)
+	if g, ok := st.state.Groups[group]; ok && n > 0 && st.entries[n-1].id > g.Acked {
+		g.Acked = st.entries[n-1].id
+	}
+	return st.trim(n)
+}
+
+func (s *LogStorage) Last(ctx context.Context, key string) (*protocol.Data, error) {
+	st, err := s.locked(key, false)
+	if err != nil || st == nil {
+		return nil, err
+	}
+	defer st.mu.Unlock()
+	if len(st.entries) == 0 {
+		return nil, nil
+	}
+	list, err := st.read(st.entries[len(st.entries)-1:])
+	if err != nil {
+		return nil, err
+	}
+	return list[0].m, nil
+}
+
+func (s *LogStorage) Trim(ctx context.Context, key string, seq uint64) error {
+	st, err := s.locked(key, false)
+	if err != nil || st == nil {
+		return err
+	}
+	defer st.mu.Unlock()
+	return st.trim(st.head(seq))
+}
+
+func (s *LogStorage) Delete(ctx context.Context, key string) error {
+	st, err := s.locked(key, false)
+	if err != nil || st == nil {
+		return err
+	}
+	defer st.mu.Unlock()
+	st.close()
+	err = os.RemoveAll(st.dir)
+	// a stream created at key from here on starts afresh
+	s.forget(key, st)
+	return err
+}
+
+func (s *LogStorage) Discard(ctx context.Context, key, through string) error {
+	last, err := parseOffset(through)
+	if err != nil || last == 0 {
+		return err
+	}
+	st, err := s.locked(key, false)
+	if err != nil || st == nil {
+		return err
+	}
+	defer st.mu.Unlock()
+	n := 0
+	for n < len(st.entries) && st.entries[n].id <= last {
+		n++
+	}
+	return st.trim(n)
+}
+
+func (s *LogStorage) Keys(ctx context.Context) ([]string, error) {
+	dirs, err := filepath.Glob(filepath.Join(s.dir, "stream-*"))
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(dirs))
+	for _, dir := range dirs {
+		key, err := url.PathUnescape(strings.TrimPrefix(filepath.Base(dir), "stream-"))
+		if err != nil {
+			log.Printf("skip unknown directory %s in log storage\n", dir)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func (s *LogStorage) Retain(ctx context.Context, key string, r Retention, now time.Time) (Evicted, error) {
+	st, err := s.locked(key, false)
+	if err != nil || st == nil {
+		return Evicted{}, err
+	}
+	defer st.mu.Unlock()
+	infos := make([]frameInfo, len(st.entries))
+	for i, e := range st.entries {
+		infos[i] = e.info
+	}
+	n, ev := evictHead(infos, r, now)
+	return ev, st.trim(n)
+}
+
+// Close writes what is appended and the groups to disk and closes the
+// segments, the storage reopens them when it is used again but no longer
+// syncs on an interval.
+func (s *LogStorage) Close() error {
+	s.stopOnce.Do(func() { close(s.stop) })
+	s.mu.Lock()
+	streams := s.streams
+	s.streams = make(map[string]*logStream)
+	s.mu.Unlock()
+	var errs []error
+	for _, st := range streams {
+		st.mu.Lock()
+		if !st.closed {
+			errs = append(errs, st.sync(), st.flushState())
+			st.close()
+		}
+		st.mu.Unlock()
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,148 @@
+package agent
+
+import (
+	"expvar"
+	"log"
+	"net"
+	"net/http"
+	"smart-agent/mptcp"
+	"smart-agent/transport"
+	"sync"
+	"time"
+)
+
+// streams migrated to other agents, by whether the peer committed them or
+// they were rolled back
+var migrations = expvar.NewMap("migrations")
+
+// connections accepted or dialed by this agent, by how they are carried
+var (
+	connsMPTCP    = expvar.NewInt("conns_mptcp")
+	connsFallback = expvar.NewInt("conns_mptcp_fallback")
+	connsTCP      = expvar.NewInt("conns_tcp")
+)
+
+// conns ended by a failure, by kind and reason, and panics recovered in
+// their goroutines
+var (
+	connFailures  = expvar.NewMap("conn_failures")
+	handlerPanics = expvar.NewInt("handler_panics")
+)
+
+// frames of senders kept in storage only because their buffer was full
+var framesSpilled = expvar.NewInt("frames_spilled")
+
+// frames and bytes the retention evicted, by client, and the frames among
+// them evicted because their TTL had passed
+var (
+	framesEvicted = expvar.NewMap("frames_evicted")
+	bytesEvicted  = expvar.NewMap("bytes_evicted")
+	framesExpired = expvar.NewInt("frames_expired")
+)
+
+// pathInfo is the path of a client connection as shown in the metrics.
+type pathInfo struct {
+	Protocol string
+	Subflows int
+	RTTMs    []float64
+}
+
+// logPath logs and counts how conn, a conn of kind, is carried.
+func logPath(kind string, conn net.Conn) {
+	info, err := transport.Inspect(conn)
+	if err == transport.ErrNoInfo {
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to inspect %s conn %s: %v\n", kind, conn.RemoteAddr(), err)
+		return
+	}
+	log.Printf("%s conn %s: %s\n", kind, conn.RemoteAddr(), info)
+	switch {
+	case info.MPTCP:
+		connsMPTCP.Add(1)
+	case info.Fallback:
+		connsFallback.Add(1)
+	default:
+		connsTCP.Add(1)
+	}
+}
+
+// clientPaths reads the current path of every client connected.
+func (ser *AgentServer) clientPaths() any {
+	ser.mu.Lock()
+	conns := make(map[string]net.Conn, len(ser.clients))
+	for id, c := range ser.clients {
+		conns[id] = c.out.conn
+	}
+	ser.mu.Unlock()
+	paths := make(map[string]pathInfo, len(conns))
+	for id, conn := range conns {
+		info, err := transport.Inspect(conn)
+		if err != nil {
+			continue
+		}
+		p := pathInfo{Protocol: info.Protocol(), Subflows: len(info.Subflows)}
+		for _, sf := range info.Subflows {
+			p.RTTMs = append(p.RTTMs, float64(sf.RTT)/float64(time.Millisecond))
+		}
+		paths[id] = p
+	}
+	return paths
+}
+
+// clientQueues reads the write queue of every client connected.
+func (ser *AgentServer) clientQueues() any {
+	ser.mu.Lock()
+	defer ser.mu.Unlock()
+	queues := make(map[string]writerStats, len(ser.clients))
+	for id, c := range ser.clients {
+		queues[id] = c.out.stats()
+	}
+	return queues
+}
+
+// receiverSchedulers returns the senders of every receiver with a sender
+// here and what each has sent under its scheduler.
+func (ser *AgentServer) receiverSchedulers() any {
+	ser.mu.Lock()
+	schedulers := make(map[string]*scheduler, len(ser.schedulers))
+	for id, sc := range ser.schedulers {
+		schedulers[id] = sc
+	}
+	ser.mu.Unlock()
+	flows := make(map[string]map[string]flowStats, len(schedulers))
+	for id, sc := range schedulers {
+		flows[id] = sc.stats()
+	}
+	return flows
+}
+
+// the vars are process wide, the agent that serves metrics first fills
+// client_paths, client_queues and receiver_schedulers
+var publishOnce sync.Once
+
+// serveMetrics serves the metrics as JSON at /debug/vars of addr until the
+// agent shuts down.
+func (ser *AgentServer) serveMetrics(addr string) {
+	publishOnce.Do(func() {
+		expvar.Publish("client_paths", expvar.Func(ser.clientPaths))
+		expvar.Publish("client_queues", expvar.Func(ser.clientQueues))
+		expvar.Publish("receiver_schedulers", expvar.Func(ser.receiverSchedulers))
+		expvar.Publish("mptcp_supported", expvar.Func(func() any { return transport.MPTCPSupported() }))
+		expvar.Publish("mptcp_path_manager", expvar.Func(func() any {
+			state, err := mptcp.Show()
+			if err != nil {
+				return err.Error()
+			}
+			return state
+		}))
+	})
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	srv := &http.Server{Addr: addr, Handler: mux}
+	ser.track(srv)
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Println("Failed to serve metrics:", err)
+	}
+}
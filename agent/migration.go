@@ -0,0 +1,282 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"smart-agent/config"
+	"smart-agent/protocol"
+	"strconv"
+	"time"
+)
+
+// A stream migrates between agents in two phases. The agent holding it
+// streams the frames to the other agent and marks them in transit, the
+// other agent stores them and commits the offset they end at, and only then
+// are they dropped where they were. A peer that fails, or does not commit
+// within the migration timeout, rolls the migration back: the frames stay
+// and the next migration hands them over again, the other agent drops the
+// frames of the sender's session it stored already by their seq. Nothing but the migration drops
+// frames of a stream in transit. Both agents log a record of every
+// migration.
+//
+// An agent pulls the streams of a client that registers with a Migrate to
+// the agent it was at before, and pushes them with a Handover to the agent
+// a client moves to, or to another agent when it shuts down.
+
+// migrate sends req to the agent at clusterIp and calls fn for every message
+// it streams back. Unless req.Keep is set it commits them once fn has stored
+// all of them. It returns the offset the peer ended at.
+func (ser *AgentServer) migrate(clusterIp string, req *protocol.Migrate, fn func(*protocol.Data) error) (string, error) {
+	clientId := req.ClientId
+	log.Printf("start fetching data for %s from %s\n", clientId, net.JoinHostPort(clusterIp, strconv.Itoa(config.DataTransferPort)))
+	conn, err := ser.dialAgent(clusterIp)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if err := conn.Send(req); err != nil {
+		return "", err
+	}
+	if req.Keep {
+		offset, _, err := recvFrames(conn, fn)
+		if err == nil {
+			log.Printf("finish fetching data for %s from %s\n", clientId, clusterIp)
+		}
+		return offset, err
+	}
+	offset, err := ser.recvStream(conn, clientId, migrationKey(req), req.After, clusterIp, fn)
+	if err == nil {
+		log.Printf("finish fetching data for %s from %s\n", clientId, clusterIp)
+	}
+	return offset, err
+}
+
+// serveMigrate streams the frames a peer agent asks for with m and, unless
+// it only reads them, drops them once the peer commits them.
+func (ser *AgentServer) serveMigrate(conn *protocol.Conn, m *protocol.Migrate) error {
+	key := migrationKey(m)
+	log.Printf("Send %s data to %s\n", key, conn.RemoteAddr())
+	if m.Keep {
+		_, _, err := ser.sendFrames(conn, m.ClientId, key, m.After)
+		return err
+	}
+	return ser.handOff(conn, m.ClientId, key, m.After, conn.RemoteAddr().String())
+}
+
+// sendFrames streams the frames of the stream at key after offset after to
+// conn and closes them with a TransferEnd. It returns how many were sent and
+// the offset they end at.
+func (ser *AgentServer) sendFrames(conn *protocol.Conn, clientId, key, after string) (int, string, error) {
+	offset := after
+	frames := 0
+	send := func(o string, data *protocol.Data) error {
+		offset = o
+		if !live(data) {
+			return nil
+		}
+		frames++
+		return conn.Send(data)
+	}
+	if err := ser.store.Range(context.Background(), key, after, send); err != nil {
+		return frames, offset, connError(protocol.ErrCodeUnavailable, "send %s data: %w", clientId, err)
+	}
+	if err := conn.Send(&protocol.TransferEnd{ClientId: clientId, Offset: offset}); err != nil {
+		return frames, offset, fmt.Errorf("send %s data: %w", clientId, err)
+	}
+	log.Printf("Send %s data finished\n", key)
+	return frames, offset, nil
+}
+
+// handOff migrates the stream at key after offset after to peer over conn:
+// it marks it in transit, streams the frames and drops them once the peer
+// commits them.
+func (ser *AgentServer) handOff(conn *protocol.Conn, clientId, key, after, peer string) error {
+	if err := ser.beginTransit(key); err != nil {
+		return connError(protocol.ErrCodeUnavailable, "migrate %s data: %w", clientId, err)
+	}
+	defer ser.endTransit(key)
+	frames, offset, err := ser.sendFrames(conn, clientId, key, after)
+	if err == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), ser.cfg.MigrationTimeout)
+		var msg protocol.Message
+		msg, err = conn.RecvContext(ctx)
+		cancel()
+		if err == nil {
+			if c, ok := msg.(*protocol.Commit); !ok || c.Offset != offset {
+				err = connError(protocol.ErrCodeBadRequest, "expected commit of %s data at %q, got %T", clientId, offset, msg)
+			}
+		}
+	}
+	if err != nil {
+		migrations.Add("rolled_back", 1)
+		logMigration("to", key, peer, frames, after, offset, "rolled back: "+err.Error())
+		return err
+	}
+	// frames the stream got meanwhile stay, and so do the committed ones
+	// when they cannot be dropped, they are handed over again at worst
+	if err := ser.store.Discard(context.Background(), key, offset); err != nil {
+		log.Printf("Failed to drop migrated %s data: %v\n", key, err)
+	}
+	ser.migrated(key)
+	migrations.Add("committed", 1)
+	logMigration("to", key, peer, frames, after, offset, "committed")
+	return nil
+}
+
+// recvFrames calls fn for every Data message on conn until the TransferEnd,
+// and returns the offset it holds and how many frames came.
+func recvFrames(conn *protocol.Conn, fn func(*protocol.Data) error) (string, int, error) {
+	frames := 0
+	for {
+		msg, err := conn.Recv()
+		if err != nil {
+			return "", frames, err
+		}
+		switch m := msg.(type) {
+		case *protocol.Data:
+			if err := fn(m); err != nil {
+				return "", frames, err
+			}
+			frames++
+		case *protocol.Error:
+			return "", frames, m
+		case *protocol.TransferEnd:
+			return m.Offset, frames, nil
+		}
+	}
+}
+
+// takenSeq is the last seq of the session token of a sender taken over from
+// a peer.
+type takenSeq struct {
+	token string
+	seq   uint64
+}
+
+// recvStream takes over the stream at key migrated from peer over conn, the
+// frames after offset after: fn stores every frame, then the offset they end
+// at is committed. Frames of the sender's session taken over from peer
+// before are skipped, unless they are unnumbered.
+func (ser *AgentServer) recvStream(conn *protocol.Conn, clientId, key, after, peer string, fn func(*protocol.Data) error) (string, error) {
+	// a peer pushing dials from another port every time
+	from := peer
+	if host, _, err := net.SplitHostPort(peer); err == nil {
+		from = host
+	}
+	ser.mu.Lock()
+	prev := ser.takenOver[key][from]
+	ser.mu.Unlock()
+	var token string
+	var skip, last, held uint64
+	looked := false
+	offset, frames, err := recvFrames(conn, func(data *protocol.Data) error {
+		if data.Seq == 0 {
+			return fn(data)
+		}
+		if !looked {
+			looked = true
+			token = ser.sessionOf(data.Sender)
+			if token != "" && token == prev.token {
+				skip = prev.seq
+			}
+		}
+		// the sender started a new session, numbered from 1 again
+		if data.Seq < last {
+			skip = 0
+		}
+		last = data.Seq
+		if data.Seq > skip {
+			if err := fn(data); err != nil {
+				return err
+			}
+		}
+		held = data.Seq
+		return nil
+	})
+	if token != "" && held != 0 {
+		ser.mu.Lock()
+		if ser.takenOver[key] == nil {
+			ser.takenOver[key] = make(map[string]takenSeq)
+		}
+		ser.takenOver[key][from] = takenSeq{token: token, seq: held}
+		ser.mu.Unlock()
+	}
+	if err == nil {
+		// what fn stored is the peer's to drop now
+		err = conn.Send(&protocol.Commit{ClientId: clientId, Offset: offset})
+	}
+	if err != nil {
+		logMigration("from", key, peer, frames, after, offset, "rolled back: "+err.Error())
+		return "", err
+	}
+	logMigration("from", key, peer, frames, after, offset, "committed")
+	return offset, nil
+}
+
+// sessionOf returns the session token of senderId, "" when it is not known.
+func (ser *AgentServer) sessionOf(senderId string) string {
+	if senderId == "" {
+		return ""
+	}
+	token, err := ser.registry.EtcdGet(sessionKey(senderId))
+	if err != nil {
+		log.Printf("Failed to look up session of %s: %v\n", senderId, err)
+		return ""
+	}
+	return token
+}
+
+// migrationKey is the stream m asks for.
+func migrationKey(m *protocol.Migrate) string {
+	if m.Pending {
+		return pendingKey(m.ClientId)
+	}
+	return m.ClientId
+}
+
+// beginTransit marks the stream at key in transit once the migration of it
+// that is in transit already, if any, is over. It gives up after the
+// migration timeout.
+func (ser *AgentServer) beginTransit(key string) error {
+	timer := time.NewTimer(ser.cfg.MigrationTimeout)
+	defer timer.Stop()
+	for {
+		ser.mu.Lock()
+		busy, ok := ser.transits[key]
+		if !ok {
+			ser.transits[key] = make(chan struct{})
+			ser.mu.Unlock()
+			return nil
+		}
+		ser.mu.Unlock()
+		select {
+		case <-busy:
+		case <-timer.C:
+			return fmt.Errorf("%s is still in transit", key)
+		}
+	}
+}
+
+// inTransit reports whether the stream at key is migrated right now.
+func (ser *AgentServer) inTransit(key string) bool {
+	ser.mu.Lock()
+	defer ser.mu.Unlock()
+	_, ok := ser.transits[key]
+	return ok
+}
+
+func (ser *AgentServer) endTransit(key string) {
+	ser.mu.Lock()
+	defer ser.mu.Unlock()
+	close(ser.transits[key])
+	delete(ser.transits, key)
+}
+
+// logMigration logs the record of a migration of the stream at key to or
+// from peer: the frames handed over, the offsets they start after and end
+// at, and how it ended.
+func logMigration(dir, key, peer string, frames int, after, through, outcome string) {
+	log.Printf("migration of %s %s %s: %d frames after %q through %q %s\n", key, dir, peer, frames, after, through, outcome)
+}
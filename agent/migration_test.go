@@ -0,0 +1,260 @@
+package agent
+
+import (
+	"context"
+	"expvar"
+	"smart-agent/protocol"
+	"smart-agent/transport"
+	"strings"
+	"testing"
+	"time"
+)
+
+// dialTransfer connects to the transfer port addr, that of the agent of
+// startAgent when empty, as a peer agent.
+func dialTransfer(t *testing.T, mem *transport.Memory, addr string) *protocol.Conn {
+	t.Helper()
+	if addr == "" {
+		addr = "agent-transfer"
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// the agent may not listen yet
+	c, err := mem.Dial(ctx, addr)
+	for err != nil && ctx.Err() == nil {
+		time.Sleep(10 * time.Millisecond)
+		c, err = mem.Dial(ctx, addr)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := protocol.Client(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// askMigrate asks the agent of startAgent for the stream of clientId as a
+// peer agent and returns the conn and the offset the frames end at.
+func askMigrate(t *testing.T, mem *transport.Memory, clientId string, frames int) (*protocol.Conn, string) {
+	t.Helper()
+	conn := dialTransfer(t, mem, "")
+	if err := conn.Send(&protocol.Migrate{ClientId: clientId}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < frames; i++ {
+		if _, err := conn.Expect(protocol.TypeData); err != nil {
+			t.Fatal(err)
+		}
+	}
+	end, err := conn.Expect(protocol.TypeTransferEnd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, end.(*protocol.TransferEnd).Offset
+}
+
+func stored(t *testing.T, ser *AgentServer, key string) int {
+	t.Helper()
+	n := 0
+	if err := ser.rangeData(key, func(*protocol.Data) error { n++; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func migrationCount(outcome string) int64 {
+	if v, ok := migrations.Get(outcome).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestMigrateCommit(t *testing.T) {
+	ser, mem, _ := startAgent(t)
+	for seq := uint64(1); seq <= 3; seq++ {
+		if err := ser.pushData("c1", &protocol.Data{Sender: "s1", Seq: seq}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before := migrationCount("committed")
+	peer, offset := askMigrate(t, mem, "c1", 3)
+
+	// the frames stay while they are in transit
+	if n := stored(t, ser, "c1"); n != 3 {
+		t.Fatalf("%d frames stored before the commit, want 3", n)
+	}
+	if err := ser.pushData("c1", &protocol.Data{Sender: "s1", Seq: 4}); err != nil {
+		t.Fatal(err)
+	}
+	// a second migration waits for the first one
+	other := dialTransfer(t, mem, "")
+	if err := other.Send(&protocol.Migrate{ClientId: "c1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := peer.Send(&protocol.Commit{ClientId: "c1", Offset: offset}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := peer.Recv(); err == nil {
+		t.Fatal("conn still open after the commit")
+	}
+	// and gets what the stream got after the first one started
+	msg, err := other.Expect(protocol.TypeData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seq := msg.(*protocol.Data).Seq; seq != 4 {
+		t.Fatalf("second migration got frame %d, want 4", seq)
+	}
+	if _, err := other.Expect(protocol.TypeTransferEnd); err != nil {
+		t.Fatal(err)
+	}
+	if n := stored(t, ser, "c1"); n != 1 {
+		t.Fatalf("%d frames stored after the first commit, want 1", n)
+	}
+	if n := migrationCount("committed") - before; n != 1 {
+		t.Fatalf("metrics count %d committed migrations, want 1", n)
+	}
+}
+
+func TestMigrateRollback(t *testing.T) {
+	ser, mem, _ := startAgent(t, func(cfg *Config) { cfg.MigrationTimeout = 100 * time.Millisecond })
+	for seq := uint64(1); seq <= 3; seq++ {
+		if err := ser.pushData("c1", &protocol.Data{Sender: "s1", Seq: seq}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before := migrationCount("rolled_back")
+
+	// a peer that never commits
+	peer, _ := askMigrate(t, mem, "c1", 3)
+	if _, err := peer.Recv(); err == nil {
+		t.Fatal("conn still open after the migration timed out")
+	}
+	// and one that fails before it does
+	peer, _ = askMigrate(t, mem, "c1", 3)
+	peer.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for migrationCount("rolled_back")-before < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("migrations not rolled back")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := stored(t, ser, "c1"); n != 3 {
+		t.Fatalf("%d frames stored after the rollbacks, want 3", n)
+	}
+	// the stream can be migrated again
+	peer, offset := askMigrate(t, mem, "c1", 3)
+	if err := peer.Send(&protocol.Commit{ClientId: "c1", Offset: offset}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := peer.Recv(); err == nil {
+		t.Fatal("conn still open after the commit")
+	}
+	if n := stored(t, ser, "c1"); n != 0 {
+		t.Fatalf("%d frames stored after the commit, want 0", n)
+	}
+}
+
+func TestMigrateInTransitKept(t *testing.T) {
+	policy, err := ParseRetention(strings.NewReader("c1 - 1 -\ns1 - 1 -\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ser, mem, _ := startAgent(t, func(cfg *Config) { cfg.Retention = policy })
+	for seq := uint64(1); seq <= 3; seq++ {
+		if err := ser.pushData("c1", &protocol.Data{Sender: "s1", Seq: seq}); err != nil {
+			t.Fatal(err)
+		}
+		if err := ser.pushPending("s1", &protocol.Data{Sender: "s1", Seq: seq}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	peer, offset := askMigrate(t, mem, "c1", 3)
+	pending := dialTransfer(t, mem, "")
+	if err := pending.Send(&protocol.Migrate{ClientId: "s1", Pending: true}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := pending.Expect(protocol.TypeData); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := pending.Expect(protocol.TypeTransferEnd); err != nil {
+		t.Fatal(err)
+	}
+
+	// neither the collector nor an ack drops frames in transit
+	if ev := ser.enforceRetention(context.Background()); ev.Frames != 0 {
+		t.Fatalf("evicted %+v in transit", ev)
+	}
+	if err := ser.trimPending("s1", 2); err != nil {
+		t.Fatal(err)
+	}
+	if n := stored(t, ser, pendingKey("s1")); n != 3 {
+		t.Fatalf("%d pending frames stored in transit, want 3", n)
+	}
+	if err := peer.Send(&protocol.Commit{ClientId: "c1", Offset: offset}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := peer.Recv(); err == nil {
+		t.Fatal("conn still open after the commit")
+	}
+	if n := stored(t, ser, "c1"); n != 0 {
+		t.Fatalf("%d frames stored after the commit, want 0", n)
+	}
+}
+
+func TestTakeOverAgain(t *testing.T) {
+	ser, mem, reg := startAgent(t)
+	push := func(seqs ...uint64) {
+		t.Helper()
+		conn := dialTransfer(t, mem, "")
+		if err := conn.Send(&protocol.Handover{ClientId: "r1", Sender: "s1"}); err != nil {
+			t.Fatal(err)
+		}
+		for _, seq := range seqs {
+			if err := conn.Send(&protocol.Data{Sender: "s1", Seq: seq}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := conn.Send(&protocol.TransferEnd{ClientId: "r1", Offset: "x"}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.Expect(protocol.TypeCommit); err != nil {
+			t.Fatal(err)
+		}
+	}
+	storedSeqs := func() []uint64 {
+		t.Helper()
+		var got []uint64
+		if err := ser.rangeData("s1", func(m *protocol.Data) error { got = append(got, m.Seq); return nil }); err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+	reg.EtcdPut(sessionKey("s1"), "t1")
+	// a peer whose migration timed out after this agent stored the frames
+	// hands them over again with one more
+	push(1, 2, 3)
+	push(1, 2, 3, 4)
+	if got := storedSeqs(); len(got) != 4 || got[3] != 4 {
+		t.Fatalf("stored %v, want 1 to 4 once", got)
+	}
+
+	// the sender starts a new session, numbered from 1 again
+	reg.EtcdPut(sessionKey("s1"), "t2")
+	push(1, 2)
+	if got := storedSeqs(); len(got) != 6 || got[4] != 1 || got[5] != 2 {
+		t.Fatalf("stored %v, want 1 and 2 of the new session after 1 to 4", got)
+	}
+	// and so it does within what one migration hands over
+	push(1, 2, 3, 1)
+	if got := storedSeqs(); len(got) != 8 || got[6] != 3 || got[7] != 1 {
+		t.Fatalf("stored %v, want 3 and the 1 of the next session after 1 and 2", got)
+	}
+}
@@ -0,0 +1,112 @@
+package agent
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"smart-agent/config"
+	"smart-agent/service"
+	"smart-agent/transport"
+	"strconv"
+	"strings"
+)
+
+// Registry is where agents publish what the others look up: where a client
+// is served, its session and keys.
+type Registry interface {
+	EtcdPut(key, value string) error
+	EtcdGet(key string) (string, error)
+	// EtcdWatch sends the value of key and then every value it is put
+	// with, the channel is closed once ctx is done or the watch fails.
+	EtcdWatch(ctx context.Context, key string) (<-chan string, error)
+}
+
+// Discovery lists the agents of the cluster.
+type Discovery interface {
+	GetNameSpacePods(namespace string) ([]service.Pod, error)
+}
+
+// NodeBridge is the node an agent runs on. The node tells the agent about
+// itself, takes data of clients and hands files to receivers, and reads the
+// loss and delay the agent measures to its peers.
+type NodeBridge interface {
+	// IP and Name of the node.
+	IP() (string, error)
+	Name() (string, error)
+	// Dial opens the conn node data of clients is forwarded over.
+	Dial(ctx context.Context) (net.Conn, error)
+	// ReadyFile returns the file the node has for receivers, nil when there
+	// is none yet. FileSent tells the node it was forwarded.
+	ReadyFile() ([]byte, error)
+	FileSent() error
+	// ReportLoss and ReportDelay hand the latest measurements to the node.
+	ReportLoss(report string) error
+	ReportDelay(report string) error
+}
+
+// the ip of the node a client is served on, in the registry for the node of
+// a sender to reach the node of its receiver
+func nodeIPKey(clientId string) string {
+	return "nodeip." + clientId
+}
+
+// FileNode is a node that talks to the agent through files in Dir, which is
+// shared with the node, and takes data on its ClientNode port.
+type FileNode struct {
+	Dir string
+	// Transport the node is dialed over, MPTCP when nil.
+	Transport transport.Transport
+}
+
+func (n *FileNode) read(name string) (string, error) {
+	content, err := os.ReadFile(filepath.Join(n.Dir, name))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(content)), nil
+}
+
+func (n *FileNode) write(name, content string) error {
+	return os.WriteFile(filepath.Join(n.Dir, name), []byte(content), 0644)
+}
+
+func (n *FileNode) IP() (string, error) {
+	return n.read("ip.txt")
+}
+
+func (n *FileNode) Name() (string, error) {
+	return n.read("node.txt")
+}
+
+func (n *FileNode) Dial(ctx context.Context) (net.Conn, error) {
+	ip, err := n.IP()
+	if err != nil {
+		return nil, err
+	}
+	tr := n.Transport
+	if tr == nil {
+		tr = transport.MPTCP{}
+	}
+	return tr.Dial(ctx, net.JoinHostPort(ip, strconv.Itoa(config.ClientNode)))
+}
+
+func (n *FileNode) ReadyFile() ([]byte, error) {
+	flag, err := n.read("flag.txt")
+	if err != nil || flag != "Ready" {
+		return nil, err
+	}
+	return os.ReadFile(filepath.Join(n.Dir, "file.txt"))
+}
+
+func (n *FileNode) FileSent() error {
+	return n.write("flag.txt", "NotReady")
+}
+
+func (n *FileNode) ReportLoss(report string) error {
+	return n.write("data1.txt", report)
+}
+
+func (n *FileNode) ReportDelay(report string) error {
+	return n.write("data3.txt", report)
+}
@@ -0,0 +1,112 @@
+package agent
+
+import (
+	"log"
+	"smart-agent/mptcp"
+	"sync"
+)
+
+// profileNone is reported to a client whose connection is not MPTCP, no
+// transport profile applies to it.
+const profileNone = "none"
+
+// sessionProfiles is the transport profile of this agent. Neither the path
+// manager endpoints nor the net/mptcp/scheduler sysctl of redundant can be
+// set for one socket, both apply to every MPTCP connection of the pod. So a
+// profile is applied for the first session asking for it and shared by the
+// sessions after it, and a session asking for another one meanwhile gets the
+// one in effect.
+type sessionProfiles struct {
+	mu sync.Mutex
+	// set by -trans-policy, clients do not change it
+	pinned bool
+	active string
+	users  int
+	iface  string
+	apply  func(policy, iface string) error
+	// the scheduler redundant replaced, put back when it is released
+	prevScheduler string
+	scheduler     func() (string, error)
+	setScheduler  func(string) error
+}
+
+func newSessionProfiles(pinned, iface string) *sessionProfiles {
+	p := &sessionProfiles{
+		active:       mptcp.PolicyDefault,
+		iface:        iface,
+		apply:        mptcp.Apply,
+		scheduler:    mptcp.Scheduler,
+		setScheduler: mptcp.SetScheduler,
+	}
+	if pinned != "" {
+		p.pinned = true
+		p.active = pinned
+	}
+	return p
+}
+
+// acquire applies requested for a session if it can and returns the profile
+// in effect. release is called when the session ends.
+func (p *sessionProfiles) acquire(requested string) (effective string, release func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	noop := func() {}
+	if requested == "" || p.pinned {
+		return p.active, noop
+	}
+	if p.users > 0 && p.active != requested {
+		return p.active, noop
+	}
+	if p.active != requested {
+		if requested == mptcp.PolicyRedundant {
+			prev, err := p.scheduler()
+			if err != nil {
+				log.Printf("Failed to read the MPTCP scheduler: %v\n", err)
+				return p.active, noop
+			}
+			p.prevScheduler = prev
+		}
+		if err := p.apply(requested, p.iface); err != nil {
+			log.Printf("Failed to apply transport profile %s: %v\n", requested, err)
+			return p.active, noop
+		}
+		log.Printf("transport profile %s applied\n", requested)
+		if p.active == mptcp.PolicyRedundant {
+			p.restoreScheduler()
+		}
+		p.active = requested
+	}
+	p.users++
+	var once sync.Once
+	return p.active, func() { once.Do(p.release) }
+}
+
+// release puts the default profile back once no session uses the active one.
+func (p *sessionProfiles) release() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.users--
+	if p.users > 0 || p.active == mptcp.PolicyDefault {
+		return
+	}
+	if err := p.apply(mptcp.PolicyDefault, p.iface); err != nil {
+		log.Printf("Failed to restore the default transport profile: %v\n", err)
+		return
+	}
+	if p.active == mptcp.PolicyRedundant && !p.restoreScheduler() {
+		// tried again when the next profile is applied
+		return
+	}
+	p.active = mptcp.PolicyDefault
+}
+
+// restoreScheduler puts back the scheduler redundant replaced, after the
+// profile following it has been applied.
+func (p *sessionProfiles) restoreScheduler() bool {
+	if err := p.setScheduler(p.prevScheduler); err != nil {
+		log.Printf("Failed to restore the MPTCP scheduler %s: %v\n", p.prevScheduler, err)
+		return false
+	}
+	log.Printf("MPTCP scheduler %s restored\n", p.prevScheduler)
+	return true
+}
@@ -0,0 +1,94 @@
+package agent
+
+import (
+	"errors"
+	"smart-agent/mptcp"
+	"testing"
+)
+
+func TestSessionProfiles(t *testing.T) {
+	var applied []string
+	p := newSessionProfiles("", "eth0")
+	p.apply = func(policy, iface string) error {
+		if policy == mptcp.PolicyRedundant {
+			return errors.New("no redundant scheduler")
+		}
+		applied = append(applied, policy)
+		return nil
+	}
+
+	if got, _ := p.acquire(""); got != mptcp.PolicyDefault {
+		t.Fatalf("no request: got %s", got)
+	}
+	got, release1 := p.acquire(mptcp.PolicyFullmesh)
+	if got != mptcp.PolicyFullmesh {
+		t.Fatalf("first session: got %s", got)
+	}
+	// a second session shares the profile, a third one cannot change it
+	got, release2 := p.acquire(mptcp.PolicyFullmesh)
+	if got != mptcp.PolicyFullmesh {
+		t.Fatalf("second session: got %s", got)
+	}
+	if got, _ := p.acquire(mptcp.PolicyBackup); got != mptcp.PolicyFullmesh {
+		t.Fatalf("conflicting session: got %s", got)
+	}
+	release1()
+	release1()
+	if len(applied) != 1 {
+		t.Fatalf("default restored while a session uses the profile: %v", applied)
+	}
+	release2()
+	if len(applied) != 2 || applied[1] != mptcp.PolicyDefault {
+		t.Fatalf("default not restored: %v", applied)
+	}
+
+	// a profile the kernel cannot do is reported as not taken
+	if got, _ := p.acquire(mptcp.PolicyRedundant); got != mptcp.PolicyDefault {
+		t.Fatalf("failed profile: got %s", got)
+	}
+
+	pinned := newSessionProfiles(mptcp.PolicyBackup, "eth0")
+	pinned.apply = func(string, string) error { t.Fatal("pinned profile changed"); return nil }
+	if got, _ := pinned.acquire(mptcp.PolicyFullmesh); got != mptcp.PolicyBackup {
+		t.Fatalf("pinned: got %s", got)
+	}
+}
+
+func TestSessionProfilesScheduler(t *testing.T) {
+	scheduler := "blest"
+	p := newSessionProfiles("", "eth0")
+	p.apply = func(policy, iface string) error {
+		switch policy {
+		case mptcp.PolicyRedundant:
+			scheduler = "redundant"
+		case mptcp.PolicyDefault:
+			scheduler = "default"
+		}
+		return nil
+	}
+	p.scheduler = func() (string, error) { return scheduler, nil }
+	p.setScheduler = func(s string) error { scheduler = s; return nil }
+
+	// the scheduler is pod-wide, the one before redundant is put back when
+	// its sessions are gone
+	_, release := p.acquire(mptcp.PolicyRedundant)
+	if scheduler != "redundant" {
+		t.Fatalf("redundant applied: scheduler %s", scheduler)
+	}
+	release()
+	if scheduler != "blest" {
+		t.Fatalf("redundant released: scheduler %s", scheduler)
+	}
+
+	// nor is it left set when a restore failed and another profile follows
+	_, release = p.acquire(mptcp.PolicyRedundant)
+	p.setScheduler = func(string) error { return errors.New("read-only") }
+	release()
+	if got, _ := p.acquire(""); got != mptcp.PolicyRedundant {
+		t.Fatalf("failed restore: profile %s", got)
+	}
+	p.setScheduler = func(s string) error { scheduler = s; return nil }
+	if got, _ := p.acquire(mptcp.PolicyFullmesh); got != mptcp.PolicyFullmesh || scheduler != "blest" {
+		t.Fatalf("after redundant: profile %s, scheduler %s", got, scheduler)
+	}
+}
@@ -0,0 +1,247 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"smart-agent/protocol"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Retention bounds what an agent keeps of a stream of a client: frames
+// older than MaxAge, and the oldest ones beyond MaxCount frames or MaxBytes
+// of payload, are evicted. A zero field bounds nothing.
+type Retention struct {
+	MaxAge   time.Duration
+	MaxCount int
+	MaxBytes int64
+}
+
+// Evicted is what the retention dropped from a stream.
+type Evicted struct {
+	Frames int
+	Bytes  int64
+	// frames among them whose TTL had passed
+	Expired int
+}
+
+// frameInfo is what the retention looks at of a stored frame.
+type frameInfo struct {
+	at      time.Time
+	bytes   int64
+	expires int64
+}
+
+// evictHead returns how many frames at the head of frames, oldest first,
+// go under r at now: those r does not keep and those whose TTL has passed.
+// Expired frames further back go once they reach the head, they are not
+// replayed meanwhile.
+func evictHead(frames []frameInfo, r Retention, now time.Time) (int, Evicted) {
+	var total int64
+	for _, f := range frames {
+		total += f.bytes
+	}
+	var ev Evicted
+	for _, f := range frames {
+		left := len(frames) - ev.Frames
+		expired := f.expires != 0 && now.UnixMilli() >= f.expires
+		if !(r.MaxAge > 0 && now.Sub(f.at) > r.MaxAge) &&
+			!(r.MaxCount > 0 && left > r.MaxCount) &&
+			!(r.MaxBytes > 0 && total-ev.Bytes > r.MaxBytes) &&
+			!expired {
+			break
+		}
+		if expired {
+			ev.Expired++
+		}
+		ev.Frames++
+		ev.Bytes += f.bytes
+	}
+	return ev.Frames, ev
+}
+
+// live reports whether m is still worth delivering. A frame whose TTL has
+// passed is neither migrated nor replayed.
+func live(m *protocol.Data) bool {
+	return m.Expires == 0 || time.Now().UnixMilli() < m.Expires
+}
+
+type retentionRule struct {
+	pattern string
+	r       Retention
+}
+
+// RetentionPolicy says how long the streams of each client are kept. A nil
+// policy keeps everything until it is acked. Each line of a retention file
+// is a rule
+//
+//	<client> <max-age> <max-count> <max-bytes>
+//
+// where client is a client id, a namespace of them like cam-* or *, and - is
+// no bound. Ages are durations like 1h, bytes may end in KiB, MiB or GiB. A
+// client gets the rule of its id, else of its longest namespace, else *.
+// Blank lines and lines starting with # are skipped.
+type RetentionPolicy struct {
+	rules []retentionRule
+}
+
+// LoadRetention reads a retention file.
+func LoadRetention(path string) (*RetentionPolicy, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseRetention(f)
+}
+
+// ParseRetention reads retention rules from r.
+func ParseRetention(r io.Reader) (*RetentionPolicy, error) {
+	p := &RetentionPolicy{}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("agent: retention line %d: want <client> <max-age> <max-count> <max-bytes>", n)
+		}
+		var rule retentionRule
+		var err error
+		rule.pattern = fields[0]
+		if fields[1] != "-" {
+			if rule.r.MaxAge, err = time.ParseDuration(fields[1]); err != nil {
+				return nil, fmt.Errorf("agent: retention line %d: %v", n, err)
+			}
+		}
+		if fields[2] != "-" {
+			if rule.r.MaxCount, err = strconv.Atoi(fields[2]); err != nil {
+				return nil, fmt.Errorf("agent: retention line %d: bad count %q", n, fields[2])
+			}
+		}
+		if fields[3] != "-" {
+			if rule.r.MaxBytes, err = parseBytes(fields[3]); err != nil {
+				return nil, fmt.Errorf("agent: retention line %d: %v", n, err)
+			}
+		}
+		p.rules = append(p.rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func parseBytes(s string) (int64, error) {
+	mult := int64(1)
+	for _, u := range []struct {
+		suffix string
+		mult   int64
+	}{{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}} {
+		if strings.HasSuffix(s, u.suffix) {
+			s, mult = strings.TrimSuffix(s, u.suffix), u.mult
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("bad size %q", s)
+	}
+	return n * mult, nil
+}
+
+// For returns the retention of the streams of clientId.
+func (p *RetentionPolicy) For(clientId string) Retention {
+	if p == nil {
+		return Retention{}
+	}
+	var best *retentionRule
+	// the id itself wins, then the longest namespace, then *
+	score := func(pattern string) int {
+		switch {
+		case pattern == clientId:
+			return len(clientId) + 2
+		case pattern == "*":
+			return 0
+		case strings.HasSuffix(pattern, "*") && strings.HasPrefix(clientId, strings.TrimSuffix(pattern, "*")):
+			return len(pattern)
+		}
+		return -1
+	}
+	for i := range p.rules {
+		s := score(p.rules[i].pattern)
+		if s >= 0 && (best == nil || s > score(best.pattern)) {
+			best = &p.rules[i]
+		}
+	}
+	if best == nil {
+		return Retention{}
+	}
+	return best.r
+}
+
+// collect enforces the retention on every stream stored every interval
+// until ctx is done.
+func (ser *AgentServer) collect(ctx context.Context) {
+	ticker := time.NewTicker(ser.cfg.RetentionInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			func() {
+				// a failing store never takes the agent down
+				defer func() {
+					if r := recover(); r != nil {
+						handlerPanics.Add(1)
+						log.Printf("retention collector panicked: %v\n", r)
+					}
+				}()
+				ser.enforceRetention(ctx)
+			}()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// enforceRetention evicts what the retention does not keep from every
+// stream, and reports it in the log and the metrics.
+func (ser *AgentServer) enforceRetention(ctx context.Context) Evicted {
+	var total Evicted
+	keys, err := ser.store.Keys(ctx)
+	if err != nil {
+		log.Println("Failed to list stored streams:", err)
+		return total
+	}
+	now := time.Now()
+	for _, key := range keys {
+		// the frames of a stream in transit are the migration's to drop
+		if ser.inTransit(key) {
+			continue
+		}
+		// a sender's pending frames are kept like its data
+		clientId := strings.TrimPrefix(key, pendingKey(""))
+		ev, err := ser.store.Retain(ctx, key, ser.cfg.Retention.For(clientId), now)
+		if err != nil {
+			log.Printf("Failed to enforce retention on %s: %v\n", key, err)
+			continue
+		}
+		if ev.Frames == 0 {
+			continue
+		}
+		log.Printf("evicted %d frames, %d bytes of %s\n", ev.Frames, ev.Bytes, key)
+		framesEvicted.Add(clientId, int64(ev.Frames))
+		bytesEvicted.Add(clientId, ev.Bytes)
+		framesExpired.Add(int64(ev.Expired))
+		total.Frames += ev.Frames
+		total.Bytes += ev.Bytes
+	}
+	return total
+}
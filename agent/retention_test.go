@@ -0,0 +1,119 @@
+package agent
+
+import (
+	"context"
+	"expvar"
+	"smart-agent/protocol"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetentionPolicy(t *testing.T) {
+	p, err := ParseRetention(strings.NewReader(`
+# client  max-age  max-count  max-bytes
+*         24h      -          1GiB
+cam-*     1h       100        -
+cam-7     -        10         64KiB
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		client string
+		want   Retention
+	}{
+		{"cli1", Retention{MaxAge: 24 * time.Hour, MaxBytes: 1 << 30}},
+		{"cam-1", Retention{MaxAge: time.Hour, MaxCount: 100}},
+		{"cam-7", Retention{MaxCount: 10, MaxBytes: 64 << 10}},
+	} {
+		if got := p.For(c.client); got != c.want {
+			t.Errorf("retention of %s = %+v, want %+v", c.client, got, c.want)
+		}
+	}
+	if _, err := ParseRetention(strings.NewReader("* 1h 10")); err == nil {
+		t.Error("rule without max-bytes accepted")
+	}
+	var none *RetentionPolicy
+	if got := none.For("cli1"); got != (Retention{}) {
+		t.Errorf("nil policy keeps %+v", got)
+	}
+}
+
+func TestStorageRetain(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	for name, s := range stores(t) {
+		// 7 bytes a frame
+		appendSeqs(t, s, 1, 10)
+		ev, err := s.Retain(ctx, "a", Retention{MaxCount: 8}, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ev.Frames != 2 || ev.Bytes != 14 || ev.Expired != 0 {
+			t.Fatalf("%s: count retention evicted %+v", name, ev)
+		}
+		ev, _ = s.Retain(ctx, "a", Retention{MaxBytes: 35}, now)
+		if all := rangeAll(t, s); ev.Frames != 3 || len(all) != 5 || all[0] != 6 {
+			t.Fatalf("%s: bytes retention evicted %+v, left %v", name, ev, all)
+		}
+		// a frame at the head whose TTL has passed goes under any retention
+		if _, err := s.Append(ctx, "b", &protocol.Data{Seq: 1, Expires: now.Add(-time.Second).UnixMilli()}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Append(ctx, "b", &protocol.Data{Seq: 2}); err != nil {
+			t.Fatal(err)
+		}
+		if ev, _ := s.Retain(ctx, "b", Retention{}, now); ev.Frames != 1 || ev.Expired != 1 {
+			t.Fatalf("%s: expired frames evicted %+v", name, ev)
+		}
+		ev, _ = s.Retain(ctx, "a", Retention{MaxAge: time.Hour}, now.Add(2*time.Hour))
+		if ev.Frames != 5 {
+			t.Fatalf("%s: age retention evicted %+v", name, ev)
+		}
+		keys, err := s.Keys(ctx)
+		if err != nil || len(keys) != 2 {
+			t.Fatalf("%s: keys %v, %v", name, keys, err)
+		}
+	}
+}
+
+func TestEnforceRetention(t *testing.T) {
+	policy, err := ParseRetention(strings.NewReader("s1 - 2 -\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ser, _, _ := startAgent(t, func(cfg *Config) { cfg.Retention = policy })
+	for seq := uint64(1); seq <= 5; seq++ {
+		if err := ser.pushData("s1", &protocol.Data{Sender: "s1", Seq: seq}); err != nil {
+			t.Fatal(err)
+		}
+		if err := ser.pushData("s2", &protocol.Data{Sender: "s2", Seq: seq}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	evicted := func() int64 {
+		if v, ok := framesEvicted.Get("s1").(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	before := evicted()
+	if ev := ser.enforceRetention(context.Background()); ev.Frames != 3 {
+		t.Fatalf("evicted %+v, want 3 frames of s1", ev)
+	}
+	if n := evicted() - before; n != 3 {
+		t.Fatalf("metrics count %d frames of s1 evicted, want 3", n)
+	}
+	// frames whose TTL passed are not replayed even if they are kept
+	if err := ser.pushData("s2", &protocol.Data{Sender: "s2", Seq: 6, Expires: 1}); err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	if err := ser.rangeData("s2", func(*protocol.Data) error { n++; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if n != 5 {
+		t.Fatalf("replayed %d frames of s2, want 5", n)
+	}
+}
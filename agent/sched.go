@@ -0,0 +1,287 @@
+package agent
+
+import (
+	"fmt"
+	"smart-agent/protocol"
+	"sync"
+)
+
+// How the senders of one receiver share it.
+const (
+	// SchedPriority serves the highest priority first, round robin among
+	// equal ones; the lower ones still get the minimum share.
+	SchedPriority = "priority"
+	// SchedWFQ shares the receiver in proportion to the weights, by the
+	// virtual start of the next quantum of every sender.
+	SchedWFQ = "wfq"
+	// SchedDRR is deficit round robin, every round a sender may send
+	// quantum times its weight bytes plus what it left over.
+	SchedDRR = "drr"
+)
+
+// share of the bytes lower priorities get under SchedPriority while a
+// higher one has data too
+const defaultMinShare = 0.1
+
+// grant lets a sender send budget bytes of frames to its receiver. A sender
+// with first set sends its first frame even if it is larger.
+type grant struct {
+	budget int
+	first  bool
+}
+
+// flow is a sender in the scheduler of its receiver.
+type flow struct {
+	id       string
+	priority int
+	weight   int
+	// the grants of the sender, one at most is outstanding
+	grants     chan grant
+	backlogged bool
+	// bytes DRR allows the sender beyond what it sent
+	deficit int
+	// virtual start of the next quantum, WFQ
+	start float64
+	sent  uint64
+}
+
+// scheduler decides which of the senders to one receiver sends next. The
+// senders ask for a grant when they have frames, it hands out one grant at
+// a time and a sender sends at most a quantum under it, so a sender of a
+// higher priority that shows up mid-stream goes next.
+type scheduler struct {
+	mu       sync.Mutex
+	policy   string
+	quantum  int
+	minShare float64
+	flows    map[string]*flow
+	// backlogged flows in round robin order
+	active []*flow
+	// the flow holding the grant and how it got it
+	busy      *flow
+	contended bool
+	low       bool
+	// WFQ virtual time
+	vtime float64
+	// bytes sent while lower priorities were backlogged too, and the part
+	// of them the lower ones sent
+	contendedBytes uint64
+	lowBytes       uint64
+}
+
+func newScheduler(policy string, quantum int, minShare float64) *scheduler {
+	return &scheduler{
+		policy:   policy,
+		quantum:  quantum,
+		minShare: minShare,
+		flows:    make(map[string]*flow),
+	}
+}
+
+func checkSchedPolicy(policy string) error {
+	switch policy {
+	case SchedPriority, SchedWFQ, SchedDRR:
+		return nil
+	}
+	return fmt.Errorf("unknown scheduler %q", policy)
+}
+
+// frameCost is what a frame counts against a grant.
+func frameCost(m *protocol.Data) int {
+	if len(m.Payload) == 0 {
+		return 1
+	}
+	return len(m.Payload)
+}
+
+func (sc *scheduler) join(id string, priority, weight int) *flow {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if weight < 1 {
+		weight = 1
+	}
+	f := &flow{id: id, priority: priority, weight: weight, grants: make(chan grant, 1)}
+	sc.flows[id] = f
+	return f
+}
+
+// leave removes f, it reports whether no sender is left.
+func (sc *scheduler) leave(f *flow) bool {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.flows[f.id] == f {
+		delete(sc.flows, f.id)
+	}
+	sc.deactivate(f)
+	if sc.busy == f {
+		sc.busy = nil
+	}
+	sc.dispatch()
+	return len(sc.flows) == 0
+}
+
+// ready tells the scheduler f has frames to send.
+func (sc *scheduler) ready(f *flow) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if f.backlogged || sc.flows[f.id] != f {
+		return
+	}
+	f.backlogged = true
+	if f.start < sc.vtime {
+		// no credit for the time it had nothing to send
+		f.start = sc.vtime
+	}
+	sc.active = append(sc.active, f)
+	sc.dispatch()
+}
+
+// done returns the grant of f, which sent used bytes under it and has
+// frames left if backlogged.
+func (sc *scheduler) done(f *flow, used int, backlogged bool) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.busy != f {
+		return
+	}
+	sc.busy = nil
+	f.sent += uint64(used)
+	if sc.contended {
+		sc.contendedBytes += uint64(used)
+		if sc.low {
+			sc.lowBytes += uint64(used)
+		}
+	}
+	switch sc.policy {
+	case SchedWFQ:
+		f.start += float64(used) / float64(f.weight)
+	case SchedDRR:
+		f.deficit -= used
+	}
+	if backlogged {
+		// the next round starts with the others
+		sc.remove(f)
+		sc.active = append(sc.active, f)
+	} else {
+		sc.deactivate(f)
+	}
+	sc.dispatch()
+}
+
+func (sc *scheduler) remove(f *flow) {
+	for i, a := range sc.active {
+		if a == f {
+			sc.active = append(sc.active[:i], sc.active[i+1:]...)
+			return
+		}
+	}
+}
+
+func (sc *scheduler) deactivate(f *flow) {
+	sc.remove(f)
+	f.backlogged = false
+	f.deficit = 0
+}
+
+// dispatch hands the next grant out unless one is outstanding.
+func (sc *scheduler) dispatch() {
+	if sc.busy != nil || len(sc.active) == 0 {
+		return
+	}
+	var f *flow
+	g := grant{budget: sc.quantum, first: true}
+	switch sc.policy {
+	case SchedDRR:
+		f = sc.active[0]
+		f.deficit += sc.quantum * f.weight
+		g = grant{budget: f.deficit}
+	case SchedWFQ:
+		f = sc.active[0]
+		for _, a := range sc.active[1:] {
+			if a.start < f.start {
+				f = a
+			}
+		}
+		sc.vtime = f.start
+	default:
+		f = sc.pickPriority()
+	}
+	sc.busy = f
+	select {
+	case f.grants <- g:
+	default:
+	}
+}
+
+// pickPriority picks the first flow of the highest priority in round robin
+// order, or the first of the lower ones while they got less than their
+// minimum share.
+func (sc *scheduler) pickPriority() *flow {
+	top := sc.active[0].priority
+	for _, a := range sc.active[1:] {
+		if a.priority > top {
+			top = a.priority
+		}
+	}
+	var high, low *flow
+	for _, a := range sc.active {
+		if a.priority == top {
+			if high == nil {
+				high = a
+			}
+		} else if low == nil {
+			low = a
+		}
+	}
+	sc.contended = low != nil
+	sc.low = false
+	if low == nil {
+		// the share is kept per busy period of the lower priorities
+		sc.contendedBytes, sc.lowBytes = 0, 0
+		return high
+	}
+	if float64(sc.lowBytes) < sc.minShare*float64(sc.contendedBytes) {
+		sc.low = true
+		return low
+	}
+	return high
+}
+
+// flowStats is a sender of a receiver as shown in the metrics.
+type flowStats struct {
+	Priority   int
+	Weight     int
+	SentBytes  uint64
+	Backlogged bool
+}
+
+func (sc *scheduler) stats() map[string]flowStats {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	st := make(map[string]flowStats, len(sc.flows))
+	for id, f := range sc.flows {
+		st[id] = flowStats{Priority: f.priority, Weight: f.weight, SentBytes: f.sent, Backlogged: f.backlogged}
+	}
+	return st
+}
+
+// joinScheduler adds a sender to the scheduler of its receiver.
+func (ser *AgentServer) joinScheduler(receiverId, senderId string, priority, weight int) (*scheduler, *flow) {
+	ser.mu.Lock()
+	defer ser.mu.Unlock()
+	sc, ok := ser.schedulers[receiverId]
+	if !ok {
+		sc = newScheduler(ser.cfg.Scheduler, ser.cfg.Quantum, ser.cfg.MinShare)
+		ser.schedulers[receiverId] = sc
+	}
+	return sc, sc.join(senderId, priority, weight)
+}
+
+// leaveScheduler removes a sender, and the scheduler with the last one.
+func (ser *AgentServer) leaveScheduler(receiverId string, sc *scheduler, f *flow) {
+	ser.mu.Lock()
+	defer ser.mu.Unlock()
+	if sc.leave(f) && ser.schedulers[receiverId] == sc {
+		delete(ser.schedulers, receiverId)
+	}
+}
@@ -0,0 +1,121 @@
+package agent
+
+import (
+	"math"
+	"testing"
+)
+
+// next returns the flow among flows holding the grant, and the grant.
+func next(t *testing.T, flows []*flow) (*flow, grant) {
+	t.Helper()
+	for _, f := range flows {
+		select {
+		case g := <-f.grants:
+			return f, g
+		default:
+		}
+	}
+	t.Fatal("no flow holds a grant")
+	return nil, grant{}
+}
+
+// serve hands out n grants of sc to flows that are always backlogged and
+// send frames of frame bytes, it returns the bytes each flow sent.
+func serve(t *testing.T, sc *scheduler, flows []*flow, n, frame int) map[string]int {
+	t.Helper()
+	sent := make(map[string]int)
+	for i := 0; i < n; i++ {
+		f, g := next(t, flows)
+		used := g.budget / frame * frame
+		if used == 0 && g.first {
+			used = frame
+		}
+		sent[f.id] += used
+		sc.done(f, used, true)
+	}
+	return sent
+}
+
+func TestSchedWeights(t *testing.T) {
+	for _, policy := range []string{SchedWFQ, SchedDRR} {
+		sc := newScheduler(policy, 1500, defaultMinShare)
+		flows := []*flow{sc.join("a", 0, 1), sc.join("b", 0, 2), sc.join("c", 0, 3)}
+		for _, f := range flows {
+			sc.ready(f)
+		}
+		sent := serve(t, sc, flows, 600, 1000)
+		total := sent["a"] + sent["b"] + sent["c"]
+		for _, f := range flows {
+			share := float64(sent[f.id]) / float64(total)
+			if want := float64(f.weight) / 6; math.Abs(share-want) > 0.03 {
+				t.Errorf("%s: %s got %.3f of the bytes, want %.3f", policy, f.id, share, want)
+			}
+		}
+	}
+}
+
+func TestSchedPriority(t *testing.T) {
+	sc := newScheduler(SchedPriority, 1000, defaultMinShare)
+	low := sc.join("low", 1, 1)
+	sc.ready(low)
+	flows := []*flow{low}
+	if sent := serve(t, sc, flows, 10, 1000); sent["low"] != 10000 {
+		t.Fatalf("low alone sent %d bytes", sent["low"])
+	}
+
+	// high shows up while low holds a grant and goes next
+	f, g := next(t, flows)
+	high := sc.join("high", 2, 1)
+	sc.ready(high)
+	flows = append(flows, high)
+	sc.done(f, g.budget, true)
+	if f, _ := next(t, flows); f != high {
+		t.Fatalf("grant went to %s after high arrived", f.id)
+	}
+	sc.done(high, 1000, true)
+
+	// low keeps its minimum share
+	sent := serve(t, sc, flows, 200, 1000)
+	share := float64(sent["low"]) / float64(sent["low"]+sent["high"])
+	if share < defaultMinShare/2 || share > defaultMinShare*1.5 {
+		t.Fatalf("low got %.3f of the bytes, want about %.2f", share, defaultMinShare)
+	}
+
+	// low has it all again once high leaves
+	for {
+		f, g := next(t, flows)
+		if f == high {
+			sc.leave(high)
+			break
+		}
+		sc.done(f, g.budget, true)
+	}
+	if sent := serve(t, sc, flows[:1], 10, 1000); sent["low"] != 10000 {
+		t.Fatalf("low sent %d bytes after high left", sent["low"])
+	}
+}
+
+func TestSchedIdle(t *testing.T) {
+	sc := newScheduler(SchedDRR, 1000, defaultMinShare)
+	a, b := sc.join("a", 0, 1), sc.join("b", 0, 1)
+	sc.ready(a)
+	f, g := next(t, []*flow{a, b})
+	if f != a {
+		t.Fatalf("grant went to %s", f.id)
+	}
+	// a flow that ran out of frames gets no grants and keeps no deficit
+	sc.done(a, g.budget/2, false)
+	if a.backlogged || a.deficit != 0 {
+		t.Fatalf("idle flow kept backlogged %v, deficit %d", a.backlogged, a.deficit)
+	}
+	sc.ready(b)
+	if f, _ := next(t, []*flow{a, b}); f != b {
+		t.Fatalf("grant went to %s", f.id)
+	}
+	if sc.leave(b) {
+		t.Fatal("scheduler empty with a still in it")
+	}
+	if !sc.leave(a) {
+		t.Fatal("scheduler not empty after the last flow left")
+	}
+}
@@ -0,0 +1,801 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"smart-agent/protocol"
+	"time"
+)
+
+// senderState is where the session of a sender is in its life.
+type senderState int
+
+const (
+	// the receiver has not connected to any agent yet, frames are buffered
+	stateWaitingReceiver senderState = iota
+	// the receiver is known but another sender goes first, or the receiver
+	// is not ready on this agent yet, frames are buffered
+	stateBuffering
+	// the receiver has no credit for the next frame, frames are buffered
+	// and spilled to the storage once the buffer is full
+	stateBlocked
+	// frames go to the receiver as they come
+	stateStreaming
+	// the sender exited, what it buffered is flushed and its last frame
+	// waits for the ack of the receiver
+	stateDraining
+	stateClosed
+)
+
+func (s senderState) String() string {
+	switch s {
+	case stateWaitingReceiver:
+		return "waiting-for-receiver"
+	case stateBuffering:
+		return "buffering"
+	case stateBlocked:
+		return "blocked"
+	case stateStreaming:
+		return "streaming"
+	case stateDraining:
+		return "draining"
+	case stateClosed:
+		return "closed"
+	}
+	return fmt.Sprintf("state(%d)", int(s))
+}
+
+// senderSession is the stream of a sender to its receiver. Its state is
+// only touched by run, the request loop of the client, the registry watch,
+// the receiver's handler, the ack readers and the other senders talk to it
+// over channels.
+type senderSession struct {
+	ser        *AgentServer
+	id         string
+	receiverId string
+	token      string
+	// cluster ip of this agent as the client knows it
+	clusterIp string
+	out       *connWriter
+	failed    *failer
+
+	// Data and Exit of the client, closed when the client is gone
+	inbox chan protocol.Message
+	// cluster ips of the receiver from the registry
+	receiverCh chan string
+	// the receiver waits for the frames on this agent
+	readyCh  chan struct{}
+	ackCh    chan uint64
+	creditCh chan uint64
+	// transfer conns whose ack reader stopped
+	brokenCh chan *protocol.Conn
+	// closed when run returns
+	done chan struct{}
+	// the share of the receiver the session gets, grants come on flow
+	sched *scheduler
+	flow  *flow
+
+	// owned by run
+	state      senderState
+	receiverIp string
+	// set when the receiver shows up or moves to another agent
+	receiverMoved bool
+	buffered      []*protocol.Data
+	transfer      *protocol.Conn
+	broken        bool
+	// a grant has been asked for
+	waiting bool
+	// bytes of buffered and how many it may hold, the frames from spillFrom
+	// to spillTo are only in the pending copy until buffered has room
+	bufferedBytes int
+	bufferLimit   int
+	spillFrom     uint64
+	spillTo       uint64
+	// last seq the receiver has credit for, a receiver that has not granted
+	// any yet is not held back
+	credit   uint64
+	credited bool
+	// last seq received from the client, acked by the receiver and sent
+	// over transfer
+	lastSeq uint64
+	acked   uint64
+	sentSeq uint64
+	// the client sent Exit and the stream has been ended
+	exited   bool
+	endSent  bool
+	deadline <-chan time.Time
+}
+
+// startSender starts the session of the sender reg registered on conn.
+func (ser *AgentServer) startSender(reg *protocol.Register, token string, registered *protocol.Registered, out *connWriter, rawConn io.Closer) *senderSession {
+	s := &senderSession{
+		ser:         ser,
+		id:          reg.ClientId,
+		receiverId:  reg.Receiver,
+		token:       token,
+		clusterIp:   reg.ClusterIp,
+		out:         out,
+		failed:      &failer{kind: "client", out: out},
+		inbox:       make(chan protocol.Message),
+		receiverCh:  make(chan string),
+		readyCh:     make(chan struct{}, 1),
+		ackCh:       make(chan uint64, 1),
+		creditCh:    make(chan uint64, 1),
+		brokenCh:    make(chan *protocol.Conn),
+		done:        make(chan struct{}),
+		lastSeq:     registered.Seq,
+		bufferLimit: ser.cfg.SessionBuffer,
+	}
+	if registered.Resumed {
+		s.acked = reg.Acked
+	}
+	// without a weight of its own a sender weighs its priority
+	weight := int(reg.Weight)
+	if weight == 0 {
+		weight = int(reg.Priority)
+	}
+	s.sched, s.flow = ser.joinScheduler(s.receiverId, s.id, int(reg.Priority), weight)
+	ser.mu.Lock()
+	ser.bufferMap[s.id] = SenderBuffer{
+		senderId:   s.id,
+		receiverId: s.receiverId,
+		readyCh:    s.readyCh,
+		ackCh:      s.ackCh,
+		creditCh:   s.creditCh,
+	}
+	ser.mu.Unlock()
+	spawn("client", rawConn, s.run)
+	spawn("client", rawConn, s.watchReceiver)
+	return s
+}
+
+// stop ends the session once the client is gone and waits until it is over.
+func (s *senderSession) stop() {
+	close(s.inbox)
+	<-s.done
+}
+
+// deliver hands m of the client to run, false once the session is over.
+func (s *senderSession) deliver(m protocol.Message) bool {
+	select {
+	case s.inbox <- m:
+		return true
+	case <-s.done:
+		return false
+	}
+}
+
+// setState moves the session to st, a draining session stays draining
+// until it is closed.
+func (s *senderSession) setState(st senderState) {
+	if s.state == st || (s.state == stateDraining && st != stateClosed) {
+		return
+	}
+	log.Printf("sender %s: %s -> %s\n", s.id, s.state, st)
+	s.state = st
+}
+
+// run drives the session until the client is gone or has exited.
+func (s *senderSession) run() {
+	defer close(s.done)
+	defer s.close()
+	for s.state != stateClosed {
+		var err error
+		select {
+		case m, ok := <-s.inbox:
+			if !ok {
+				s.setState(stateClosed)
+				break
+			}
+			switch m := m.(type) {
+			case *protocol.Data:
+				err = s.onData(m)
+			case *protocol.Exit:
+				err = s.onExit(m)
+			case *protocol.Credit:
+				err = s.onCredit(m.Seq)
+			}
+		case ip := <-s.receiverCh:
+			err = s.onReceiver(ip)
+		case g := <-s.flow.grants:
+			err = s.onGrant(g)
+		case <-s.readyCh:
+			err = s.pump()
+		case seq := <-s.ackCh:
+			s.onAck(seq)
+		case seq := <-s.creditCh:
+			err = s.onCredit(seq)
+		case c := <-s.brokenCh:
+			if c == s.transfer {
+				s.broken = true
+			}
+		case <-s.deadline:
+			s.finish()
+		}
+		if err == nil && s.state == stateDraining && !s.endSent {
+			err = s.endStream()
+		}
+		if err != nil {
+			// closing the client conn makes the request loop fail too
+			s.failed.fail(s.failure(err))
+			s.setState(stateClosed)
+		}
+	}
+}
+
+// failure is how a failed stream to the receiver, which is another agent
+// unless it is local, ends the conn of the client.
+func (s *senderSession) failure(err error) error {
+	var cerr *ConnError
+	if errors.As(err, &cerr) {
+		return err
+	}
+	return connError(protocol.ErrCodeUnavailable, "transfer data of %s: %w", s.id, err)
+}
+
+// close ends the stream to the receiver and leaves the scheduler to the
+// other senders.
+func (s *senderSession) close() {
+	ser := s.ser
+	if s.transfer != nil {
+		if ser.isDraining() && !s.exited && !s.broken {
+			// the stream goes on from the agent the sender moves to
+			if err := s.transfer.Send(&protocol.TransferEnd{ClientId: s.id, Moving: true}); err != nil {
+				log.Printf("Failed to close transfer of %s: %v\n", s.id, err)
+			}
+		}
+		s.transfer.Close()
+	}
+	ser.mu.Lock()
+	delete(ser.bufferMap, s.id)
+	ser.mu.Unlock()
+	ser.leaveScheduler(s.receiverId, s.sched, s.flow)
+}
+
+func (s *senderSession) onData(data *protocol.Data) error {
+	data.Sender = s.id
+	if data.Seq != 0 && data.Seq <= s.lastSeq {
+		// sent again by the client after it moved, the agents hold it
+		log.Printf("drop duplicate frame %d of %s\n", data.Seq, s.id)
+		return nil
+	}
+	if data.Seq != 0 {
+		s.lastSeq = data.Seq
+	}
+	// keep a copy until the receiver acks it, for retransmission
+	pushErr := s.ser.pushPending(s.id, data)
+	if pushErr != nil {
+		log.Printf("Failed to keep pending copy of %s: %v\n", s.id, pushErr)
+	}
+	// frames go out in order, after whatever is buffered or spilled; frames
+	// without a seq cannot be read back and are always buffered
+	if data.Seq != 0 && (s.spillFrom != 0 || s.full(data)) {
+		if err := s.spill(data, pushErr); err != nil {
+			return err
+		}
+	} else {
+		s.buffer(data)
+	}
+	return s.pump()
+}
+
+// full reports whether buffered has no room for data.
+func (s *senderSession) full(data *protocol.Data) bool {
+	return len(s.buffered) > 0 && s.bufferedBytes+frameCost(data) > s.bufferLimit
+}
+
+func (s *senderSession) buffer(data *protocol.Data) {
+	s.buffered = append(s.buffered, data)
+	s.bufferedBytes += frameCost(data)
+}
+
+// spill leaves data in the pending copy only, and tells the sender to slow
+// down when the spill starts.
+func (s *senderSession) spill(data *protocol.Data, pushErr error) error {
+	if pushErr != nil {
+		return connError(protocol.ErrCodeUnavailable, "spill frame %d of %s: %w", data.Seq, s.id, pushErr)
+	}
+	if s.spillFrom == 0 {
+		log.Printf("buffer of %s is full, spill frames from %d\n", s.id, data.Seq)
+		s.spillFrom = data.Seq
+		if err := s.out.Post(&protocol.Busy{Seq: data.Seq}); err != nil {
+			log.Printf("Failed to tell %s it is busy: %v\n", s.id, err)
+		}
+	}
+	s.spillTo = data.Seq
+	framesSpilled.Add(1)
+	return nil
+}
+
+// errBufferFull stops reading spilled frames back.
+var errBufferFull = errors.New("sender buffer full")
+
+// refill reads spilled frames back from the pending copy once buffered is
+// half empty, until it is full again.
+func (s *senderSession) refill() error {
+	if s.spillFrom == 0 || s.bufferedBytes > s.bufferLimit/2 {
+		return nil
+	}
+	to := s.spillTo
+	err := s.ser.rangeData(pendingKey(s.id), func(m *protocol.Data) error {
+		if m.Seq < s.spillFrom || m.Seq > to {
+			return nil
+		}
+		if s.full(m) {
+			return errBufferFull
+		}
+		m.Sender = s.id
+		s.buffer(m)
+		s.spillFrom = m.Seq + 1
+		return nil
+	})
+	if err == errBufferFull {
+		return nil
+	}
+	if err != nil {
+		return connError(protocol.ErrCodeUnavailable, "read back spilled frames of %s: %w", s.id, err)
+	}
+	// frames missing from the pending copy were acked after a replay
+	log.Printf("spilled frames of %s up to %d are buffered again\n", s.id, to)
+	s.spillFrom, s.spillTo = 0, 0
+	return nil
+}
+
+func (s *senderSession) onExit(m *protocol.Exit) error {
+	if !m.Moving {
+		// the last frames are sent before the stream is ended
+		s.exited = true
+		s.setState(stateDraining)
+		return s.pump()
+	}
+	// pending frames stay in redis for the agent the sender moves to
+	log.Printf("sender %s moves to another agent\n", s.id)
+	if s.ser.isDraining() {
+		// what is buffered goes to the receiver now if it may, it is
+		// pending for the next agent either way
+		ready, err := s.receiverReady()
+		if err == nil && ready {
+			_, err = s.send(-1, false)
+		}
+		if err != nil {
+			log.Printf("Failed to flush buffered data of %s: %v\n", s.id, err)
+		}
+		s.ser.expectMigration(s.id, pendingKey(s.id))
+	}
+	s.setState(stateClosed)
+	return nil
+}
+
+func (s *senderSession) onReceiver(ip string) error {
+	s.receiverIp = ip
+	s.receiverMoved = true
+	// the agent of the receiver passes its credits on again
+	s.credited = false
+	log.Printf("get receiver %s cluster ip: %s\n", s.receiverId, ip)
+	return s.pump()
+}
+
+// onAck forwards an ack to the sender and drops acked frames from the
+// pending copy.
+func (s *senderSession) onAck(seq uint64) {
+	if seq <= s.acked {
+		return
+	}
+	s.acked = seq
+	if err := s.ser.trimPending(s.id, seq); err != nil {
+		log.Printf("Failed to trim pending data of %s: %v\n", s.id, err)
+	}
+	if err := s.out.Post(&protocol.Ack{Sender: s.id, Seq: seq}); err != nil {
+		log.Printf("Failed to forward ack to %s: %v\n", s.id, err)
+	}
+	if s.endSent && s.acked >= s.lastSeq {
+		s.finish()
+	}
+}
+
+// onCredit lets the frames up to seq go to the receiver, and passes the
+// credit on to the sender.
+func (s *senderSession) onCredit(seq uint64) error {
+	if s.credited && seq <= s.credit {
+		return nil
+	}
+	s.credit, s.credited = seq, true
+	if err := s.out.Post(&protocol.Credit{Sender: s.id, Seq: seq}); err != nil {
+		log.Printf("Failed to forward credit to %s: %v\n", s.id, err)
+	}
+	return s.pump()
+}
+
+// mayTake reports whether the receiver has credit for data.
+func (s *senderSession) mayTake(data *protocol.Data) bool {
+	return !s.credited || data.Seq == 0 || data.Seq <= s.credit
+}
+
+// pump asks the scheduler for a grant for the buffered frames once the
+// receiver may get them.
+func (s *senderSession) pump() error {
+	if err := s.refill(); err != nil {
+		return err
+	}
+	ready, err := s.receiverReady()
+	if err != nil || !ready {
+		return err
+	}
+	if len(s.buffered) == 0 || s.waiting {
+		return nil
+	}
+	if !s.mayTake(s.buffered[0]) {
+		s.setState(stateBlocked)
+		return nil
+	}
+	if s.state != stateStreaming {
+		s.setState(stateBuffering)
+	}
+	s.waiting = true
+	s.sched.ready(s.flow)
+	return nil
+}
+
+// receiverReady follows the receiver and reports whether it may get frames.
+func (s *senderSession) receiverReady() (bool, error) {
+	if s.receiverIp == "" {
+		if len(s.buffered) > 0 {
+			log.Printf("buffer %d frames of %s, receiver not connected\n", len(s.buffered), s.id)
+		}
+		s.setState(stateWaitingReceiver)
+		return false, nil
+	}
+	if err := s.followReceiver(); err != nil {
+		return false, err
+	}
+	if s.local() && !s.ser.hasReceiverConn(s.id) {
+		// the receiver registered here but does not wait for this sender
+		// yet, its handler wakes the session once it does
+		s.setState(stateBuffering)
+		return false, nil
+	}
+	return true, nil
+}
+
+// onGrant sends the buffered frames g allows, the session asks for the
+// next grant by returning it with frames left.
+func (s *senderSession) onGrant(g grant) error {
+	s.waiting = false
+	ready, err := s.receiverReady()
+	if err != nil || !ready {
+		// asked for again once the receiver is ready
+		s.sched.done(s.flow, 0, false)
+		return err
+	}
+	used, err := s.send(g.budget, g.first)
+	if err != nil {
+		return err
+	}
+	if err := s.refill(); err != nil {
+		return err
+	}
+	s.waiting = len(s.buffered) > 0 && s.mayTake(s.buffered[0])
+	s.sched.done(s.flow, used, s.waiting)
+	if len(s.buffered) > 0 && !s.waiting {
+		s.setState(stateBlocked)
+	} else {
+		s.setState(stateStreaming)
+	}
+	return nil
+}
+
+// send sends buffered frames of at most budget bytes, all of them for a
+// negative budget, and returns the bytes sent.
+func (s *senderSession) send(budget int, first bool) (int, error) {
+	used := 0
+	for len(s.buffered) > 0 {
+		data := s.buffered[0]
+		cost := frameCost(data)
+		if budget >= 0 && used+cost > budget && !(first && used == 0) {
+			break
+		}
+		if !s.mayTake(data) {
+			break
+		}
+		if s.local() {
+			if _, err := s.ser.forward(s.token, data); err != nil {
+				return used, err
+			}
+		} else {
+			replayed, err := s.sendRemote(data)
+			if err != nil {
+				return used, err
+			}
+			if replayed {
+				// the rest of the buffer was pending too and has been replayed
+				used += s.bufferedBytes
+				s.buffered, s.bufferedBytes = nil, 0
+				break
+			}
+		}
+		s.buffered = s.buffered[1:]
+		s.bufferedBytes -= cost
+		used += cost
+	}
+	if len(s.buffered) == 0 {
+		s.buffered = nil
+	}
+	return used, nil
+}
+
+// local reports whether the receiver is served by this agent.
+func (s *senderSession) local() bool {
+	return s.receiverIp == s.clusterIp
+}
+
+// followReceiver switches the stream to the agent the receiver is connected
+// to now and sends it the frames the receiver misses.
+func (s *senderSession) followReceiver() error {
+	if !s.receiverMoved {
+		return nil
+	}
+	s.receiverMoved = false
+	if s.transfer != nil {
+		s.transfer.Close()
+		s.transfer = nil
+	}
+	if !s.local() {
+		return retry(retransmitAttempts, s.beginTransfer)
+	}
+	if !s.ser.hasReceiverConn(s.id) {
+		// replayed from the pending copy once the receiver is ready
+		s.receiverMoved = true
+		return nil
+	}
+	err := s.ser.resendPending(s.id, s.acked, func(m *protocol.Data) error {
+		_, err := s.ser.forward(s.token, m)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	// the buffered frames were pending too and have been replayed
+	s.buffered, s.bufferedBytes = nil, 0
+	return nil
+}
+
+// beginTransfer opens the stream to the agent of the receiver and sends it
+// every pending frame the receiver has not got.
+func (s *senderSession) beginTransfer() error {
+	pconn, err := s.ser.dialAgent(s.receiverIp)
+	if err != nil {
+		return err
+	}
+	if err := pconn.Send(&protocol.Relay{ClientId: s.id, Token: s.token}); err != nil {
+		pconn.Close()
+		return err
+	}
+	// the peer agent answers with how far the receiver has got
+	msg, err := pconn.Expect(protocol.TypeAck)
+	if err != nil {
+		pconn.Close()
+		return fmt.Errorf("failed to open relay to %s: %w", s.receiverIp, err)
+	}
+	from := msg.(*protocol.Ack).Seq
+	if s.acked > from {
+		from = s.acked
+	}
+	s.sentSeq = from
+	err = s.ser.resendPending(s.id, from, func(m *protocol.Data) error {
+		if m.Seq != 0 {
+			s.sentSeq = m.Seq
+		}
+		return pconn.Send(m)
+	})
+	if err != nil {
+		pconn.Close()
+		return err
+	}
+	// the peer agent sends acks of the receiver back on the same conn
+	spawn("transfer", pconn, func() {
+		for {
+			msg, err := pconn.Recv()
+			if err != nil {
+				select {
+				case s.brokenCh <- pconn:
+				case <-s.done:
+				}
+				return
+			}
+			switch m := msg.(type) {
+			case *protocol.Ack:
+				offerAck(s.ackCh, m.Seq)
+			case *protocol.Credit:
+				offerAck(s.creditCh, m.Seq)
+			}
+		}
+	})
+	s.transfer = pconn
+	s.broken = false
+	return nil
+}
+
+// reopenTransfer replaces a broken transfer conn, beginTransfer sends every
+// frame the receiver misses again from the pending copy.
+func (s *senderSession) reopenTransfer() error {
+	s.transfer.Close()
+	return retry(retransmitAttempts, s.beginTransfer)
+}
+
+// checkBroken takes in a stop of the ack reader of transfer that run has
+// not seen yet.
+func (s *senderSession) checkBroken() {
+	select {
+	case c := <-s.brokenCh:
+		if c == s.transfer {
+			s.broken = true
+		}
+	default:
+	}
+}
+
+// sendRemote sends data over the transfer conn; replayed reports that the
+// stream had to be reopened, which has sent data again already.
+func (s *senderSession) sendRemote(data *protocol.Data) (replayed bool, err error) {
+	if s.transfer == nil {
+		// 和对端的云化代理建立通信并发送两个指令
+		if err := s.beginTransfer(); err != nil {
+			return false, err
+		}
+	}
+	if data.Seq != 0 && data.Seq <= s.sentSeq {
+		// sent already when the stream was opened
+		return false, nil
+	}
+	s.checkBroken()
+	if !s.broken {
+		err := s.transfer.Send(data)
+		if err == nil {
+			s.sentSeq = data.Seq
+			return false, nil
+		}
+		log.Printf("transfer conn of %s broken: %v\n", s.id, err)
+	}
+	return true, s.reopenTransfer()
+}
+
+// endStream tells the receiver the sender is done once everything buffered
+// is sent, and waits for the ack of the last frame.
+func (s *senderSession) endStream() error {
+	if len(s.buffered) > 0 || s.spillFrom != 0 {
+		return nil
+	}
+	if err := s.sendEnd(); err != nil {
+		log.Printf("Failed to end transfer of %s: %v\n", s.id, err)
+	}
+	s.endSent = true
+	if s.acked >= s.lastSeq || s.receiverIp == "" {
+		s.finish()
+		return nil
+	}
+	s.deadline = time.After(exitAckTimeout)
+	return nil
+}
+
+func (s *senderSession) sendEnd() error {
+	end := &protocol.TransferEnd{ClientId: s.id}
+	if s.receiverIp == "" {
+		return nil
+	}
+	if s.local() {
+		return s.ser.endLocal(s.id, end)
+	}
+	if s.transfer == nil {
+		return nil
+	}
+	s.checkBroken()
+	if s.broken {
+		if err := s.reopenTransfer(); err != nil {
+			return err
+		}
+	}
+	if err := s.transfer.Send(end); err != nil {
+		if err := s.reopenTransfer(); err != nil {
+			return err
+		}
+		return s.transfer.Send(end)
+	}
+	return nil
+}
+
+// finish closes the session of a sender that exited.
+func (s *senderSession) finish() {
+	if s.acked < s.lastSeq {
+		log.Printf("sender %s exits with %d unacked frames kept in redis\n", s.id, s.lastSeq-s.acked)
+	}
+	log.Printf("sender %s Exit", s.id)
+	s.setState(stateClosed)
+}
+
+// watchReceiver tells s where its receiver is: it watches the registry
+// until the receiver connects into the cluster, then follows it when it
+// moves to another agent.
+func (s *senderSession) watchReceiver() {
+	ser := s.ser
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-s.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	registryFailures := 0
+	last := ""
+	for {
+		ips, err := ser.registry.EtcdWatch(ctx, s.receiverId)
+		if err == nil {
+			for ip := range ips {
+				registryFailures = 0
+				if ip == "" || ip == last {
+					continue
+				}
+				select {
+				case s.receiverCh <- ip:
+					last = ip
+				case <-s.done:
+					return
+				}
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			err = errors.New("watch ended")
+		}
+		if registryFailures++; registryFailures >= registryAttempts {
+			s.failed.fail(connError(protocol.ErrCodeUnavailable, "watch receiver cluster ip: %w", err))
+			return
+		}
+		log.Printf("Failed to watch receiver cluster ip of %s, retrying: %v\n", s.id, err)
+		select {
+		case <-time.After(time.Second):
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// wakeSender tells the session of senderId that its receiver waits for its
+// frames on this agent.
+func (ser *AgentServer) wakeSender(senderId string) {
+	ser.mu.Lock()
+	bf, ok := ser.bufferMap[senderId]
+	ser.mu.Unlock()
+	if !ok {
+		return
+	}
+	select {
+	case bf.readyCh <- struct{}{}:
+	default:
+	}
+}
+
+// hasReceiverConn reports whether the receiver of senderId is connected to
+// this agent and waits for its frames.
+func (ser *AgentServer) hasReceiverConn(senderId string) bool {
+	ser.mu.Lock()
+	defer ser.mu.Unlock()
+	_, ok := ser.senderMap[senderId]
+	return ok
+}
+
+// endLocal tells the receiver of senderId served by this agent that the
+// sender is done.
+func (ser *AgentServer) endLocal(senderId string, end *protocol.TransferEnd) error {
+	ser.mu.Lock()
+	sr, ok := ser.senderMap[senderId]
+	ser.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("receiver of %s is not connected", senderId)
+	}
+	return sr.out.Post(end)
+}
@@ -0,0 +1,1211 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os/exec"
+	"smart-agent/auth"
+	"smart-agent/config"
+	"smart-agent/protocol"
+	"smart-agent/transport"
+	"smart-agent/util"
+	"strings"
+	"sync"
+	"time"
+)
+
+type SenderBuffer struct {
+	senderId   string
+	receiverId string
+	// acks and credits from the receiver, whether they come through a peer
+	// agent or not
+	ackCh    chan uint64
+	creditCh chan uint64
+	// told when the receiver waits for the sender on this agent
+	readyCh chan struct{}
+}
+
+// Record used for receiver to receive data from many senders
+type SenderRecord struct {
+	out *connWriter
+	// the receiver, its consumer group reads the stream of the sender
+	receiverId string
+	waitCh     chan bool
+}
+
+type AgentServer struct {
+	store       MessageStore
+	registry    Registry
+	discovery   Discovery
+	node        NodeBridge
+	myClusterIp string
+	senderMap   map[string]SenderRecord
+	bufferMap   map[string]SenderBuffer
+	// schedulers of the senders served here, by receiver
+	schedulers map[string]*scheduler
+	relayMap   map[string]*protocol.Conn
+	cursors    map[string]streamCursor
+	// one caller at a time hands the stream of a sender to its receiver
+	delivering map[string]*sync.Mutex
+	// last credit the receivers served here granted each sender
+	credits map[string]uint64
+	// certificates of this agent, the transfer port only speaks mutual TLS
+	tls              *util.TLSMaterial
+	requireClientTLS bool
+	verifier         auth.Verifier
+	acl              *auth.ACL
+	clients          map[string]clientRecord
+	// what clients connect over, and what agents and the node talk over
+	clientTransport transport.Transport
+	peerTransport   transport.Transport
+	profiles        *sessionProfiles
+	mu              sync.Mutex
+
+	cfg Config
+	// port of the transfer listener of the other agents
+	peerPort int
+	// lifecycle of Run
+	runMu    sync.Mutex
+	running  bool
+	cancel   context.CancelFunc
+	clientLn net.Listener
+	// listeners closed once the agent is drained
+	listeners []io.Closer
+	conns     map[net.Conn]struct{}
+	closing   bool
+	// handlers of client and of peer agent conns
+	clientHandlers sync.WaitGroup
+	peerHandlers   sync.WaitGroup
+	// closed when Shutdown starts and when it is done
+	draining chan struct{}
+	stopped  chan struct{}
+	// lists clients that moved away while draining leave, until the agents
+	// they moved to have taken them over
+	migrating map[string]bool
+	// streams handed to a peer agent that has not committed them yet, by
+	// key, closed once the migration is over
+	transits map[string]chan struct{}
+	// the last seq taken over of each stream from each peer, by key and
+	// peer, a migration rolled back after this agent stored the frames
+	// hands them over again
+	takenOver map[string]map[string]takenSeq
+	// what is known of the session of each client that registered here or
+	// was handed over to this agent
+	metas map[string]clientMeta
+}
+
+// Config holds what an agent is made of. Storage and Registry are required,
+// without Discovery or Node the agent does not measure its peers.
+type Config struct {
+	Storage   MessageStore
+	Registry  Registry
+	Discovery Discovery
+	Node      NodeBridge
+
+	// ClientTransport is what clients connect over, PeerTransport what the
+	// agents talk to each other over. MPTCP when nil.
+	ClientTransport transport.Transport
+	PeerTransport   transport.Transport
+	// ListenAddr is where clients connect, TransferAddr where the other
+	// agents do. PeerPort is the transfer port the other agents listen on.
+	ListenAddr   string
+	TransferAddr string
+	PeerPort     int
+	// PingAddr is the UDP address the ping probes of peers are answered on,
+	// "-" for none.
+	PingAddr string
+
+	// TLS of the agent, nil for plaintext everywhere.
+	TLS              *util.TLSMaterial
+	RequireClientTLS bool
+	// Verifier checks client credentials, everyone is let in when nil.
+	Verifier auth.Verifier
+	ACL      *auth.ACL
+
+	// TransPolicy pins the transport profile of every session, TransIface
+	// is the interface the profiles use. Setting the policy is left to the
+	// caller.
+	TransPolicy string
+	TransIface  string
+	// MetricsAddr is where metrics are served, empty for none.
+	MetricsAddr string
+	// GracePeriod bounds how long Run drains the agent once ctx is done.
+	GracePeriod time.Duration
+
+	// Scheduler is how the senders of a receiver share it, SchedPriority
+	// when empty. Quantum is the bytes a sender sends per grant, MinShare
+	// the share of the bytes lower priorities get under SchedPriority, 0.1
+	// when 0 and none when negative.
+	Scheduler string
+	Quantum   int
+	MinShare  float64
+	// SessionBuffer is how many bytes of frames the agent holds in memory
+	// for a sender, the next ones are spilled to Storage until the receiver
+	// takes them. config.SessionBufferSize when 0.
+	SessionBuffer int
+	// Retention bounds the stored streams of each client, only what has
+	// been acked or has expired is dropped when nil. The collector enforces
+	// it every RetentionInterval, config.RetentionInterval when 0.
+	Retention         *RetentionPolicy
+	RetentionInterval time.Duration
+	// MigrationTimeout bounds how long the agent waits for a peer to commit
+	// a stream it migrated, config.MigrationTimeout when 0. The frames stay
+	// here when it does not.
+	MigrationTimeout time.Duration
+}
+
+// New creates an agent from cfg, Run starts it.
+func New(cfg Config) (*AgentServer, error) {
+	if cfg.Storage == nil {
+		return nil, errors.New("agent: no storage")
+	}
+	if cfg.Registry == nil {
+		return nil, errors.New("agent: no registry")
+	}
+	if cfg.ClientTransport == nil {
+		cfg.ClientTransport = transport.MPTCP{}
+	}
+	if cfg.PeerTransport == nil {
+		cfg.PeerTransport = transport.MPTCP{}
+	}
+	if cfg.ListenAddr == "" {
+		cfg.ListenAddr = fmt.Sprintf(":%d", config.ClientServePort)
+	}
+	if cfg.TransferAddr == "" {
+		cfg.TransferAddr = fmt.Sprintf(":%d", config.DataTransferPort)
+	}
+	if cfg.PeerPort == 0 {
+		cfg.PeerPort = config.DataTransferPort
+	}
+	if cfg.PingAddr == "" {
+		cfg.PingAddr = fmt.Sprintf(":%d", config.PingPort)
+	}
+	if cfg.Verifier == nil {
+		cfg.Verifier = auth.AllowAll{}
+	}
+	if cfg.GracePeriod == 0 {
+		cfg.GracePeriod = config.DrainTimeout
+	}
+	if cfg.Scheduler == "" {
+		cfg.Scheduler = SchedPriority
+	}
+	if err := checkSchedPolicy(cfg.Scheduler); err != nil {
+		return nil, fmt.Errorf("agent: %v", err)
+	}
+	if cfg.Quantum <= 0 {
+		cfg.Quantum = protocol.MaxChunkSize
+	}
+	if cfg.MinShare == 0 {
+		cfg.MinShare = defaultMinShare
+	}
+	if cfg.SessionBuffer <= 0 {
+		cfg.SessionBuffer = config.SessionBufferSize
+	}
+	if cfg.RetentionInterval <= 0 {
+		cfg.RetentionInterval = config.RetentionInterval
+	}
+	if cfg.MigrationTimeout <= 0 {
+		cfg.MigrationTimeout = config.MigrationTimeout
+	}
+	return &AgentServer{
+		store:            cfg.Storage,
+		registry:         cfg.Registry,
+		discovery:        cfg.Discovery,
+		node:             cfg.Node,
+		senderMap:        make(map[string]SenderRecord),
+		bufferMap:        make(map[string]SenderBuffer),
+		schedulers:       make(map[string]*scheduler),
+		relayMap:         make(map[string]*protocol.Conn),
+		credits:          make(map[string]uint64),
+		cursors:          make(map[string]streamCursor),
+		delivering:       make(map[string]*sync.Mutex),
+		tls:              cfg.TLS,
+		requireClientTLS: cfg.RequireClientTLS,
+		verifier:         cfg.Verifier,
+		acl:              cfg.ACL,
+		clients:          make(map[string]clientRecord),
+		clientTransport:  cfg.ClientTransport,
+		peerTransport:    cfg.PeerTransport,
+		profiles:         newSessionProfiles(cfg.TransPolicy, cfg.TransIface),
+		cfg:              cfg,
+		peerPort:         cfg.PeerPort,
+		conns:            make(map[net.Conn]struct{}),
+		draining:         make(chan struct{}),
+		stopped:          make(chan struct{}),
+		migrating:        make(map[string]bool),
+		transits:         make(map[string]chan struct{}),
+		takenOver:        make(map[string]map[string]takenSeq),
+		metas:            make(map[string]clientMeta),
+	}, nil
+}
+
+// Run serves clients and peer agents until ctx is done or Shutdown is
+// called. Once ctx is done it drains the agent for at most the grace period
+// and returns ctx.Err(), after Shutdown it returns nil.
+func (ser *AgentServer) Run(ctx context.Context) error {
+	ser.runMu.Lock()
+	if ser.running {
+		ser.runMu.Unlock()
+		return errors.New("agent: already running")
+	}
+	if ser.isDraining() {
+		// shut down before it ran
+		ser.runMu.Unlock()
+		return nil
+	}
+	ser.running = true
+	parent := ctx
+	ctx, ser.cancel = context.WithCancel(ctx)
+	ser.runMu.Unlock()
+
+	clientLn, err := ser.clientTransport.Listen(ctx, ser.cfg.ListenAddr)
+	if err != nil {
+		ser.Shutdown(context.Background())
+		return fmt.Errorf("listen for clients: %w", err)
+	}
+	ser.runMu.Lock()
+	ser.clientLn = clientLn
+	ser.runMu.Unlock()
+	log.Printf("listening for clients on %s\n", clientLn.Addr())
+
+	transferLn, err := ser.peerTransport.Listen(ctx, ser.cfg.TransferAddr)
+	if err != nil {
+		ser.Shutdown(context.Background())
+		return fmt.Errorf("listen for peer agents: %w", err)
+	}
+	ser.track(transferLn)
+
+	go ser.serve(clientLn, ser.handleClient, &ser.clientHandlers)
+	go ser.serve(transferLn, ser.handleTransfer, &ser.peerHandlers)
+
+	if ser.cfg.PingAddr != "-" {
+		if err := ser.servePing(ser.cfg.PingAddr); err != nil {
+			log.Println("Error listening for pings:", err)
+		}
+	}
+	if ser.discovery != nil && ser.node != nil {
+		go ser.measure(ctx, "loss", ser.GetLossAwareness)
+		go ser.measure(ctx, "delay", ser.GetLatencyAwareness)
+	}
+	if ser.cfg.MetricsAddr != "" {
+		go ser.serveMetrics(ser.cfg.MetricsAddr)
+	}
+	go ser.collect(ctx)
+
+	<-ctx.Done()
+	if parent.Err() == nil {
+		// Shutdown was called
+		<-ser.stopped
+		return nil
+	}
+	log.Printf("draining agent for at most %v\n", ser.cfg.GracePeriod)
+	drainCtx, cancel := context.WithTimeout(context.Background(), ser.cfg.GracePeriod)
+	defer cancel()
+	if err := ser.Shutdown(drainCtx); err != nil {
+		log.Println("Failed to drain agent:", err)
+	}
+	return parent.Err()
+}
+
+// Shutdown drains the agent: it stops accepting clients, tells the
+// connected ones to move to another agent and waits until they have left
+// and the agents they moved to have taken over their data. Then it closes
+// every conn. Conns still open when ctx is done are closed right away.
+func (ser *AgentServer) Shutdown(ctx context.Context) error {
+	ser.runMu.Lock()
+	if ser.isDraining() {
+		ser.runMu.Unlock()
+		select {
+		case <-ser.stopped:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	close(ser.draining)
+	if ser.cancel != nil {
+		ser.cancel()
+	}
+	if ser.clientLn != nil {
+		ser.clientLn.Close()
+	}
+	ser.runMu.Unlock()
+	defer close(ser.stopped)
+
+	ser.drainClients(ctx)
+	err := wait(ctx, &ser.clientHandlers)
+	if err == nil {
+		// what the agents the clients moved to have not taken yet is
+		// pushed to them, or to other agents, before it is gone with this
+		// one
+		ser.pushAway(ctx)
+		err = ser.waitMigrations(ctx)
+	}
+
+	ser.runMu.Lock()
+	ser.closing = true
+	for _, l := range ser.listeners {
+		l.Close()
+	}
+	ser.listeners = nil
+	for c := range ser.conns {
+		c.Close()
+	}
+	ser.runMu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := wait(ctx, &ser.clientHandlers); err != nil {
+		return err
+	}
+	return wait(ctx, &ser.peerHandlers)
+}
+
+// wait waits for wg until ctx is done.
+func wait(ctx context.Context, wg *sync.WaitGroup) error {
+	waited := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(waited)
+	}()
+	select {
+	case <-waited:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (ser *AgentServer) track(l io.Closer) {
+	ser.runMu.Lock()
+	defer ser.runMu.Unlock()
+	ser.listeners = append(ser.listeners, l)
+}
+
+// serve accepts conns from l until it is closed and handles each of them,
+// counting the handlers in group.
+func (ser *AgentServer) serve(l net.Listener, handle func(net.Conn), group *sync.WaitGroup) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Println("Failed to accept connection:", err)
+			continue
+		}
+		ser.runMu.Lock()
+		if ser.closing {
+			ser.runMu.Unlock()
+			conn.Close()
+			return
+		}
+		ser.conns[conn] = struct{}{}
+		group.Add(1)
+		ser.runMu.Unlock()
+		go func() {
+			defer func() {
+				ser.runMu.Lock()
+				delete(ser.conns, conn)
+				ser.runMu.Unlock()
+				group.Done()
+			}()
+			handle(conn)
+		}()
+	}
+}
+
+// measure runs probe until ctx is done, backing off while it fails.
+func (ser *AgentServer) measure(ctx context.Context, what string, probe func() error) {
+	for ctx.Err() == nil {
+		err := func() (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					handlerPanics.Add(1)
+					err = fmt.Errorf("panic: %v", r)
+				}
+			}()
+			return probe()
+		}()
+		if err != nil {
+			log.Printf("Failed to measure %s to peer agents: %v\n", what, err)
+			select {
+			case <-time.After(probeRetryInterval):
+			case <-ctx.Done():
+			}
+		}
+	}
+}
+
+// servePing answers the UDP ping probes of peer agents.
+func (ser *AgentServer) servePing(addr string) error {
+	serverAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenUDP("udp", serverAddr)
+	if err != nil {
+		return err
+	}
+	ser.track(conn)
+	go func() {
+		buffer := make([]byte, 1024)
+		for {
+			_, addr, err := conn.ReadFromUDP(buffer)
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				log.Println("Error reading message:", err)
+				continue
+			}
+			if _, err = conn.WriteToUDP([]byte("pong"), addr); err != nil {
+				log.Println("Error sending pong:", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// clusterIp returns the cluster ip of this agent, as the first client to
+// register knew it.
+func (ser *AgentServer) clusterIp() string {
+	ser.mu.Lock()
+	defer ser.mu.Unlock()
+	return ser.myClusterIp
+}
+
+// handleClient serves a client conn, a failure or a panic ends the conn
+// and never the agent.
+func (ser *AgentServer) handleClient(rawConn net.Conn) {
+	defer rawConn.Close()
+	var conn *protocol.Conn
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+	defer recoverConn("client", &conn)
+	err := ser.serveClient(rawConn, &conn)
+	endConn("client", conn, err)
+}
+
+// serveClient serves a client until it leaves. *connp is set once the
+// protocol handshake is done.
+func (ser *AgentServer) serveClient(rawConn net.Conn, connp **protocol.Conn) error {
+	rawConn, err := ser.secureClient(rawConn)
+	if err != nil {
+		return fmt.Errorf("tls handshake with client: %w", err)
+	}
+
+	conn, err := protocol.Server(rawConn)
+	if err != nil {
+		return fmt.Errorf("handshake with client %s: %w", rawConn.RemoteAddr(), err)
+	}
+	*connp = conn
+	logPath("client", conn)
+	// every frame to the client goes through out, the frames of its own
+	// handler and of the senders relaying to it
+	out := newConnWriter(conn)
+	defer out.close()
+	msg, err := conn.Expect(protocol.TypeRegister)
+	if err != nil {
+		return connError(protocol.ErrCodeBadRequest, "register client: %w", err)
+	}
+	reg := msg.(*protocol.Register)
+	cliId := reg.ClientId
+	clientType := reg.Role
+	if clientType != config.RoleSender && clientType != config.RoleReceiver {
+		return connError(protocol.ErrCodeBadRequest, "unknown client type %q", clientType)
+	}
+	// an id with a '.' could name the registry keys of another client
+	if !config.ValidClientId(cliId) {
+		return connError(protocol.ErrCodeBadRequest, "invalid client id %q", cliId)
+	}
+	if perr := ser.authorize(reg); perr != nil {
+		return perr
+	}
+	// peers the session pushed here names are checked like those of reg
+	if ser.adoptSession(reg) {
+		if perr := ser.permit(reg); perr != nil {
+			return perr
+		}
+	}
+	if perr := ser.claimClient(cliId, reg.Token, out); perr != nil {
+		return perr
+	}
+	defer ser.releaseClient(cliId, out)
+	ser.rememberClient(reg)
+	// a client that says where it moves to has its state pushed there once
+	// it is gone from here
+	var movingTo string
+	defer func() {
+		if movingTo != "" && !ser.isSelf(movingTo) {
+			ser.moveClient(cliId, movingTo)
+			go ser.handOverClient(cliId, movingTo)
+		}
+	}()
+	currClusterIp := reg.ClusterIp
+	prevClusterIp := reg.PrevClusterIp
+
+	// 实现读取宿主机的物理ip地址，并存到map中
+	if ser.node != nil {
+		nodeIP, err := ser.node.IP()
+		if err != nil {
+			return connError(protocol.ErrCodeUnavailable, "read node ip: %w", err)
+		}
+		key := nodeIPKey(cliId)
+		if err := ser.registry.EtcdPut(key, nodeIP); err != nil {
+			return connError(protocol.ErrCodeUnavailable, "publish node ip: %w", err)
+		}
+	}
+	ser.mu.Lock()
+	if ser.myClusterIp == "" {
+		ser.myClusterIp = currClusterIp
+		log.Printf("my cluster ip = %s\n", ser.myClusterIp)
+	}
+	ser.mu.Unlock()
+	// only a client that proved its id gets to say where it is served
+	if at := ser.clusterIp(); at != "" {
+		if err := ser.registry.EtcdPut(cliId, at); err != nil {
+			return connError(protocol.ErrCodeUnavailable, "publish where %s is served: %w", cliId, err)
+		}
+	}
+	// fetch old data
+	prevAgents := ser.previousAgents(reg)
+	for _, ip := range prevAgents {
+		_, err := ser.migrate(ip, &protocol.Migrate{ClientId: cliId}, func(m *protocol.Data) error {
+			return ser.pushData(cliId, m)
+		})
+		if err != nil {
+			log.Printf("Failed to fetch old data of %s: %v\n", cliId, err)
+		}
+	}
+	log.Println(cliId, clientType, currClusterIp, prevClusterIp)
+	token, resumed := ser.openSession(reg)
+	ser.bindSession(cliId, token, out)
+	registered := &protocol.Registered{Token: token, Resumed: resumed, Profile: profileNone}
+	if info, err := transport.Inspect(conn); err == nil && info.MPTCP {
+		profile, releaseProfile := ser.profiles.acquire(reg.Profile)
+		defer releaseProfile()
+		registered.Profile = profile
+	}
+	if reg.Profile != "" && registered.Profile != reg.Profile {
+		log.Printf("client %s asked for transport profile %s, got %s\n", cliId, reg.Profile, registered.Profile)
+	}
+	if clientType == config.RoleSender {
+		if resumed {
+			registered.Seq = ser.resumeSender(reg, prevAgents)
+		} else if err := ser.store.Delete(context.Background(), pendingKey(cliId)); err != nil {
+			log.Printf("Failed to drop pending data of an old session of %s: %v\n", cliId, err)
+		}
+	} else {
+		// whatever the receiver has got is not sent to it again, and what
+		// it has not got is, even if it was forwarded before
+		got := make(map[string]uint64, len(reg.Cursors))
+		for _, c := range reg.Cursors {
+			got[c.Sender] = c.Seq
+		}
+		for _, senderId := range reg.Senders {
+			ser.setCursor(senderId, got[senderId])
+		}
+	}
+	var sess *senderSession
+	if clientType == config.RoleSender {
+		// the sender takes its turn among the senders of its receiver
+		// before it may send
+		sess = ser.startSender(reg, token, registered, out, rawConn)
+		defer sess.stop()
+	}
+	if err := out.Send(registered); err != nil {
+		return fmt.Errorf("acknowledge registration of %s: %w", cliId, err)
+	}
+	if sess != nil {
+		// a receiver served here may have granted credits before the
+		// sender came, they hold back its first frames already
+		if seq, ok := ser.grantedCredit(cliId); ok {
+			sess.deliver(&protocol.Credit{Sender: cliId, Seq: seq})
+		}
+	}
+
+	if clientType == config.RoleSender {
+		log.Println("serve for sender", cliId)
+
+		receiverId := reg.Receiver
+		// the node conn of this sender, the first frame to it carries the
+		// node ip of the receiver
+		var nodeConn net.Conn
+		isFirstData := true
+		defer func() {
+			if nodeConn != nil {
+				nodeConn.Close()
+			}
+		}()
+
+		// the client is served until its session is over, after an Exit it
+		// only waits for the last acks
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			select {
+			case <-sess.done:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		for {
+			msg, err := conn.RecvContext(ctx)
+			if err != nil {
+				if ctx.Err() == nil && !sess.failed.hasFailed() {
+					log.Printf("Failed to receive from sender %s: %v\n", cliId, err)
+				}
+				return nil
+			}
+			switch m := msg.(type) {
+			case *protocol.Data:
+				// chunks are relayed one by one, never reassembled in memory
+				if !sess.deliver(m) {
+					return nil
+				}
+			case *protocol.Exit:
+				// the session ends the stream unless the sender moves to
+				// another agent
+				if m.Moving {
+					movingTo = m.To
+				}
+				if !sess.deliver(m) || m.Moving {
+					return nil
+				}
+			case *protocol.Fetch:
+				if !ser.acl.Allow(cliId, auth.ActionFetch, m.ClientId) {
+					if err := out.Send(forbidden(cliId, auth.ActionFetch, m.ClientId)); err != nil {
+						return fmt.Errorf("reject fetch of %s: %w", cliId, err)
+					}
+					continue
+				}
+				offset, err := ser.fetchData(m.ClientId, m.ClusterIp, m.After, func(data *protocol.Data) error {
+					return out.Send(data)
+				})
+				if err != nil {
+					return connError(protocol.ErrCodeUnavailable, "send fetched data to %s: %w", cliId, err)
+				}
+				if err := out.Send(&protocol.TransferEnd{ClientId: m.ClientId, Offset: offset}); err != nil {
+					return fmt.Errorf("send fetched data to %s: %w", cliId, err)
+				}
+			case *protocol.NodeOpen:
+				if ser.node == nil {
+					return connError(protocol.ErrCodeBadRequest, "agent has no node")
+				}
+				// 本云化代理与node建立连接（使用ip + 端口号），并把data发送给node
+				ctx, cancel := context.WithTimeout(context.Background(), protocol.HandshakeTimeout)
+				if nodeConn != nil {
+					nodeConn.Close()
+				}
+				nodeConn, err = ser.node.Dial(ctx)
+				cancel()
+				if err != nil {
+					return connError(protocol.ErrCodeUnavailable, "connect to node: %w", err)
+				}
+			case *protocol.NodeData:
+				if m.ClientId != cliId {
+					return &protocol.Error{Code: protocol.ErrCodeForbidden, Message: "node data of another client"}
+				}
+				if nodeConn == nil {
+					return connError(protocol.ErrCodeBadRequest, "node data before node open")
+				}
+				clientId := m.ClientId
+				data := m.Payload
+				// 在传输数据到Node之前需要在云化代理的本地缓存中记录数据
+				if err := ser.pushData(clientId, &protocol.Data{Sender: clientId, Payload: data}); err != nil {
+					log.Println("Error during redis xadd:", err)
+				}
+
+				if isFirstData {
+					key := nodeIPKey(receiverId)
+					ip, _ := ser.registry.EtcdGet(key)
+					parts := strings.Split(string(data), "|")
+					if len(parts) >= 3 {
+						if net.ParseIP(parts[2]) != nil {
+							// Replace the IP address in data with the retrieved IP
+							parts[2] = ip
+							data = []byte(strings.Join(parts, "|"))
+							isFirstData = false
+						}
+					}
+
+				}
+				// 转发数据到Node上
+				_, err := nodeConn.Write(data)
+				if err != nil {
+					return connError(protocol.ErrCodeUnavailable, "send data to node: %w", err)
+				}
+			case *protocol.NodeClose:
+				log.Println("agent and node close the connection")
+				if nodeConn != nil {
+					nodeConn.Close()
+					nodeConn = nil
+				}
+				isFirstData = true
+			default:
+				log.Printf("unexpected message type %d from sender %s\n", msg.Type(), cliId)
+			}
+		}
+	} else {
+		senderIds := reg.Senders
+
+		log.Printf("%s recv from %d senders: %v\n", cliId, len(senderIds), senderIds)
+
+		if ser.node != nil {
+			spawn("client", rawConn, func() { ser.forwardNodeFiles(cliId, out) })
+		}
+		receiverDone := make(chan struct{})
+		defer close(receiverDone)
+		defer ser.forgetCredits(senderIds)
+		for _, senderId := range senderIds {
+			senderId := senderId
+			spawn("client", rawConn, func() {
+				log.Printf("set conn map [%s]\n", senderId)
+				ch := make(chan bool, 1)
+				ser.mu.Lock()
+				ser.senderMap[senderId] = SenderRecord{
+					out:        out,
+					receiverId: cliId,
+					waitCh:     ch,
+				}
+				token := ser.cursors[senderId].token
+				ser.mu.Unlock()
+				// what was stored for the receiver and not acked comes first
+				ser.deliverStored(senderId, token, true)
+				ser.wakeSender(senderId)
+				select {
+				case <-ch:
+					log.Printf("sender %s finsihed\n", senderId)
+				case <-receiverDone:
+				}
+				ser.mu.Lock()
+				if sr, ok := ser.senderMap[senderId]; ok && sr.out == out {
+					delete(ser.senderMap, senderId)
+				}
+				ser.mu.Unlock()
+			})
+		}
+		// the receiver acks what it got until it leaves
+		for {
+			msg, err := conn.Recv()
+			if err != nil {
+				log.Printf("receiver %s disconnected: %v\n", cliId, err)
+				return nil
+			}
+			switch m := msg.(type) {
+			case *protocol.Ack:
+				ser.routeAck(m)
+				// a stream in transit keeps what was acked, the next
+				// agent takes it over as it is sent
+				if ser.inTransit(m.Sender) {
+					break
+				}
+				if err := ser.store.Ack(context.Background(), m.Sender, cliId, m.Seq); err != nil {
+					log.Printf("Failed to ack stream of %s for %s: %v\n", m.Sender, cliId, err)
+				}
+			case *protocol.Credit:
+				ser.routeCredit(m)
+			case *protocol.Exit:
+				log.Printf("receiver %s Exit", cliId)
+				if m.Moving && ser.isDraining() {
+					ser.expectMigration(cliId)
+				}
+				if m.Moving {
+					movingTo = m.To
+				}
+				return nil
+			default:
+				log.Printf("unexpected message type %d from receiver %s\n", msg.Type(), cliId)
+			}
+		}
+	}
+}
+
+// forwardNodeFiles hands every file the node gets ready to the receiver.
+func (ser *AgentServer) forwardNodeFiles(cliId string, out *connWriter) {
+	for {
+		var fileContent []byte
+		for {
+			content, err := ser.node.ReadyFile()
+			if err != nil {
+				log.Println("Error reading file:", err)
+				return
+			}
+			if content != nil {
+				fileContent = content
+				break
+			}
+			time.Sleep(time.Millisecond * 2000)
+		}
+		// 读取node/file.txt文件中的内容转发给接收端
+		scanner := bufio.NewScanner(bytes.NewReader(fileContent))
+		for scanner.Scan() {
+			line := scanner.Text()
+			if err := out.Send(&protocol.Data{Payload: []byte(line)}); err != nil {
+				log.Printf("Failed to forward node file to %s: %v\n", cliId, err)
+				return
+			}
+		}
+		if err := out.Send(&protocol.TransferEnd{}); err != nil {
+			log.Printf("Failed to forward node file to %s: %v\n", cliId, err)
+			return
+		}
+		if err := scanner.Err(); err != nil {
+			log.Println("Error scanning file content:", err)
+			return
+		}
+		if err := ser.node.FileSent(); err != nil {
+			log.Println("Error writing file:", err)
+			return
+		}
+		log.Println("flag.txt file updated successfully")
+	}
+}
+
+// fetchData calls fn for every message stored for clientId after offset
+// after on the agent at clusterIp, streaming it from the peer agent when it
+// is not this one, which keeps it. It returns the offset of the last message,
+// after itself when there was none.
+func (ser *AgentServer) fetchData(clientId, clusterIp, after string, fn func(*protocol.Data) error) (string, error) {
+	if clusterIp != ser.clusterIp() {
+		return ser.migrate(clusterIp, &protocol.Migrate{ClientId: clientId, Keep: true, After: after}, fn)
+	}
+	offset := after
+	err := ser.store.Range(context.Background(), clientId, after, func(o string, m *protocol.Data) error {
+		offset = o
+		if !live(m) {
+			return nil
+		}
+		return fn(m)
+	})
+	return offset, err
+}
+
+// pushData appends m to the stored stream at key.
+func (ser *AgentServer) pushData(key string, m *protocol.Data) error {
+	_, err := ser.store.Append(context.Background(), key, m)
+	return err
+}
+
+// rangeData calls fn for every message in the stored stream at key whose TTL
+// has not passed.
+func (ser *AgentServer) rangeData(key string, fn func(*protocol.Data) error) error {
+	return ser.store.Range(context.Background(), key, "", func(_ string, m *protocol.Data) error {
+		if !live(m) {
+			return nil
+		}
+		return fn(m)
+	})
+}
+
+// deliverStored hands the receiver served here the frames of the stream of
+// senderId its consumer group has not got, and first those it got but has
+// not acked when redeliver is set. Without the receiver they wait in the
+// stream. The frames are handed one caller at a time so they reach the
+// receiver in stream order.
+func (ser *AgentServer) deliverStored(senderId, token string, redeliver bool) {
+	ser.mu.Lock()
+	dmu, ok := ser.delivering[senderId]
+	if !ok {
+		dmu = new(sync.Mutex)
+		ser.delivering[senderId] = dmu
+	}
+	ser.mu.Unlock()
+	dmu.Lock()
+	defer dmu.Unlock()
+	ser.mu.Lock()
+	sr, ok := ser.senderMap[senderId]
+	ser.mu.Unlock()
+	if !ok {
+		return
+	}
+	err := ser.store.Consume(context.Background(), senderId, sr.receiverId, redeliver, func(_ string, m *protocol.Data) error {
+		if !live(m) {
+			return nil
+		}
+		_, err := ser.forward(token, m)
+		return err
+	})
+	if err != nil {
+		// a frame handed but not written is delivered again once the
+		// receiver is back
+		log.Printf("Failed to deliver stored data of %s to %s: %v\n", senderId, sr.receiverId, err)
+	}
+}
+
+// handleTransfer serves a conn of a peer agent, a failure or a panic ends
+// the conn and never the agent.
+func (ser *AgentServer) handleTransfer(rawConn net.Conn) {
+	defer rawConn.Close()
+	var conn *protocol.Conn
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+	defer recoverConn("transfer", &conn)
+	err := ser.serveTransfer(rawConn, &conn)
+	endConn("transfer", conn, err)
+}
+
+// serveTransfer serves one request of a peer agent. *connp is set once the
+// protocol handshake is done.
+func (ser *AgentServer) serveTransfer(rawConn net.Conn, connp **protocol.Conn) error {
+	// only agents holding a certificate of the agents' CA get this far
+	rawConn, err := ser.secureAgent(rawConn)
+	if err != nil {
+		return fmt.Errorf("refuse transfer conn: %w", err)
+	}
+
+	conn, err := protocol.Server(rawConn)
+	if err != nil {
+		return fmt.Errorf("handshake with agent %s: %w", rawConn.RemoteAddr(), err)
+	}
+	*connp = conn
+	logPath("transfer", conn)
+	msg, err := conn.Recv()
+	if err != nil {
+		return fmt.Errorf("receive transfer request: %w", err)
+	}
+	switch m := msg.(type) {
+	case *protocol.Migrate:
+		return ser.serveMigrate(conn, m)
+	case *protocol.Handover:
+		return ser.serveHandover(conn, m)
+	case *protocol.Relay:
+		clientId := m.ClientId
+		// acks of the receiver go back to the sender agent over this conn
+		ser.mu.Lock()
+		ser.relayMap[clientId] = conn
+		ser.mu.Unlock()
+		// tell the sender agent where to resume the stream
+		if err := conn.Send(&protocol.Ack{Sender: clientId, Seq: ser.resumeSeq(clientId, m.Token)}); err != nil {
+			return fmt.Errorf("open relay for %s: %w", clientId, err)
+		}
+		// and what the receiver may take
+		if seq, ok := ser.grantedCredit(clientId); ok {
+			if err := conn.Send(&protocol.Credit{Sender: clientId, Seq: seq}); err != nil {
+				return fmt.Errorf("open relay for %s: %w", clientId, err)
+			}
+		}
+		defer func() {
+			ser.mu.Lock()
+			if ser.relayMap[clientId] == conn {
+				delete(ser.relayMap, clientId)
+			}
+			ser.mu.Unlock()
+		}()
+		for {
+			msg, err := conn.Recv()
+			if err != nil {
+				// the sender agent closes the relay when it is done
+				log.Printf("Failed to relay data for %s: %v\n", clientId, err)
+				return nil
+			}
+			if data, ok := msg.(*protocol.Data); ok {
+				// the frame is stored first, the receiver gets it from the
+				// stream
+				if err := ser.pushData(clientId, data); err != nil {
+					log.Println("Error during redis xadd:", err)
+					if _, err := ser.forward(m.Token, data); err != nil {
+						log.Printf("Failed to relay data of %s to receiver: %v\n", clientId, err)
+					}
+					continue
+				}
+				ser.deliverStored(clientId, m.Token, false)
+			} else if end, ok := msg.(*protocol.TransferEnd); ok && end.Moving {
+				// the sender agent shuts down, the sender is not done
+				log.Printf("relay of %s moves to another agent\n", clientId)
+			} else if msg.Type() == protocol.TypeTransferEnd {
+				log.Printf("relay end")
+				ser.mu.Lock()
+				sr, ok := ser.senderMap[clientId]
+				ser.mu.Unlock()
+				if ok {
+					if err := sr.out.Post(&protocol.TransferEnd{ClientId: clientId}); err != nil {
+						log.Printf("Failed to relay end of %s to receiver: %v\n", clientId, err)
+					}
+					select {
+					case sr.waitCh <- true:
+					default:
+					}
+				}
+				// keep reading so the last acks can still be routed back, the
+				// sender agent closes the conn once it has them
+			}
+		}
+	default:
+		return connError(protocol.ErrCodeBadRequest, "unexpected transfer request type %d", msg.Type())
+	}
+}
+
+// 丢包率测试
+func (ser *AgentServer) GetLossAwareness() error {
+	servers, err := ser.discovery.GetNameSpacePods(config.Namespace)
+	if err != nil {
+		return err
+	}
+	ch := make(chan string, len(servers)*2)
+	localIps := getIPsForInterface("eth0")
+
+	localServerName := ""
+	for _, server := range servers {
+		if localIps[server.PodIP] {
+			localServerName = server.PodName
+		}
+	}
+	nodeName, err := ser.node.Name()
+	if err != nil {
+		return fmt.Errorf("read node name: %w", err)
+	}
+
+	ser.registry.EtcdPut(localServerName, nodeName)
+
+	var wg sync.WaitGroup // WaitGroup 用于等待所有 goroutine 完成
+	for _, server := range servers {
+		serverIP := server.PodIP
+		serverName := server.PodName
+		if !localIps[serverIP] {
+			wg.Add(1) // 增加 WaitGroup 的计数器
+
+			go func(serverIP, serverName string) {
+				defer wg.Done() // 减少 WaitGroup 的计数器
+
+				packetLoss, _, err := runPingCommand(serverIP, "50", "0.01")
+
+				otherName, _ := ser.registry.EtcdGet(serverName)
+				if err != nil {
+					log.Println("Failed to get Loss:", err)
+					packetLoss = "100%"
+				}
+				ch <- fmt.Sprintf("/%sand%s/loss: %s\n", nodeName, otherName, packetLoss)
+			}(serverIP, serverName)
+		}
+	}
+
+	go func() {
+		wg.Wait() // 等待所有 goroutine 完成
+		close(ch) // 关闭通道，表示数据发送完成
+	}()
+
+	var result strings.Builder
+	for data := range ch {
+		result.WriteString(data)
+	}
+
+	return ser.node.ReportLoss(result.String())
+}
+
+// 时延测试
+func (ser *AgentServer) GetLatencyAwareness() error {
+	servers, err := ser.discovery.GetNameSpacePods(config.Namespace)
+	if err != nil {
+		return err
+	}
+	ch := make(chan string, len(servers))
+	localIps := getIPsForInterface("eth0")
+
+	localServerName := ""
+	for _, server := range servers {
+		if localIps[server.PodIP] {
+			localServerName = server.PodName
+		}
+	}
+	nodeName, err := ser.node.Name()
+	if err != nil {
+		return fmt.Errorf("read node name: %w", err)
+	}
+
+	ser.registry.EtcdPut(localServerName, nodeName)
+
+	var wg sync.WaitGroup // WaitGroup 用于等待所有 goroutine 完成
+	for _, server := range servers {
+		serverIP := server.PodIP
+		serverName := server.PodName
+		if !localIps[serverIP] {
+			wg.Add(1) // 增加 WaitGroup 的计数器
+
+			go func(serverIP, serverName string) {
+				defer wg.Done() // 减少 WaitGroup 的计数器
+
+				_, avgRTT, err := runPingCommand(serverIP, "2", "0.1")
+				otherName, _ := ser.registry.EtcdGet(serverName)
+				if err != nil {
+					avgRTT = "9999"
+				}
+				ch <- fmt.Sprintf("/%sand%s/delay: %s\n", nodeName, otherName, avgRTT)
+			}(serverIP, serverName)
+		}
+	}
+
+	go func() {
+		wg.Wait() // 等待所有 goroutine 完成
+		close(ch) // 关闭通道，表示数据发送完成
+	}()
+
+	var result strings.Builder
+	for data := range ch {
+		result.WriteString(data)
+	}
+
+	return ser.node.ReportDelay(result.String())
+}
+
+// 实现客户端发送ping命令（测指定次数的平均时延以及数据丢失率）
+func runPingCommand(serverIp string, times string, interval string) (string, string, error) {
+	args := []string{"-c", times, "-i", interval, "-W", "1", serverIp}
+	if ip := net.ParseIP(serverIp); ip != nil && ip.To4() == nil {
+		// not every ping picks the family from the address
+		args = append([]string{"-6"}, args...)
+	}
+	cmd := exec.Command("ping", args...)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	err := cmd.Run()
+	if err != nil {
+		return "", "", err
+	}
+	output := out.String()
+	lines := strings.Split(output, "\n")
+	packetLossLine := lines[len(lines)-3]
+	statisticsLine := lines[len(lines)-2]
+
+	packetLoss := strings.Split(packetLossLine, ",")[2]
+	packetLoss = strings.TrimSpace(strings.Split(packetLoss, " ")[1])
+
+	avgRTT := strings.Split(statisticsLine, "/")[4]
+	//fmt.Println("Packet Loss:", packetLoss)
+	//fmt.Println("Average RTT:", avgRTT)
+	return packetLoss, avgRTT, nil
+}
+
+// getIPsForInterface returns the IPv4 and IPv6 addresses of an interface,
+// a dual-stack pod is known by either of them.
+func getIPsForInterface(ifaceName string) map[string]bool {
+	ips := make(map[string]bool)
+	iface, err := net.InterfaceByName(ifaceName)
+	if err != nil {
+		return ips
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return ips
+	}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if ok && !ipNet.IP.IsLoopback() && !ipNet.IP.IsLinkLocalUnicast() {
+			ips[ipNet.IP.String()] = true
+		}
+	}
+	return ips
+}
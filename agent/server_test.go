@@ -0,0 +1,691 @@
+package agent
+
+import (
+	"context"
+	"expvar"
+	"smart-agent/config"
+	"smart-agent/protocol"
+	"smart-agent/transport"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeRegistry struct {
+	mu sync.Mutex
+	kv map[string]string
+	// called on every write when set
+	onPut func(key string)
+	// closed and replaced on every write
+	changed chan struct{}
+}
+
+func (r *fakeRegistry) EtcdPut(key, value string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.onPut != nil {
+		r.onPut(key)
+	}
+	r.kv[key] = value
+	if r.changed != nil {
+		close(r.changed)
+	}
+	r.changed = make(chan struct{})
+	return nil
+}
+
+func (r *fakeRegistry) EtcdWatch(ctx context.Context, key string) (<-chan string, error) {
+	ch := make(chan string)
+	go func() {
+		defer close(ch)
+		sent := false
+		last := ""
+		for {
+			r.mu.Lock()
+			value := r.kv[key]
+			if r.changed == nil {
+				r.changed = make(chan struct{})
+			}
+			changed := r.changed
+			r.mu.Unlock()
+			if !sent || value != last {
+				select {
+				case ch <- value:
+					sent, last = true, value
+				case <-ctx.Done():
+					return
+				}
+			}
+			select {
+			case <-changed:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+func (r *fakeRegistry) EtcdGet(key string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.kv[key], nil
+}
+
+// startAgent runs an agent on an in-memory transport until the test ends,
+// opts change its config.
+func startAgent(t *testing.T, opts ...func(*Config)) (*AgentServer, *transport.Memory, *fakeRegistry) {
+	t.Helper()
+	mem := transport.NewMemory()
+	reg := &fakeRegistry{kv: make(map[string]string)}
+	cfg := Config{
+		Storage:         NewMemoryStorage(),
+		Registry:        reg,
+		ClientTransport: mem,
+		PeerTransport:   mem,
+		ListenAddr:      "agent",
+		TransferAddr:    "agent-transfer",
+		PingAddr:        "-",
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	ser, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ran := make(chan error, 1)
+	go func() { ran <- ser.Run(context.Background()) }()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := ser.Shutdown(ctx); err != nil {
+			t.Errorf("shutdown: %v", err)
+		}
+		if err := <-ran; err != nil {
+			t.Errorf("run: %v", err)
+		}
+	})
+	return ser, mem, reg
+}
+
+func register(t *testing.T, mem *transport.Memory, reg *protocol.Register) *protocol.Conn {
+	t.Helper()
+	conn := dial(t, mem)
+	if err := conn.Send(reg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Expect(protocol.TypeRegistered); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// dial connects to the agent of startAgent.
+func dial(t *testing.T, mem *transport.Memory) *protocol.Conn {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// the agent may not listen yet
+	c, err := mem.Dial(ctx, "agent")
+	for err != nil && ctx.Err() == nil {
+		time.Sleep(10 * time.Millisecond)
+		c, err = mem.Dial(ctx, "agent")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := protocol.Client(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// expectError reads the Error frame the agent ends conn with.
+func expectError(t *testing.T, conn *protocol.Conn, code uint16) *protocol.Error {
+	t.Helper()
+	_, err := conn.Expect(protocol.TypeRegistered)
+	perr, ok := err.(*protocol.Error)
+	if !ok || perr.Code != code {
+		t.Fatalf("got %v, want error code %d", err, code)
+	}
+	if _, err := conn.Recv(); err == nil {
+		t.Fatal("conn still open after the error")
+	}
+	return perr
+}
+
+func TestBadClientIsolated(t *testing.T) {
+	_, mem, _ := startAgent(t)
+	before := failures("client.bad_request")
+
+	conn := dial(t, mem)
+	if err := conn.Send(&protocol.Register{ClientId: "c1", Role: "observer"}); err != nil {
+		t.Fatal(err)
+	}
+	expectError(t, conn, protocol.ErrCodeBadRequest)
+	if n := failures("client.bad_request"); n != before+1 {
+		t.Fatalf("bad requests counted %d, want %d", n, before+1)
+	}
+	// the agent still serves everyone else
+	register(t, mem, &protocol.Register{ClientId: "r1", Role: config.RoleReceiver, ClusterIp: "agent"})
+}
+
+func TestClientIdChecked(t *testing.T) {
+	_, mem, reg := startAgent(t)
+	// it would name the session of alice
+	conn := dial(t, mem)
+	if err := conn.Send(&protocol.Register{ClientId: "session.alice", Role: config.RoleReceiver, ClusterIp: "agent"}); err != nil {
+		t.Fatal(err)
+	}
+	// the client is told the code only, the agent logs why
+	if perr := expectError(t, conn, protocol.ErrCodeBadRequest); strings.Contains(perr.Message, "session.alice") {
+		t.Fatalf("error frame %q tells the cause", perr.Message)
+	}
+
+	register(t, mem, &protocol.Register{ClientId: "alice", Role: config.RoleReceiver, ClusterIp: "agent"})
+	token, _ := reg.EtcdGet(sessionKey("alice"))
+	// and a client whose id ends like a key of alice leaves them alone
+	register(t, mem, &protocol.Register{ClientId: "alicesession", Role: config.RoleReceiver, ClusterIp: "agent"})
+	if now, _ := reg.EtcdGet(sessionKey("alice")); token == "" || now != token {
+		t.Fatalf("session of alice %q is %q now", token, now)
+	}
+}
+
+func TestPanicIsolated(t *testing.T) {
+	_, mem, reg := startAgent(t)
+	reg.onPut = func(key string) {
+		if key == sessionKey("boom") {
+			panic("registry bug")
+		}
+	}
+	before := handlerPanics.Value()
+
+	conn := dial(t, mem)
+	if err := conn.Send(&protocol.Register{ClientId: "boom", Role: config.RoleReceiver, ClusterIp: "agent"}); err != nil {
+		t.Fatal(err)
+	}
+	if perr := expectError(t, conn, protocol.ErrCodeInternal); strings.Contains(perr.Message, "registry bug") {
+		t.Fatalf("error frame %q tells the panic", perr.Message)
+	}
+	if n := handlerPanics.Value(); n != before+1 {
+		t.Fatalf("panics counted %d, want %d", n, before+1)
+	}
+	register(t, mem, &protocol.Register{ClientId: "r1", Role: config.RoleReceiver, ClusterIp: "agent"})
+}
+
+func failures(key string) int64 {
+	if v, ok := connFailures.Get(key).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestRelayLocal(t *testing.T) {
+	_, mem, _ := startAgent(t)
+
+	receiver := register(t, mem, &protocol.Register{ClientId: "r1", Role: config.RoleReceiver, ClusterIp: "agent", Senders: []string{"s1"}})
+	sender := register(t, mem, &protocol.Register{ClientId: "s1", Role: config.RoleSender, Priority: 1, ClusterIp: "agent", Receiver: "r1"})
+
+	if err := sender.Send(&protocol.Data{Seq: 1, Payload: []byte("hello")}); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := receiver.Expect(protocol.TypeData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := msg.(*protocol.Data); d.Sender != "s1" || d.Seq != 1 || string(d.Payload) != "hello" {
+		t.Fatalf("receiver got %+v", d)
+	}
+	if err := receiver.Send(&protocol.Ack{Sender: "s1", Seq: 1}); err != nil {
+		t.Fatal(err)
+	}
+	msg, err = sender.Expect(protocol.TypeAck)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a := msg.(*protocol.Ack); a.Seq != 1 {
+		t.Fatalf("sender got ack %d, want 1", a.Seq)
+	}
+}
+
+func TestUnnumberedKeepsDuplicates(t *testing.T) {
+	_, mem, _ := startAgent(t)
+
+	receiver := register(t, mem, &protocol.Register{ClientId: "r1", Role: config.RoleReceiver, ClusterIp: "agent", Senders: []string{"s1"}})
+	sender := register(t, mem, &protocol.Register{ClientId: "s1", Role: config.RoleSender, Priority: 1, ClusterIp: "agent", Receiver: "r1"})
+	go discard(sender)
+
+	// a frame without a seq does not make the client's frames new again
+	for _, seq := range []uint64{2, 0, 1, 3} {
+		if err := sender.Send(&protocol.Data{Seq: seq, Payload: []byte("x")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var got []uint64
+	for len(got) < 3 {
+		msg, err := receiver.Expect(protocol.TypeData)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, msg.(*protocol.Data).Seq)
+	}
+	if got[0] != 2 || got[1] != 0 || got[2] != 3 {
+		t.Fatalf("receiver got seqs %v, want [2 0 3]", got)
+	}
+	// and a replay of the pending frames does not send it twice
+	if err := sender.Send(&protocol.Data{Seq: 4, Payload: []byte("x")}); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := receiver.Expect(protocol.TypeData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seq := msg.(*protocol.Data).Seq; seq != 4 {
+		t.Fatalf("receiver got seq %d after [2 0 3], want 4", seq)
+	}
+}
+
+func TestShutdownDrains(t *testing.T) {
+	ser, mem, _ := startAgent(t)
+	conn := register(t, mem, &protocol.Register{ClientId: "r1", Role: config.RoleReceiver, ClusterIp: "agent"})
+
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdown <- ser.Shutdown(ctx)
+	}()
+	if _, err := conn.Expect(protocol.TypeDrain); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := mem.Dial(ctx, "agent"); err == nil {
+		t.Fatal("draining agent still accepts clients")
+	}
+	if err := conn.Send(&protocol.Exit{Moving: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the agent stays up until the agent the client moved to takes it over
+	select {
+	case err := <-shutdown:
+		t.Fatalf("shutdown before the client was taken over: %v", err)
+	case <-time.After(3 * migrationPollInterval):
+	}
+	raw, err := mem.Dial(ctx, "agent-transfer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := protocol.Client(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	if err := peer.Send(&protocol.Migrate{ClientId: "r1"}); err != nil {
+		t.Fatal(err)
+	}
+	end, err := peer.Expect(protocol.TypeTransferEnd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := peer.Send(&protocol.Commit{ClientId: "r1", Offset: end.(*protocol.TransferEnd).Offset}); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-shutdown; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestShutdownGracePeriod(t *testing.T) {
+	ser, mem, _ := startAgent(t)
+	conn := register(t, mem, &protocol.Register{ClientId: "r1", Role: config.RoleReceiver, ClusterIp: "agent"})
+
+	// the client is told to move but never does
+	drained := make(chan error, 1)
+	go func() {
+		_, err := conn.Expect(protocol.TypeDrain)
+		drained <- err
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := ser.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("shutdown = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if err := <-drained; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Recv(); err == nil {
+		t.Fatal("conn still open after the grace period")
+	}
+}
+
+// discard reads what the agent sends on conn, acks mostly, until it closes.
+func discard(conn *protocol.Conn) {
+	go func() {
+		for {
+			if _, err := conn.Recv(); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+// receive reads n frames at the receiver, acking each, and returns the seqs
+// it got from every sender. Acks are sent aside as the agent may be sending
+// the next frame.
+func receive(t *testing.T, receiver *protocol.Conn, n int) map[string][]uint64 {
+	t.Helper()
+	acks := make(chan *protocol.Ack, n)
+	defer close(acks)
+	go func() {
+		for ack := range acks {
+			if err := receiver.Send(ack); err != nil {
+				return
+			}
+		}
+	}()
+	got := make(map[string][]uint64)
+	for n > 0 {
+		msg, err := receiver.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, ok := msg.(*protocol.Data)
+		if !ok {
+			continue
+		}
+		got[d.Sender] = append(got[d.Sender], d.Seq)
+		acks <- &protocol.Ack{Sender: d.Sender, Seq: d.Seq}
+		n--
+	}
+	return got
+}
+
+func TestConcurrentSenders(t *testing.T) {
+	_, mem, _ := startAgent(t)
+	const senders, frames = 4, 50
+
+	ids := make([]string, senders)
+	for i := range ids {
+		ids[i] = "s" + strconv.Itoa(i)
+	}
+	receiver := register(t, mem, &protocol.Register{ClientId: "r1", Role: config.RoleReceiver, ClusterIp: "agent", Senders: ids})
+
+	conns := make([]*protocol.Conn, senders)
+	for i, id := range ids {
+		conns[i] = register(t, mem, &protocol.Register{ClientId: id, Role: config.RoleSender, Priority: 1, ClusterIp: "agent", Receiver: "r1"})
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*senders)
+	for _, conn := range conns {
+		conn := conn
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for seq := uint64(1); seq <= frames; seq++ {
+				if err := conn.Send(&protocol.Data{Seq: seq, Payload: []byte("x")}); err != nil {
+					errs <- err
+					return
+				}
+			}
+			if err := conn.Send(&protocol.Exit{}); err != nil {
+				errs <- err
+			}
+		}()
+		// the sender is done once its last frame is acked
+		go func() {
+			defer wg.Done()
+			for {
+				msg, err := conn.Recv()
+				if err != nil {
+					errs <- err
+					return
+				}
+				if ack, ok := msg.(*protocol.Ack); ok && ack.Seq == frames {
+					return
+				}
+			}
+		}()
+	}
+	got := receive(t, receiver, senders*frames)
+	// the ends of the streams
+	discard(receiver)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	for _, id := range ids {
+		seqs := got[id]
+		if len(seqs) != frames {
+			t.Fatalf("got %d frames of %s, want %d", len(seqs), id, frames)
+		}
+		for i, seq := range seqs {
+			if seq != uint64(i+1) {
+				t.Fatalf("frame %d of %s has seq %d", i, id, seq)
+			}
+		}
+	}
+}
+
+func TestSenderWaitsForReceiver(t *testing.T) {
+	_, mem, _ := startAgent(t)
+
+	sender := register(t, mem, &protocol.Register{ClientId: "s1", Role: config.RoleSender, Priority: 1, ClusterIp: "agent", Receiver: "r1"})
+	for seq := uint64(1); seq <= 3; seq++ {
+		if err := sender.Send(&protocol.Data{Seq: seq, Payload: []byte("x")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	receiver := register(t, mem, &protocol.Register{ClientId: "r1", Role: config.RoleReceiver, ClusterIp: "agent", Senders: []string{"s1"}})
+
+	if got := receive(t, receiver, 3)["s1"]; len(got) != 3 || got[0] != 1 || got[2] != 3 {
+		t.Fatalf("receiver got %v", got)
+	}
+	for {
+		msg, err := sender.Expect(protocol.TypeAck)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.(*protocol.Ack).Seq == 3 {
+			break
+		}
+	}
+}
+
+func TestSenderPriority(t *testing.T) {
+	_, mem, _ := startAgent(t)
+
+	receiver := register(t, mem, &protocol.Register{ClientId: "r1", Role: config.RoleReceiver, ClusterIp: "agent", Senders: []string{"low", "high"}})
+	low := register(t, mem, &protocol.Register{ClientId: "low", Role: config.RoleSender, Priority: 1, ClusterIp: "agent", Receiver: "r1"})
+	high := register(t, mem, &protocol.Register{ClientId: "high", Role: config.RoleSender, Priority: 2, ClusterIp: "agent", Receiver: "r1"})
+	discard(low)
+	discard(high)
+
+	// a higher priority with nothing to send does not hold low back
+	if err := low.Send(&protocol.Data{Seq: 1, Payload: []byte("x")}); err != nil {
+		t.Fatal(err)
+	}
+	if got := receive(t, receiver, 1); len(got["low"]) != 1 {
+		t.Fatalf("receiver got %v, want the frame of low", got)
+	}
+	if err := high.Send(&protocol.Data{Seq: 1, Payload: []byte("x")}); err != nil {
+		t.Fatal(err)
+	}
+	if got := receive(t, receiver, 1); len(got["high"]) != 1 {
+		t.Fatalf("receiver got %v, want the frame of high", got)
+	}
+}
+
+func TestCreditHoldsSender(t *testing.T) {
+	_, mem, _ := startAgent(t)
+
+	receiver := register(t, mem, &protocol.Register{ClientId: "r1", Role: config.RoleReceiver, ClusterIp: "agent", Senders: []string{"s1"}})
+	if err := receiver.Send(&protocol.Credit{Sender: "s1", Seq: 2}); err != nil {
+		t.Fatal(err)
+	}
+	sender := register(t, mem, &protocol.Register{ClientId: "s1", Role: config.RoleSender, ClusterIp: "agent", Receiver: "r1"})
+	credits := make(chan uint64, 4)
+	go func() {
+		for {
+			msg, err := sender.Recv()
+			if err != nil {
+				return
+			}
+			if c, ok := msg.(*protocol.Credit); ok {
+				credits <- c.Seq
+			}
+		}
+	}()
+	for seq := uint64(1); seq <= 4; seq++ {
+		if err := sender.Send(&protocol.Data{Seq: seq, Payload: []byte("x")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := receive(t, receiver, 2); len(got["s1"]) != 2 {
+		t.Fatalf("receiver got %v, want the 2 frames it has credit for", got)
+	}
+	// the frames after the credit wait for the next one
+	if err := receiver.Send(&protocol.Credit{Sender: "s1", Seq: 4}); err != nil {
+		t.Fatal(err)
+	}
+	if got := receive(t, receiver, 2); len(got["s1"]) != 2 || got["s1"][0] != 3 {
+		t.Fatalf("receiver got %v after the next credit, want frames 3 and 4", got)
+	}
+	// the sender hears of the credits too
+	for _, want := range []uint64{2, 4} {
+		select {
+		case seq := <-credits:
+			if seq != want {
+				t.Fatalf("sender got credit %d, want %d", seq, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("sender never got credit %d", want)
+		}
+	}
+}
+
+func TestSenderSpills(t *testing.T) {
+	_, mem, _ := startAgent(t, func(cfg *Config) { cfg.SessionBuffer = 2 })
+	before := framesSpilled.Value()
+
+	// nobody takes the frames yet
+	sender := register(t, mem, &protocol.Register{ClientId: "s1", Role: config.RoleSender, ClusterIp: "agent", Receiver: "r1"})
+	busy := make(chan uint64, 1)
+	go func() {
+		for {
+			msg, err := sender.Recv()
+			if err != nil {
+				return
+			}
+			if b, ok := msg.(*protocol.Busy); ok {
+				busy <- b.Seq
+			}
+		}
+	}()
+	const frames = 6
+	for seq := uint64(1); seq <= frames; seq++ {
+		if err := sender.Send(&protocol.Data{Seq: seq, Payload: []byte("x")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case seq := <-busy:
+		if seq != 3 {
+			t.Fatalf("busy from frame %d, want 3", seq)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("sender was not told it is busy")
+	}
+	// the receiver gets every frame in order once it shows up
+	receiver := register(t, mem, &protocol.Register{ClientId: "r1", Role: config.RoleReceiver, ClusterIp: "agent", Senders: []string{"s1"}})
+	got := receive(t, receiver, frames)
+	for i, seq := range got["s1"] {
+		if seq != uint64(i+1) {
+			t.Fatalf("receiver got %v", got)
+		}
+	}
+	if n := framesSpilled.Value() - before; n != frames-2 {
+		t.Fatalf("%d frames spilled, want %d", n, frames-2)
+	}
+}
+
+// openRelay opens the stream of senderId from a sender agent to the agent of
+// startAgent.
+func openRelay(t *testing.T, mem *transport.Memory, senderId string) *protocol.Conn {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := mem.Dial(ctx, "agent-transfer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := protocol.Client(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if err := conn.Send(&protocol.Relay{ClientId: senderId, Token: "t1"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Expect(protocol.TypeAck); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func TestRelayStored(t *testing.T) {
+	ser, mem, _ := startAgent(t)
+	receiver := register(t, mem, &protocol.Register{ClientId: "r1", Role: config.RoleReceiver, ClusterIp: "agent", Senders: []string{"s1"}})
+	relay := openRelay(t, mem, "s1")
+	discard(relay)
+	for seq := uint64(1); seq <= 3; seq++ {
+		if err := relay.Send(&protocol.Data{Sender: "s1", Seq: seq, Payload: []byte("x")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect := func(seq uint64) {
+		t.Helper()
+		msg, err := receiver.Expect(protocol.TypeData)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d := msg.(*protocol.Data); d.Seq != seq {
+			t.Fatalf("receiver got frame %d, want %d", d.Seq, seq)
+		}
+	}
+	for seq := uint64(1); seq <= 3; seq++ {
+		expect(seq)
+	}
+	// the receiver leaves without acking, it gets the frames again when it
+	// comes back
+	receiver.Close()
+	receiver = register(t, mem, &protocol.Register{ClientId: "r1", Role: config.RoleReceiver, ClusterIp: "agent", Senders: []string{"s1"}})
+	for seq := uint64(1); seq <= 3; seq++ {
+		expect(seq)
+	}
+	if err := receiver.Send(&protocol.Ack{Sender: "s1", Seq: 3}); err != nil {
+		t.Fatal(err)
+	}
+	// acked frames are trimmed from the stream
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		m, err := ser.store.Last(context.Background(), "s1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("frame %d still stored after the ack", m.Seq)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,154 @@
+package agent
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"smart-agent/protocol"
+)
+
+// the session token of a client is kept in the registry next to its cluster
+// ip, so whichever agent the client moves to can check it
+func sessionKey(clientId string) string {
+	return "session." + clientId
+}
+
+// streamCursor is how far the stream of one sender has been forwarded to its
+// receiver on this agent. Frames at or below seq are duplicates and dropped,
+// which makes the (sender, seq) pair the idempotency key of a frame.
+type streamCursor struct {
+	// session of the sender, "" until the first frame or Relay names it
+	token string
+	seq   uint64
+}
+
+// openSession resumes the session of reg when it presents the token issued
+// for it earlier, otherwise it issues a new token.
+func (ser *AgentServer) openSession(reg *protocol.Register) (token string, resumed bool) {
+	key := sessionKey(reg.ClientId)
+	if reg.Token != "" {
+		stored, err := ser.registry.EtcdGet(key)
+		if err != nil {
+			log.Printf("Failed to look up session of %s: %v\n", reg.ClientId, err)
+		} else if stored == reg.Token {
+			return reg.Token, true
+		} else {
+			log.Printf("unknown session token of %s, start a new session\n", reg.ClientId)
+		}
+	}
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		log.Printf("Failed to create session token of %s: %v\n", reg.ClientId, err)
+		return "", false
+	}
+	token = hex.EncodeToString(buf)
+	if err := ser.registry.EtcdPut(key, token); err != nil {
+		log.Printf("Failed to store session of %s: %v\n", reg.ClientId, err)
+	}
+	return token, false
+}
+
+// setCursor records the last seq a receiver reports to have from senderId.
+func (ser *AgentServer) setCursor(senderId string, seq uint64) {
+	ser.mu.Lock()
+	defer ser.mu.Unlock()
+	c := ser.cursors[senderId]
+	c.seq = seq
+	ser.cursors[senderId] = c
+}
+
+// resumeSeq returns the seq after which the session token of senderId has to
+// send its frames again, 0 for a session the receiver has not seen yet.
+func (ser *AgentServer) resumeSeq(senderId, token string) uint64 {
+	ser.mu.Lock()
+	defer ser.mu.Unlock()
+	c := ser.cursors[senderId]
+	if c.token != "" && c.token != token {
+		return 0
+	}
+	return c.seq
+}
+
+// forward queues m for the receiver of its sender if it is connected here,
+// dropping frames the receiver has already got. It reports whether m was
+// queued. A sender that starts a new session numbers its frames from 1 again.
+// The frames of a sender come from one stream at a time, its session or its
+// relay, so they are queued in the order the cursor moves.
+func (ser *AgentServer) forward(token string, m *protocol.Data) (bool, error) {
+	ser.mu.Lock()
+	sr, ok := ser.senderMap[m.Sender]
+	if !ok {
+		ser.mu.Unlock()
+		return false, nil
+	}
+	c := ser.cursors[m.Sender]
+	if c.token != token {
+		if c.token != "" {
+			c.seq = 0
+		}
+		c.token = token
+	}
+	if m.Seq != 0 && m.Seq <= c.seq {
+		log.Printf("drop duplicate frame %d of %s\n", m.Seq, m.Sender)
+		ser.cursors[m.Sender] = c
+		ser.mu.Unlock()
+		return false, nil
+	}
+	if m.Seq != 0 {
+		c.seq = m.Seq
+	}
+	ser.cursors[m.Sender] = c
+	ser.mu.Unlock()
+	// a frame that cannot be written fails the receiver's conn, which
+	// reconnects with the cursors it has got
+	if err := sr.out.Post(m); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// lastPendingSeq returns the seq of the newest pending frame of senderId.
+func (ser *AgentServer) lastPendingSeq(senderId string) (uint64, error) {
+	m, err := ser.store.Last(context.Background(), pendingKey(senderId))
+	if err != nil || m == nil {
+		return 0, err
+	}
+	return m.Seq, nil
+}
+
+// resumeSender takes over the pending frames a moving sender left on the
+// agents at prevAgents and returns the last seq held for it, the sender
+// sends again whatever it sent after that.
+func (ser *AgentServer) resumeSender(reg *protocol.Register, prevAgents []string) uint64 {
+	cliId := reg.ClientId
+	held, err := ser.lastPendingSeq(cliId)
+	if err != nil {
+		log.Printf("Failed to read pending data of %s: %v\n", cliId, err)
+	}
+	for _, ip := range prevAgents {
+		_, err := ser.migrate(ip, &protocol.Migrate{ClientId: cliId, Pending: true}, func(m *protocol.Data) error {
+			// frames this agent still holds from an earlier stay are kept
+			if m.Seq <= held {
+				return nil
+			}
+			held = m.Seq
+			return ser.pushPending(cliId, m)
+		})
+		if err != nil {
+			log.Printf("Failed to take over pending data of %s: %v\n", cliId, err)
+		}
+	}
+	// and so do those the agent it left pushed here
+	if last, err := ser.lastPendingSeq(cliId); err == nil && last > held {
+		held = last
+	}
+	if err := ser.trimPending(cliId, reg.Acked); err != nil {
+		log.Printf("Failed to trim pending data of %s: %v\n", cliId, err)
+	}
+	if reg.Acked > held {
+		held = reg.Acked
+	}
+	log.Printf("resume sender %s at seq %d\n", cliId, held)
+	return held
+}
@@ -0,0 +1,542 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"smart-agent/protocol"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// MessageStore keeps streams of Data frames by key: the messages stored for
+// a client and the pending frames of a sender. Every frame of a stream has
+// an offset, later frames have greater ones; "" is the start of a stream.
+//
+// The receiver of a stream reads it as a consumer group named after it: the
+// frames handed to the group stay pending until the receiver acks them, and
+// acked frames are trimmed from the stream.
+type MessageStore interface {
+	// Append appends m to the stream at key and returns its offset.
+	Append(ctx context.Context, key string, m *protocol.Data) (string, error)
+	// Range calls fn for every frame of the stream at key after offset
+	// after, oldest first.
+	Range(ctx context.Context, key, after string, fn func(offset string, m *protocol.Data) error) error
+	// Consume calls fn for every frame of the stream at key not handed to
+	// group yet, and first for those handed to it but not acked when
+	// redeliver is set. A new group starts at the head of the stream.
+	Consume(ctx context.Context, key, group string, redeliver bool, fn func(offset string, m *protocol.Data) error) error
+	// Ack acknowledges the frames up to and including seq for group and
+	// trims them from the stream at key.
+	Ack(ctx context.Context, key, group string, seq uint64) error
+	// Last returns the newest frame of the stream at key, nil when it is
+	// empty.
+	Last(ctx context.Context, key string) (*protocol.Data, error)
+	// Trim drops the frames up to and including seq from the head of the
+	// stream at key.
+	Trim(ctx context.Context, key string, seq uint64) error
+	// Delete drops the stream at key.
+	Delete(ctx context.Context, key string) error
+	// Discard drops the frames of the stream at key up to and including the
+	// one at offset through, once they are stored elsewhere. Frames
+	// appended after it stay.
+	Discard(ctx context.Context, key, through string) error
+	// Keys returns the keys of the streams stored.
+	Keys(ctx context.Context) ([]string, error)
+	// Retain evicts the frames at the head of the stream at key r does not
+	// keep at now, or whose TTL has passed.
+	Retain(ctx context.Context, key string, r Retention, now time.Time) (Evicted, error)
+}
+
+// number of stream entries read from redis at once
+const redisPageSize = 128
+
+// RedisStorage keeps every stream in a redis stream, whose entry ids are the
+// offsets. Frames are stored encoded next to their seq, so binary payloads
+// and chunk boundaries survive a replay.
+type RedisStorage struct {
+	cli *redis.Client
+}
+
+func NewRedisStorage(cli *redis.Client) *RedisStorage {
+	return &RedisStorage{cli: cli}
+}
+
+// streamKey is where the stream at key lives in redis, apart from the lists
+// agents used to keep.
+func streamKey(key string) string {
+	return "stream:" + key
+}
+
+// decodeEntry returns the frame of a stream entry.
+func decodeEntry(key string, e redis.XMessage) (*protocol.Data, bool) {
+	raw, ok := e.Values["frame"].(string)
+	if !ok {
+		// pending in a group but trimmed from the stream
+		return nil, false
+	}
+	msg, err := protocol.Unmarshal(protocol.TypeData, []byte(raw))
+	if err != nil {
+		log.Printf("skip corrupt record %s in %s: %v\n", e.ID, key, err)
+		return nil, false
+	}
+	return msg.(*protocol.Data), true
+}
+
+func (s *RedisStorage) Append(ctx context.Context, key string, m *protocol.Data) (string, error) {
+	return s.cli.XAdd(ctx, &redis.XAddArgs{
+		Stream: streamKey(key),
+		Values: []interface{}{"seq", m.Seq, "frame", protocol.Marshal(m)},
+	}).Result()
+}
+
+// Range reads the stream page by page so it never has to fit in memory at
+// once.
+func (s *RedisStorage) Range(ctx context.Context, key, after string, fn func(string, *protocol.Data) error) error {
+	start := "-"
+	if after != "" {
+		start = "(" + after
+	}
+	for {
+		page, err := s.cli.XRangeN(ctx, streamKey(key), start, "+", redisPageSize).Result()
+		if err != nil {
+			return fmt.Errorf("redis xrange %s: %w", key, err)
+		}
+		for _, e := range page {
+			if m, ok := decodeEntry(key, e); ok {
+				if err := fn(e.ID, m); err != nil {
+					return err
+				}
+			}
+		}
+		if len(page) < redisPageSize {
+			return nil
+		}
+		start = "(" + page[len(page)-1].ID
+	}
+}
+
+func (s *RedisStorage) Consume(ctx context.Context, key, group string, redeliver bool, fn func(string, *protocol.Data) error) error {
+	sk := streamKey(key)
+	err := s.cli.XGroupCreateMkStream(ctx, sk, group, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return fmt.Errorf("redis xgroup create %s %s: %w", key, group, err)
+	}
+	// pending entries of the group are read from 0 on, new ones with >
+	id := ">"
+	if redeliver {
+		id = "0"
+	}
+	for {
+		streams, err := s.cli.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    group,
+			Consumer: group,
+			Streams:  []string{sk, id},
+			Count:    redisPageSize,
+			Block:    -1,
+		}).Result()
+		if err != nil && err != redis.Nil {
+			return fmt.Errorf("redis xreadgroup %s %s: %w", key, group, err)
+		}
+		var page []redis.XMessage
+		if len(streams) > 0 {
+			page = streams[0].Messages
+		}
+		for _, e := range page {
+			if m, ok := decodeEntry(key, e); ok {
+				if err := fn(e.ID, m); err != nil {
+					return err
+				}
+			}
+		}
+		if len(page) < redisPageSize {
+			if id == ">" {
+				return nil
+			}
+			id = ">"
+		} else if id != ">" {
+			id = page[len(page)-1].ID
+		}
+	}
+}
+
+func (s *RedisStorage) Ack(ctx context.Context, key, group string, seq uint64) error {
+	ids, next, err := s.head(ctx, key, seq)
+	if err != nil || len(ids) == 0 {
+		return err
+	}
+	if err := s.cli.XAck(ctx, streamKey(key), group, ids...).Err(); err != nil {
+		return fmt.Errorf("redis xack %s %s: %w", key, group, err)
+	}
+	return s.trimBefore(ctx, key, next)
+}
+
+// head returns the ids of the entries up to and including seq at the head of
+// the stream at key, and the id of the entry after them, "" for none.
+func (s *RedisStorage) head(ctx context.Context, key string, seq uint64) ([]string, string, error) {
+	var ids []string
+	start := "-"
+	for {
+		page, err := s.cli.XRangeN(ctx, streamKey(key), start, "+", redisPageSize).Result()
+		if err != nil {
+			return nil, "", fmt.Errorf("redis xrange %s: %w", key, err)
+		}
+		for _, e := range page {
+			if m, ok := decodeEntry(key, e); ok && m.Seq > seq {
+				return ids, e.ID, nil
+			}
+			ids = append(ids, e.ID)
+		}
+		if len(page) < redisPageSize {
+			return ids, "", nil
+		}
+		start = "(" + page[len(page)-1].ID
+	}
+}
+
+// trimBefore drops the entries before id from the stream at key, all of
+// them when id is "". The groups of the stream are kept.
+func (s *RedisStorage) trimBefore(ctx context.Context, key, id string) error {
+	var err error
+	if id == "" {
+		err = s.cli.XTrimMaxLen(ctx, streamKey(key), 0).Err()
+	} else {
+		err = s.cli.XTrimMinID(ctx, streamKey(key), id).Err()
+	}
+	if err != nil {
+		return fmt.Errorf("redis xtrim %s: %w", key, err)
+	}
+	return nil
+}
+
+func (s *RedisStorage) Last(ctx context.Context, key string) (*protocol.Data, error) {
+	page, err := s.cli.XRevRangeN(ctx, streamKey(key), "+", "-", 1).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(page) == 0 {
+		return nil, nil
+	}
+	m, ok := decodeEntry(key, page[0])
+	if !ok {
+		return nil, fmt.Errorf("corrupt record %s in %s", page[0].ID, key)
+	}
+	return m, nil
+}
+
+func (s *RedisStorage) Trim(ctx context.Context, key string, seq uint64) error {
+	ids, next, err := s.head(ctx, key, seq)
+	if err != nil || len(ids) == 0 {
+		return err
+	}
+	return s.trimBefore(ctx, key, next)
+}
+
+func (s *RedisStorage) Delete(ctx context.Context, key string) error {
+	return s.cli.Del(ctx, streamKey(key)).Err()
+}
+
+func (s *RedisStorage) Discard(ctx context.Context, key, through string) error {
+	if through == "" {
+		return nil
+	}
+	next, err := nextEntryId(through)
+	if err != nil {
+		return err
+	}
+	return s.trimBefore(ctx, key, next)
+}
+
+func (s *RedisStorage) Keys(ctx context.Context) ([]string, error) {
+	var keys []string
+	iter := s.cli.Scan(ctx, 0, streamKey("*"), redisPageSize).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, strings.TrimPrefix(iter.Val(), streamKey("")))
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("redis scan: %w", err)
+	}
+	return keys, nil
+}
+
+// Retain reads the times the frames were added from their entry ids.
+func (s *RedisStorage) Retain(ctx context.Context, key string, r Retention, now time.Time) (Evicted, error) {
+	var ids []string
+	var infos []frameInfo
+	err := s.Range(ctx, key, "", func(id string, m *protocol.Data) error {
+		ms, err := strconv.ParseInt(strings.SplitN(id, "-", 2)[0], 10, 64)
+		if err != nil {
+			return fmt.Errorf("bad stream entry id %q", id)
+		}
+		ids = append(ids, id)
+		infos = append(infos, frameInfo{at: time.UnixMilli(ms), bytes: int64(len(m.Payload)), expires: m.Expires})
+		return nil
+	})
+	if err != nil {
+		return Evicted{}, err
+	}
+	n, ev := evictHead(infos, r, now)
+	if n == 0 {
+		return ev, nil
+	}
+	next := ""
+	if n < len(ids) {
+		next = ids[n]
+	}
+	return ev, s.trimBefore(ctx, key, next)
+}
+
+// nextEntryId returns the smallest stream entry id after id.
+func nextEntryId(id string) (string, error) {
+	ms, seq, ok := strings.Cut(id, "-")
+	n, err := strconv.ParseUint(seq, 10, 64)
+	if !ok || err != nil {
+		return "", fmt.Errorf("bad stream entry id %q", id)
+	}
+	return ms + "-" + strconv.FormatUint(n+1, 10), nil
+}
+
+// MemoryStorage keeps the streams in memory, for tests and agents that do
+// not need their data to outlive them. Offsets are the decimal ids of the
+// frames, counted per stream from 1.
+type MemoryStorage struct {
+	mu      sync.Mutex
+	streams map[string]*memStream
+}
+
+type memStream struct {
+	// id of the last frame appended
+	last   uint64
+	frames []memFrame
+	groups map[string]*memGroup
+}
+
+type memFrame struct {
+	id uint64
+	m  *protocol.Data
+	at time.Time
+}
+
+type memGroup struct {
+	// id of the last frame handed to the group, and the ids handed but not
+	// acked yet
+	delivered uint64
+	pending   []uint64
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{streams: make(map[string]*memStream)}
+}
+
+// stream returns the stream at key, creating it if it is missing.
+func (s *MemoryStorage) stream(key string) *memStream {
+	st, ok := s.streams[key]
+	if !ok {
+		st = &memStream{groups: make(map[string]*memGroup)}
+		s.streams[key] = st
+	}
+	return st
+}
+
+func parseOffset(offset string) (uint64, error) {
+	if offset == "" {
+		return 0, nil
+	}
+	id, err := strconv.ParseUint(offset, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("bad offset %q", offset)
+	}
+	return id, nil
+}
+
+func formatOffset(id uint64) string {
+	return strconv.FormatUint(id, 10)
+}
+
+// each calls fn for a copy of every frame of list, the caller may keep it.
+func each(list []memFrame, fn func(string, *protocol.Data) error) error {
+	for _, f := range list {
+		c := *f.m
+		if err := fn(formatOffset(f.id), &c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStorage) Append(ctx context.Context, key string, m *protocol.Data) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.stream(key)
+	st.last++
+	// a copy, the caller may reuse m
+	c := *m
+	st.frames = append(st.frames, memFrame{id: st.last, m: &c, at: time.Now()})
+	return formatOffset(st.last), nil
+}
+
+func (s *MemoryStorage) Range(ctx context.Context, key, after string, fn func(string, *protocol.Data) error) error {
+	from, err := parseOffset(after)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	var list []memFrame
+	if st, ok := s.streams[key]; ok {
+		for _, f := range st.frames {
+			if f.id > from {
+				list = append(list, f)
+			}
+		}
+	}
+	s.mu.Unlock()
+	return each(list, fn)
+}
+
+func (s *MemoryStorage) Consume(ctx context.Context, key, group string, redeliver bool, fn func(string, *protocol.Data) error) error {
+	s.mu.Lock()
+	st := s.stream(key)
+	g, ok := st.groups[group]
+	if !ok {
+		g = &memGroup{}
+		st.groups[group] = g
+	}
+	var list []memFrame
+	for _, f := range st.frames {
+		if f.id > g.delivered {
+			// handed to the group from now on, like XREADGROUP does
+			g.pending = append(g.pending, f.id)
+			list = append(list, f)
+		} else if redeliver && containsId(g.pending, f.id) {
+			list = append(list, f)
+		}
+	}
+	if n := len(st.frames); n > 0 && st.frames[n-1].id > g.delivered {
+		g.delivered = st.frames[n-1].id
+	}
+	s.mu.Unlock()
+	return each(list, fn)
+}
+
+func containsId(ids []uint64, id uint64) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *MemoryStorage) Ack(ctx context.Context, key, group string, seq uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, ok := s.streams[key]
+	if !ok {
+		return nil
+	}
+	st.drop(st.head(seq))
+	return nil
+}
+
+// drop removes n frames at the head of st, and them from what the groups
+// have pending.
+func (st *memStream) drop(n int) {
+	if n == 0 {
+		return
+	}
+	last := st.frames[n-1].id
+	for _, g := range st.groups {
+		pending := g.pending[:0]
+		for _, id := range g.pending {
+			if id > last {
+				pending = append(pending, id)
+			}
+		}
+		g.pending = pending
+	}
+	st.frames = st.frames[n:]
+}
+
+// head returns how many frames at the head of st are up to and including
+// seq.
+func (st *memStream) head(seq uint64) int {
+	n := 0
+	for n < len(st.frames) && st.frames[n].m.Seq <= seq {
+		n++
+	}
+	return n
+}
+
+func (s *MemoryStorage) Last(ctx context.Context, key string) (*protocol.Data, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, ok := s.streams[key]
+	if !ok || len(st.frames) == 0 {
+		return nil, nil
+	}
+	c := *st.frames[len(st.frames)-1].m
+	return &c, nil
+}
+
+func (s *MemoryStorage) Trim(ctx context.Context, key string, seq uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if st, ok := s.streams[key]; ok {
+		st.drop(st.head(seq))
+	}
+	return nil
+}
+
+func (s *MemoryStorage) Delete(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.streams, key)
+	return nil
+}
+
+func (s *MemoryStorage) Discard(ctx context.Context, key, through string) error {
+	last, err := parseOffset(through)
+	if err != nil || last == 0 {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if st, ok := s.streams[key]; ok {
+		n := 0
+		for n < len(st.frames) && st.frames[n].id <= last {
+			n++
+		}
+		st.drop(n)
+	}
+	return nil
+}
+
+func (s *MemoryStorage) Keys(ctx context.Context) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := make([]string, 0, len(s.streams))
+	for key := range s.streams {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func (s *MemoryStorage) Retain(ctx context.Context, key string, r Retention, now time.Time) (Evicted, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, ok := s.streams[key]
+	if !ok {
+		return Evicted{}, nil
+	}
+	infos := make([]frameInfo, len(st.frames))
+	for i, f := range st.frames {
+		infos[i] = frameInfo{at: f.at, bytes: int64(len(f.m.Payload)), expires: f.m.Expires}
+	}
+	n, ev := evictHead(infos, r, now)
+	st.drop(n)
+	return ev, nil
+}
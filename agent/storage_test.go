@@ -0,0 +1,409 @@
+package agent
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"smart-agent/protocol"
+	"testing"
+	"time"
+)
+
+// stores returns a store of every backend that needs no server.
+func stores(t *testing.T) map[string]MessageStore {
+	t.Helper()
+	logs, err := NewLogStorage(t.TempDir(), 256, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { logs.Close() })
+	return map[string]MessageStore{"memory": NewMemoryStorage(), "log": logs}
+}
+
+// seqs returns the seqs and offsets each calls fn with.
+func seqs(t *testing.T, each func(fn func(string, *protocol.Data) error) error) ([]uint64, []string) {
+	t.Helper()
+	var got []uint64
+	var offsets []string
+	err := each(func(offset string, m *protocol.Data) error {
+		got = append(got, m.Seq)
+		offsets = append(offsets, offset)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got, offsets
+}
+
+// appendSeqs appends the frames from to to of sender a.
+func appendSeqs(t *testing.T, s MessageStore, from, to uint64) {
+	t.Helper()
+	for seq := from; seq <= to; seq++ {
+		if _, err := s.Append(context.Background(), "a", &protocol.Data{Sender: "a", Seq: seq, Payload: []byte("payload")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func rangeAll(t *testing.T, s MessageStore) []uint64 {
+	t.Helper()
+	got, _ := seqs(t, func(fn func(string, *protocol.Data) error) error {
+		return s.Range(context.Background(), "a", "", fn)
+	})
+	return got
+}
+
+func TestStorageOffsets(t *testing.T) {
+	ctx := context.Background()
+	for name, s := range stores(t) {
+		appendSeqs(t, s, 1, 5)
+		_, offsets := seqs(t, func(fn func(string, *protocol.Data) error) error {
+			return s.Range(ctx, "a", "", fn)
+		})
+		if len(offsets) != 5 {
+			t.Fatalf("%s: range = %v", name, offsets)
+		}
+		// a fetch goes on after the offset the last one ended at
+		rest, _ := seqs(t, func(fn func(string, *protocol.Data) error) error {
+			return s.Range(ctx, "a", offsets[2], fn)
+		})
+		if len(rest) != 2 || rest[0] != 4 || rest[1] != 5 {
+			t.Fatalf("%s: range after %s = %v", name, offsets[2], rest)
+		}
+		err := s.Range(ctx, "a", "x", func(string, *protocol.Data) error { return nil })
+		if err == nil {
+			t.Fatalf("%s: bad offset accepted", name)
+		}
+	}
+}
+
+func TestStorageConsumerGroup(t *testing.T) {
+	ctx := context.Background()
+	for name, s := range stores(t) {
+		consume := func(redeliver bool) []uint64 {
+			got, _ := seqs(t, func(fn func(string, *protocol.Data) error) error {
+				return s.Consume(ctx, "a", "r", redeliver, fn)
+			})
+			return got
+		}
+		appendSeqs(t, s, 1, 3)
+		if got := consume(false); len(got) != 3 {
+			t.Fatalf("%s: first consume = %v", name, got)
+		}
+		appendSeqs(t, s, 4, 4)
+		// only what the group has not got yet
+		if got := consume(false); len(got) != 1 || got[0] != 4 {
+			t.Fatalf("%s: second consume = %v", name, got)
+		}
+		if err := s.Ack(ctx, "a", "r", 2); err != nil {
+			t.Fatal(err)
+		}
+		// a receiver coming back gets what it has not acked again
+		if got := consume(true); len(got) != 2 || got[0] != 3 || got[1] != 4 {
+			t.Fatalf("%s: redelivery = %v", name, got)
+		}
+		// and acked frames are trimmed from the stream
+		if all := rangeAll(t, s); len(all) != 2 || all[0] != 3 {
+			t.Fatalf("%s: stream after ack = %v", name, all)
+		}
+	}
+}
+
+func TestStorageDiscard(t *testing.T) {
+	ctx := context.Background()
+	for name, s := range stores(t) {
+		appendSeqs(t, s, 1, 4)
+		_, offsets := seqs(t, func(fn func(string, *protocol.Data) error) error {
+			return s.Range(ctx, "a", "", fn)
+		})
+		// appended while the stream is handed over
+		appendSeqs(t, s, 5, 5)
+		if err := s.Discard(ctx, "a", offsets[3]); err != nil {
+			t.Fatal(err)
+		}
+		if left := rangeAll(t, s); len(left) != 1 || left[0] != 5 {
+			t.Fatalf("%s: %v left after discarding through %s", name, left, offsets[3])
+		}
+		if err := s.Discard(ctx, "a", ""); err != nil {
+			t.Fatal(err)
+		}
+		if left := rangeAll(t, s); len(left) != 1 {
+			t.Fatalf("%s: discarding nothing left %v", name, left)
+		}
+	}
+}
+
+func TestMemoryStoragePendingPruned(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStorage()
+	pending := func() []uint64 {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return append([]uint64(nil), s.streams["a"].groups["r"].pending...)
+	}
+	appendSeqs(t, s, 1, 8)
+	if err := s.Consume(ctx, "a", "r", false, func(string, *protocol.Data) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	// frames gone from the stream are gone from the group too, however they
+	// were removed
+	if err := s.Trim(ctx, "a", 2); err != nil {
+		t.Fatal(err)
+	}
+	if got := pending(); len(got) != 6 || got[0] != 3 {
+		t.Fatalf("pending after trim = %v", got)
+	}
+	if err := s.Discard(ctx, "a", "4"); err != nil {
+		t.Fatal(err)
+	}
+	if got := pending(); len(got) != 4 || got[0] != 5 {
+		t.Fatalf("pending after discard = %v", got)
+	}
+	if _, err := s.Retain(ctx, "a", Retention{MaxCount: 1}, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if got := pending(); len(got) != 1 || got[0] != 8 {
+		t.Fatalf("pending after retain = %v", got)
+	}
+}
+
+func TestLogStorageRecovery(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	s, err := NewLogStorage(dir, 256, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendSeqs(t, s, 1, 20)
+	if err := s.Consume(ctx, "a", "r", false, func(string, *protocol.Data) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Ack(ctx, "a", "r", 10); err != nil {
+		t.Fatal(err)
+	}
+	segs, _ := filepath.Glob(filepath.Join(dir, "stream-a", "*.log"))
+	if len(segs) < 2 {
+		t.Fatalf("%d segments, want the log split", len(segs))
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// a crash tears the last record
+	last := segs[len(segs)-1]
+	info, err := os.Stat(last)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(last, info.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = NewLogStorage(dir, 256, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if all := rangeAll(t, s); len(all) != 9 || all[0] != 11 || all[8] != 19 {
+		t.Fatalf("recovered %v, want 11 to 19", all)
+	}
+	// the group is where it was, nothing is new to it
+	got, _ := seqs(t, func(fn func(string, *protocol.Data) error) error {
+		return s.Consume(ctx, "a", "r", false, fn)
+	})
+	if len(got) != 0 {
+		t.Fatalf("consume after recovery = %v", got)
+	}
+	// the stream goes on where the torn record was
+	appendSeqs(t, s, 20, 20)
+	_, offsets := seqs(t, func(fn func(string, *protocol.Data) error) error {
+		return s.Range(ctx, "a", "", fn)
+	})
+	if offsets[len(offsets)-1] != "20" {
+		t.Fatalf("offsets %v", offsets)
+	}
+	got, _ = seqs(t, func(fn func(string, *protocol.Data) error) error {
+		return s.Consume(ctx, "a", "r", false, fn)
+	})
+	if len(got) != 1 || got[0] != 20 {
+		t.Fatalf("consume of the frame appended after recovery = %v", got)
+	}
+}
+
+func TestLogStorageChecksum(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewLogStorage(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendSeqs(t, s, 1, 3)
+	s.Close()
+	segs, _ := filepath.Glob(filepath.Join(dir, "stream-a", "*.log"))
+	raw, err := os.ReadFile(segs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	// flip a payload byte of the second record
+	raw[len(raw)/2] ^= 0xff
+	if err := os.WriteFile(segs[0], raw, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	s, err = NewLogStorage(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if all := rangeAll(t, s); len(all) != 1 || all[0] != 1 {
+		t.Fatalf("read back %v past a corrupt record", all)
+	}
+}
+
+func TestLogStorageSync(t *testing.T) {
+	ctx := context.Background()
+	s, err := NewLogStorage(t.TempDir(), 0, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err := s.Append(ctx, "a", &protocol.Data{Seq: 1}); err != nil {
+		t.Fatal(err)
+	}
+	a, err := s.locked("a", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirty := a.dirty
+	a.mu.Unlock()
+	if !dirty {
+		t.Fatal("append synced before the interval")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for dirty {
+		if time.Now().After(deadline) {
+			t.Fatal("append not synced on the interval")
+		}
+		time.Sleep(time.Millisecond)
+		a.mu.Lock()
+		dirty = a.dirty
+		a.mu.Unlock()
+	}
+
+	// a stream held by a slow reader does not hold up the others
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.Append(ctx, "b", &protocol.Data{Seq: 1})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("append to b waits for a")
+	}
+}
+
+func TestLogStorageOlderRecords(t *testing.T) {
+	dir := t.TempDir()
+	record := func(id uint64, frame []byte) []byte {
+		rec := make([]byte, recordHeaderSize+recordMetaSize+len(frame))
+		binary.LittleEndian.PutUint32(rec[0:4], uint32(recordMetaSize+len(frame)))
+		binary.LittleEndian.PutUint64(rec[8:16], id)
+		binary.LittleEndian.PutUint64(rec[16:24], uint64(time.Now().UnixMilli()))
+		copy(rec[24:], frame)
+		binary.LittleEndian.PutUint32(rec[4:8], crc32.Checksum(rec[8:], crcTable))
+		return rec
+	}
+	frame := func(seq uint64) []byte {
+		return protocol.Marshal(&protocol.Data{Sender: "a", Seq: seq, Payload: []byte("payload")})
+	}
+	var seg []byte
+	seg = append(seg, record(1, frame(1))...)
+	// stored by a build before Encrypted and Expires
+	old := frame(2)
+	seg = append(seg, record(2, old[:len(old)-9])...)
+	// whole, but no frame this build reads
+	seg = append(seg, record(3, []byte{1})...)
+	seg = append(seg, record(4, frame(4))...)
+	if err := os.MkdirAll(filepath.Join(dir, "stream-a"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "stream-a", fmt.Sprintf("%020d.log", 1)), seg, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewLogStorage(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if all := rangeAll(t, s); len(all) != 3 || all[0] != 1 || all[1] != 2 || all[2] != 4 {
+		t.Fatalf("read back %v, want 1, 2 and 4", all)
+	}
+	appendSeqs(t, s, 5, 5)
+	_, offsets := seqs(t, func(fn func(string, *protocol.Data) error) error {
+		return s.Range(context.Background(), "a", "4", fn)
+	})
+	if len(offsets) != 1 || offsets[0] != "5" {
+		t.Fatalf("appended after the old records at %v, want 5", offsets)
+	}
+}
+
+func TestLogStorageState(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	state := filepath.Join(dir, "stream-a", "state")
+	consume := func(s *LogStorage) []uint64 {
+		got, _ := seqs(t, func(fn func(string, *protocol.Data) error) error {
+			return s.Consume(ctx, "a", "r", false, fn)
+		})
+		return got
+	}
+	s, err := NewLogStorage(dir, 0, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendSeqs(t, s, 1, 3)
+	if got := consume(s); len(got) != 3 {
+		t.Fatalf("consume = %v", got)
+	}
+	// a delivery is not written on its own
+	if _, err := os.Stat(state); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("state written on consume: %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s, err = NewLogStorage(dir, 0, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := consume(s); len(got) != 0 {
+		t.Fatalf("consume after reopening = %v", got)
+	}
+	s.Close()
+
+	// a crash tore the state
+	if err := os.WriteFile(state, []byte(`{"Head":`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	s, err = NewLogStorage(dir, 0, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if all := rangeAll(t, s); len(all) != 3 {
+		t.Fatalf("read back %v with a torn state", all)
+	}
+	// the group starts over, nothing is lost
+	if got := consume(s); len(got) != 3 {
+		t.Fatalf("consume with a torn state = %v", got)
+	}
+}
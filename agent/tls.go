@@ -0,0 +1,72 @@
+package agent
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"smart-agent/config"
+	"smart-agent/protocol"
+	"smart-agent/util"
+	"strconv"
+	"time"
+)
+
+// secureClient runs the TLS handshake with a client that starts one. A
+// client certificate is checked if one is presented. Plaintext clients are
+// served too, unless requireClientTLS is set. An agent without certificates
+// only serves plaintext.
+func (ser *AgentServer) secureClient(conn net.Conn) (net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(protocol.HandshakeTimeout))
+	conn, isTLS, err := util.SniffTLS(conn)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	if !isTLS {
+		if ser.requireClientTLS {
+			return nil, errors.New("client does not use tls")
+		}
+		return conn, nil
+	}
+	if ser.tls == nil {
+		return nil, errors.New("client uses tls, this agent has no certificates")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), protocol.HandshakeTimeout)
+	defer cancel()
+	return util.TLSHandshake(ctx, tls.Server(conn, ser.tls.ServerConfig(tls.VerifyClientCertIfGiven)))
+}
+
+// secureAgent runs the TLS handshake with a peer agent, which has to present
+// a certificate signed by the agents' CA and issued for the agents' name.
+func (ser *AgentServer) secureAgent(conn net.Conn) (net.Conn, error) {
+	if ser.tls == nil {
+		return conn, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), protocol.HandshakeTimeout)
+	defer cancel()
+	return util.TLSHandshake(ctx, tls.Server(conn, ser.tls.PeerConfig(config.AgentTLSName)))
+}
+
+// dialAgent opens a conn to the transfer port of the agent at clusterIp.
+func (ser *AgentServer) dialAgent(clusterIp string) (*protocol.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), protocol.HandshakeTimeout)
+	defer cancel()
+	rawConn, err := ser.peerTransport.Dial(ctx, net.JoinHostPort(clusterIp, strconv.Itoa(ser.peerPort)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create connection to %s: %w", clusterIp, err)
+	}
+	if ser.tls != nil {
+		if rawConn, err = util.TLSHandshake(ctx, tls.Client(rawConn, ser.tls.ClientConfig(config.AgentTLSName))); err != nil {
+			return nil, err
+		}
+	}
+	conn, err := protocol.Client(rawConn)
+	if err != nil {
+		rawConn.Close()
+		return nil, fmt.Errorf("failed to handshake with peer agent %s: %w", clusterIp, err)
+	}
+	logPath("agent", conn)
+	return conn, nil
+}
@@ -0,0 +1,190 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"log"
+	"smart-agent/protocol"
+	"sync"
+	"sync/atomic"
+)
+
+// frames queued for a client conn at most, a producer finding the queue
+// full waits for room
+const writeQueueLen = 256
+
+var errWriterClosed = errors.New("conn writer closed")
+
+// connWriter owns the writes to a client conn. Whoever sends the client a
+// frame, its own handler, the senders relaying to it or the agent draining,
+// queues it here and one goroutine writes the frames in order, so frames
+// never interleave on the conn.
+type connWriter struct {
+	conn  *protocol.Conn
+	queue chan outFrame
+	// closed by close, and once the writer has stopped
+	closing   chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+	// held by enqueue while it queues, set by run before the last flush so
+	// that no frame is queued once it is done
+	mu     sync.RWMutex
+	closed bool
+	// the write that failed, only touched by run
+	err error
+
+	queued  atomic.Uint64
+	written atomic.Uint64
+	failed  atomic.Uint64
+	waits   atomic.Uint64
+}
+
+// outFrame is a queued frame, done gets the result of its write if set.
+type outFrame struct {
+	m    protocol.Message
+	done chan error
+}
+
+// writerStats is the queue of a client conn as shown in the metrics.
+type writerStats struct {
+	Depth    int
+	Capacity int
+	Queued   uint64
+	Written  uint64
+	// frames not written because the conn failed
+	Failed uint64
+	// times a producer waited for room in the queue
+	Waits uint64
+}
+
+func newConnWriter(conn *protocol.Conn) *connWriter {
+	w := &connWriter{
+		conn:    conn,
+		queue:   make(chan outFrame, writeQueueLen),
+		closing: make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+func (w *connWriter) run() {
+	defer close(w.stopped)
+	for {
+		select {
+		case f := <-w.queue:
+			w.write(f)
+		case <-w.closing:
+			// waits for the producers queueing, what they queued is still
+			// written
+			w.mu.Lock()
+			w.closed = true
+			w.mu.Unlock()
+			for {
+				select {
+				case f := <-w.queue:
+					w.write(f)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (w *connWriter) write(f outFrame) {
+	if w.err == nil {
+		if err := w.conn.Send(f.m); err != nil {
+			// a client that cannot be written to is given up, which ends
+			// its handler too
+			log.Printf("Failed to write to client %s: %v\n", w.conn.RemoteAddr(), err)
+			w.err = err
+			w.conn.Close()
+		}
+	}
+	if w.err != nil {
+		w.failed.Add(1)
+	} else {
+		w.written.Add(1)
+	}
+	if f.done != nil {
+		f.done <- w.err
+	}
+}
+
+// enqueue waits for room in the queue until ctx is done. A frame it has
+// queued is written, or failed, before the writer stops.
+func (w *connWriter) enqueue(ctx context.Context, f outFrame) error {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.closed {
+		return errWriterClosed
+	}
+	select {
+	case w.queue <- f:
+		w.queued.Add(1)
+		return nil
+	default:
+	}
+	w.waits.Add(1)
+	select {
+	case w.queue <- f:
+		w.queued.Add(1)
+		return nil
+	case <-w.closing:
+		return errWriterClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Post queues m without waiting for it to be written. A client that has
+// not made room in the queue within the write timeout is given up, a closed
+// writer fails with errWriterClosed and m is not sent.
+func (w *connWriter) Post(m protocol.Message) error {
+	ctx, cancel := context.WithTimeout(context.Background(), protocol.DefaultWriteTimeout)
+	defer cancel()
+	err := w.enqueue(ctx, outFrame{m: m})
+	if err == context.DeadlineExceeded {
+		log.Printf("write queue of client %s is stuck, close it\n", w.conn.RemoteAddr())
+		w.conn.Close()
+	}
+	return err
+}
+
+// Send queues m and waits until it is written.
+func (w *connWriter) Send(m protocol.Message) error {
+	return w.SendContext(context.Background(), m)
+}
+
+// SendContext queues m and waits until it is written or ctx is done.
+func (w *connWriter) SendContext(ctx context.Context, m protocol.Message) error {
+	done := make(chan error, 1)
+	if err := w.enqueue(ctx, outFrame{m: m, done: done}); err != nil {
+		return err
+	}
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// close writes what is queued and stops the writer. Frames queued later
+// fail with errWriterClosed.
+func (w *connWriter) close() {
+	w.closeOnce.Do(func() { close(w.closing) })
+	<-w.stopped
+}
+
+func (w *connWriter) stats() writerStats {
+	return writerStats{
+		Depth:    len(w.queue),
+		Capacity: cap(w.queue),
+		Queued:   w.queued.Load(),
+		Written:  w.written.Load(),
+		Failed:   w.failed.Load(),
+		Waits:    w.waits.Load(),
+	}
+}
@@ -0,0 +1,145 @@
+package agent
+
+import (
+	"net"
+	"smart-agent/protocol"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// pipe returns the two ends of a protocol conn.
+func pipe(t *testing.T) (*protocol.Conn, *protocol.Conn) {
+	t.Helper()
+	a, b := net.Pipe()
+	accepted := make(chan *protocol.Conn, 1)
+	go func() {
+		conn, err := protocol.Server(a)
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- conn
+	}()
+	client, err := protocol.Client(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := <-accepted
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return server, client
+}
+
+func TestConnWriter(t *testing.T) {
+	server, client := pipe(t)
+	w := newConnWriter(server)
+	const producers, frames = 8, 100
+
+	var wg sync.WaitGroup
+	for p := 0; p < producers; p++ {
+		sender := string(rune('a' + p))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for seq := uint64(1); seq <= frames; seq++ {
+				m := &protocol.Data{Sender: sender, Seq: seq, Payload: make([]byte, 512)}
+				var err error
+				if seq%2 == 0 {
+					err = w.Send(m)
+				} else {
+					err = w.Post(m)
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	// every frame arrives whole, and those of a producer in order
+	last := make(map[string]uint64)
+	for i := 0; i < producers*frames; i++ {
+		msg, err := client.Expect(protocol.TypeData)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d := msg.(*protocol.Data)
+		if d.Seq != last[d.Sender]+1 || len(d.Payload) != 512 {
+			t.Fatalf("frame %d of %s after %d, %d bytes", d.Seq, d.Sender, last[d.Sender], len(d.Payload))
+		}
+		last[d.Sender] = d.Seq
+	}
+	wg.Wait()
+	w.close()
+	if st := w.stats(); st.Queued != producers*frames || st.Written != producers*frames || st.Depth != 0 {
+		t.Fatalf("stats %+v", st)
+	}
+	if err := w.Post(&protocol.Drain{}); err != errWriterClosed {
+		t.Fatalf("post after close = %v, want %v", err, errWriterClosed)
+	}
+}
+
+func TestConnWriterFailure(t *testing.T) {
+	server, client := pipe(t)
+	w := newConnWriter(server)
+	defer w.close()
+	client.Close()
+	if err := w.Send(&protocol.Drain{}); err == nil {
+		t.Fatal("send to a closed peer succeeded")
+	}
+	// the conn is given up, later frames fail as well
+	if err := w.Send(&protocol.Drain{}); err == nil {
+		t.Fatal("send after a failed write succeeded")
+	}
+	if st := w.stats(); st.Failed != 2 || st.Written != 0 {
+		t.Fatalf("stats %+v", st)
+	}
+}
+
+func TestConnWriterPostRacingClose(t *testing.T) {
+	for round := 0; round < 50; round++ {
+		server, client := pipe(t)
+		w := newConnWriter(server)
+		const producers, frames = 4, 50
+
+		received := make(chan int, 1)
+		go func() {
+			n := 0
+			for {
+				if _, err := client.Expect(protocol.TypeData); err != nil {
+					received <- n
+					return
+				}
+				n++
+			}
+		}()
+		var posted atomic.Int64
+		var wg sync.WaitGroup
+		for p := 0; p < producers; p++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for seq := uint64(1); seq <= frames; seq++ {
+					err := w.Post(&protocol.Data{Sender: "a", Seq: seq})
+					if err == errWriterClosed {
+						return
+					}
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					posted.Add(1)
+				}
+			}()
+		}
+		w.close()
+		wg.Wait()
+		server.Close()
+		// a frame Post took is written, none is lost to the close
+		if n := <-received; int64(n) != posted.Load() {
+			t.Fatalf("round %d: %d frames posted, %d written", round, posted.Load(), n)
+		}
+	}
+}
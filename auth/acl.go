@@ -0,0 +1,87 @@
+package auth
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Actions a client can be granted on a peer.
+const (
+	ActionSend  = "send"
+	ActionRecv  = "recv"
+	ActionFetch = "fetch"
+)
+
+// Wildcard matches any client id in an ACL rule.
+const Wildcard = "*"
+
+type rule struct {
+	client, action, peer string
+}
+
+// ACL lists which client may do what to which peer, anything not listed is
+// denied. A nil ACL allows everything. Each line of an ACL file is a rule
+//
+//	<client> <send|recv|fetch> <peer>
+//
+// where client and peer may be *. Blank lines and lines starting with # are
+// skipped. A client may always fetch its own data.
+type ACL struct {
+	rules []rule
+}
+
+// LoadACL reads an ACL file.
+func LoadACL(path string) (*ACL, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseACL(f)
+}
+
+// ParseACL reads ACL rules from r.
+func ParseACL(r io.Reader) (*ACL, error) {
+	acl := &ACL{}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("auth: acl line %d: want <client> <action> <peer>", n)
+		}
+		switch fields[1] {
+		case ActionSend, ActionRecv, ActionFetch:
+		default:
+			return nil, fmt.Errorf("auth: acl line %d: unknown action %q", n, fields[1])
+		}
+		acl.rules = append(acl.rules, rule{client: fields[0], action: fields[1], peer: fields[2]})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return acl, nil
+}
+
+// Allow reports whether client may perform action on peer.
+func (a *ACL) Allow(client, action, peer string) bool {
+	if a == nil || (action == ActionFetch && client == peer) {
+		return true
+	}
+	for _, r := range a.rules {
+		if r.action == action && match(r.client, client) && match(r.peer, peer) {
+			return true
+		}
+	}
+	return false
+}
+
+func match(pattern, id string) bool {
+	return pattern == Wildcard || pattern == id
+}
@@ -0,0 +1,85 @@
+// Package auth checks who a client is and what it may do.
+//
+// A client proves it owns its id with the credential it sends in Register. A
+// Verifier checks the credential, an ACL then decides which peers the client
+// may send to, receive from or fetch the data of.
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"smart-agent/config"
+	"strings"
+)
+
+// ErrUnauthenticated is returned by a Verifier for a missing or wrong
+// credential.
+var ErrUnauthenticated = errors.New("auth: invalid credential")
+
+// Verifier checks that credential proves the identity clientId.
+type Verifier interface {
+	Verify(ctx context.Context, clientId, credential string) error
+}
+
+// AllowAll accepts every client, it is used when authentication is off.
+type AllowAll struct{}
+
+func (AllowAll) Verify(ctx context.Context, clientId, credential string) error {
+	return nil
+}
+
+// HMACVerifier accepts static tokens, the hex HMAC-SHA256 of the client id
+// under a secret shared by the agents. An operator issues a token with
+// HMACToken, or with `echo -n <id> | openssl dgst -sha256 -hmac <secret>`.
+type HMACVerifier struct {
+	Secret []byte
+}
+
+// HMACToken returns the token of clientId under secret.
+func HMACToken(secret []byte, clientId string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(clientId))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (v *HMACVerifier) Verify(ctx context.Context, clientId, credential string) error {
+	want := HMACToken(v.Secret, clientId)
+	if !hmac.Equal([]byte(strings.ToLower(credential)), []byte(want)) {
+		return ErrUnauthenticated
+	}
+	return nil
+}
+
+// TokenReviewer asks Kubernetes who a bearer token belongs to.
+type TokenReviewer interface {
+	ReviewToken(ctx context.Context, token string) (username string, authenticated bool, err error)
+}
+
+// TokenReviewVerifier accepts Kubernetes tokens, e.g. of a service account.
+// The user a token belongs to has to be the client id, or the service account
+// named like it in the agents' namespace,
+// system:serviceaccount:<namespace>:<client id>.
+type TokenReviewVerifier struct {
+	Reviewer TokenReviewer
+}
+
+func (v *TokenReviewVerifier) Verify(ctx context.Context, clientId, credential string) error {
+	if credential == "" {
+		return ErrUnauthenticated
+	}
+	username, ok, err := v.Reviewer.ReviewToken(ctx, credential)
+	if err != nil {
+		return fmt.Errorf("auth: token review: %w", err)
+	}
+	if !ok {
+		return ErrUnauthenticated
+	}
+	if username != clientId && username != "system:serviceaccount:"+config.Namespace+":"+clientId {
+		return fmt.Errorf("%w: token of %s used by %s", ErrUnauthenticated, username, clientId)
+	}
+	return nil
+}
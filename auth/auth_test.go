@@ -0,0 +1,97 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestHMACVerifier(t *testing.T) {
+	v := &HMACVerifier{Secret: []byte("secret")}
+	ctx := context.Background()
+	token := HMACToken(v.Secret, "cli1")
+	if err := v.Verify(ctx, "cli1", token); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Verify(ctx, "cli1", strings.ToUpper(token)); err != nil {
+		t.Fatalf("upper case hex rejected: %v", err)
+	}
+	// the token of one client does not work for another
+	if err := v.Verify(ctx, "cli2", token); !errors.Is(err, ErrUnauthenticated) {
+		t.Fatalf("token of cli1 accepted for cli2: %v", err)
+	}
+	if err := v.Verify(ctx, "cli1", ""); !errors.Is(err, ErrUnauthenticated) {
+		t.Fatalf("empty token accepted: %v", err)
+	}
+}
+
+type fakeReviewer map[string]string
+
+func (f fakeReviewer) ReviewToken(ctx context.Context, token string) (string, bool, error) {
+	username, ok := f[token]
+	return username, ok, nil
+}
+
+func TestTokenReviewVerifier(t *testing.T) {
+	v := &TokenReviewVerifier{Reviewer: fakeReviewer{
+		"sa-token":   "system:serviceaccount:smart-agent:cli1",
+		"user-token": "cli2",
+		"other-ns":   "system:serviceaccount:other:cli1",
+	}}
+	ctx := context.Background()
+	if err := v.Verify(ctx, "cli1", "sa-token"); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Verify(ctx, "cli2", "user-token"); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct{ id, token string }{
+		{"cli2", "sa-token"},
+		{"li1", "sa-token"},
+		{"cli1", "other-ns"},
+		{"cli1", "unknown"},
+		{"cli1", ""},
+	} {
+		if err := v.Verify(ctx, c.id, c.token); !errors.Is(err, ErrUnauthenticated) {
+			t.Fatalf("%s with %q: got %v", c.id, c.token, err)
+		}
+	}
+}
+
+func TestACL(t *testing.T) {
+	acl, err := ParseACL(strings.NewReader(`
+# client action peer
+cli1 send cli2
+cli2 recv cli1
+ops  fetch *
+*    send  public
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		client, action, peer string
+		want                 bool
+	}{
+		{"cli1", ActionSend, "cli2", true},
+		{"cli2", ActionSend, "cli1", false},
+		{"cli2", ActionRecv, "cli1", true},
+		{"cli3", ActionRecv, "cli1", false},
+		{"ops", ActionFetch, "cli1", true},
+		{"cli1", ActionFetch, "cli2", false},
+		{"cli1", ActionFetch, "cli1", true},
+		{"anyone", ActionSend, "public", true},
+	} {
+		if got := acl.Allow(c.client, c.action, c.peer); got != c.want {
+			t.Errorf("%s %s %s: got %v, want %v", c.client, c.action, c.peer, got, c.want)
+		}
+	}
+	var none *ACL
+	if !none.Allow("cli1", ActionSend, "cli2") {
+		t.Fatal("nil acl denies")
+	}
+	if _, err := ParseACL(strings.NewReader("cli1 write cli2")); err == nil {
+		t.Fatal("unknown action accepted")
+	}
+}
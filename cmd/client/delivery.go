@@ -0,0 +1,308 @@
+package main
+
+import (
+	"fmt"
+	"smart-agent/protocol"
+	"strings"
+	"sync"
+	"time"
+)
+
+// number of delivered messages remembered for .status
+const deliveredHistory = 20
+
+const (
+	// how long a sender waits for a credit for its next frame before it
+	// sends it anyway, its agent holds it back then
+	creditTimeout = 2 * time.Second
+	// how long a sender waits for a credit after its agent said it is busy
+	busyBackoff = 500 * time.Millisecond
+)
+
+// sentMessage is a message sent by this client. It is delivered once the
+// receiver has acked seq, the sequence number of its last frame.
+type sentMessage struct {
+	first  uint64
+	seq    uint64
+	desc   string
+	sentAt time.Time
+	// resend sends the message again with the same seqs
+	resend func(*protocol.Stream, *protocol.Conn) error
+}
+
+// deliveryTracker numbers the frames this client sends and records which
+// messages the receiver has acknowledged.
+type deliveryTracker struct {
+	stream protocol.Stream
+
+	mu        sync.Mutex
+	acked     uint64
+	pending   []sentMessage
+	delivered []sentMessage
+}
+
+func newDeliveryTracker(clientId string) *deliveryTracker {
+	return &deliveryTracker{stream: protocol.Stream{Sender: clientId}}
+}
+
+// sent records the message whose frames from first on have just been sent,
+// even if sending failed halfway. It is kept until acked, so resend can send
+// it again after the client moves to another agent.
+func (t *deliveryTracker) sent(first uint64, desc string, resend func(*protocol.Stream, *protocol.Conn) error) uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	seq := t.stream.Seq
+	if seq >= first && seq > t.acked {
+		t.pending = append(t.pending, sentMessage{first: first, seq: seq, desc: desc, sentAt: time.Now(), resend: resend})
+	}
+	return seq
+}
+
+// ackedSeq returns the last seq acked by the receiver.
+func (t *deliveryTracker) ackedSeq() uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.acked
+}
+
+// resume continues the stream on conn after the client registered with an
+// agent. The agents hold every frame up to seq, pending messages after it are
+// sent again. A session that could not be resumed numbers its frames from 1
+// again and gives up the messages still pending.
+func (t *deliveryTracker) resume(conn *protocol.Conn, resumed bool, seq uint64) error {
+	t.mu.Lock()
+	pending := append([]sentMessage(nil), t.pending...)
+	if !resumed {
+		t.pending = nil
+		t.acked = 0
+		t.stream.Seq = 0
+	}
+	t.mu.Unlock()
+	if !resumed {
+		if len(pending) > 0 {
+			fmt.Printf("session not resumed, %d messages may be lost\n", len(pending))
+		}
+		return nil
+	}
+	n := 0
+	for _, m := range pending {
+		if m.seq <= seq {
+			continue
+		}
+		// the agent drops the frames of m it already holds
+		t.stream.Seq = m.first - 1
+		if err := m.resend(&t.stream, conn); err != nil {
+			return err
+		}
+		n++
+	}
+	if n > 0 {
+		fmt.Printf("%d messages sent again after seq %d\n", n, seq)
+	}
+	return nil
+}
+
+// ack marks every message up to seq as delivered.
+func (t *deliveryTracker) ack(seq uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if seq <= t.acked {
+		return
+	}
+	t.acked = seq
+	i := 0
+	for ; i < len(t.pending) && t.pending[i].seq <= seq; i++ {
+		t.delivered = append(t.delivered, t.pending[i])
+	}
+	t.pending = t.pending[i:]
+	if n := len(t.delivered); n > deliveredHistory {
+		t.delivered = t.delivered[n-deliveredHistory:]
+	}
+}
+
+// isDelivered reports whether the message ending at seq has been acked.
+func (t *deliveryTracker) isDelivered(seq uint64) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return seq <= t.acked
+}
+
+func (t *deliveryTracker) print() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	fmt.Printf("last sent seq: %d, acked seq: %d\n", t.stream.Seq, t.acked)
+	fmt.Printf("%-8s %-12s %-30s\n", "Seq", "State", "Message")
+	fmt.Println(strings.Repeat("-", 50))
+	for _, m := range t.delivered {
+		fmt.Printf("%-8d %-12s %-30s\n", m.seq, "delivered", m.desc)
+	}
+	for _, m := range t.pending {
+		fmt.Printf("%-8d %-12s %-30s\n", m.seq, fmt.Sprintf("pending %s", time.Since(m.sentAt).Truncate(time.Second)), m.desc)
+	}
+	fmt.Println(strings.Repeat("-", 50))
+}
+
+// receiveCursors record the last seq a receiver has got from each sender, so
+// the agent it moves to sends only what is missing.
+type receiveCursors struct {
+	mu   sync.Mutex
+	seqs map[string]uint64
+}
+
+func newReceiveCursors() *receiveCursors {
+	return &receiveCursors{seqs: make(map[string]uint64)}
+}
+
+func (c *receiveCursors) see(sender string, seq uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seqs[sender] = seq
+}
+
+// get returns the last seq got from sender.
+func (c *receiveCursors) get(sender string) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.seqs[sender]
+}
+
+func (c *receiveCursors) list() []protocol.Cursor {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cursors := make([]protocol.Cursor, 0, len(c.seqs))
+	for sender, seq := range c.seqs {
+		cursors = append(cursors, protocol.Cursor{Sender: sender, Seq: seq})
+	}
+	return cursors
+}
+
+// creditGate holds the frames of a sender back while its receiver has no
+// credit for them. Credits pace the sender, the agent is what enforces
+// them: a frame waits for its credit at most creditTimeout.
+type creditGate struct {
+	mu       sync.Mutex
+	credit   uint64
+	credited bool
+	busy     time.Time
+	// closed and replaced whenever a credit comes
+	changed chan struct{}
+}
+
+func newCreditGate() *creditGate {
+	return &creditGate{changed: make(chan struct{})}
+}
+
+// wait blocks until the receiver has credit for frame seq.
+func (g *creditGate) wait(seq uint64) {
+	deadline := time.Now().Add(creditTimeout)
+	for {
+		g.mu.Lock()
+		blocked := g.credited && seq > g.credit
+		busy := time.Until(g.busy)
+		changed := g.changed
+		g.mu.Unlock()
+		if !blocked && busy <= 0 {
+			return
+		}
+		wait := time.Until(deadline)
+		if !blocked {
+			wait = busy
+		}
+		if wait <= 0 {
+			return
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-changed:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// grant lets frames up to seq go.
+func (g *creditGate) grant(seq uint64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.credit, g.credited = seq, true
+	g.busy = time.Time{}
+	close(g.changed)
+	g.changed = make(chan struct{})
+}
+
+// backOff holds the next frames until a credit comes or busyBackoff is over.
+func (g *creditGate) backOff() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.busy = time.Now().Add(busyBackoff)
+}
+
+// reset forgets the credits, the next agent grants its own.
+func (g *creditGate) reset() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.credited = false
+	g.busy = time.Time{}
+	close(g.changed)
+	g.changed = make(chan struct{})
+}
+
+// creditGrants are the credits a receiver has granted its senders. It grants
+// window frames ahead of what it has got, once half of the last grant is
+// used up.
+type creditGrants struct {
+	window  uint64
+	granted map[string]uint64
+}
+
+func newCreditGrants(window int) *creditGrants {
+	if window < 1 {
+		window = 1
+	}
+	return &creditGrants{window: uint64(window), granted: make(map[string]uint64)}
+}
+
+// next returns the credit to grant sender after frame seq, false while the
+// last one is good for long enough.
+func (g *creditGrants) next(sender string, seq uint64) (uint64, bool) {
+	if g.granted[sender] > seq+g.window/2 {
+		return 0, false
+	}
+	g.granted[sender] = seq + g.window
+	return g.granted[sender], true
+}
+
+// reset forgets what was granted, the agent a receiver moved to has not
+// heard of it.
+func (g *creditGrants) reset() {
+	g.granted = make(map[string]uint64)
+}
+
+// readLoop reads everything the agent sends to a sender. Acks update the
+// tracker, credits and Busy pace its frames, a Drain makes the REPL move to
+// another agent, any other message is handed to replies.
+func (cli *AgentClient) readLoop(conn *protocol.Conn, replies chan<- protocol.Message) {
+	defer close(replies)
+	for {
+		msg, err := conn.Recv()
+		if err != nil {
+			return
+		}
+		switch m := msg.(type) {
+		case *protocol.Ack:
+			cli.delivery.ack(m.Seq)
+		case *protocol.Credit:
+			cli.credits.grant(m.Seq)
+		case *protocol.Busy:
+			fmt.Printf("agent holds frames from %d in storage, slowing down\n", m.Seq)
+			cli.credits.backOff()
+		case *protocol.Drain:
+			select {
+			case cli.drains <- struct{}{}:
+			default:
+			}
+		default:
+			replies <- msg
+		}
+	}
+}
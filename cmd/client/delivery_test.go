@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net"
+	"smart-agent/protocol"
+	"testing"
+	"time"
+)
+
+func TestDeliveryTracker(t *testing.T) {
+	tr := newDeliveryTracker("sender")
+	tr.stream.Seq = 1
+	tr.sent(1, "first", nil)
+	// a chunked message of three frames
+	tr.stream.Seq = 4
+	last := tr.sent(2, "second", nil)
+
+	tr.ack(1)
+	if !tr.isDelivered(1) || tr.isDelivered(last) {
+		t.Fatalf("after ack 1: acked %d, pending %v", tr.acked, tr.pending)
+	}
+	// acks are cumulative and never go backwards
+	tr.ack(4)
+	tr.ack(2)
+	if !tr.isDelivered(last) || len(tr.pending) != 0 || len(tr.delivered) != 2 {
+		t.Fatalf("after ack 4: acked %d, pending %v, delivered %v", tr.acked, tr.pending, tr.delivered)
+	}
+}
+
+func TestDeliveryTrackerResume(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	tr := newDeliveryTracker("sender")
+	send := func(payload []byte) func(*protocol.Stream, *protocol.Conn) error {
+		return func(s *protocol.Stream, c *protocol.Conn) error {
+			return s.SendBytes(c, payload)
+		}
+	}
+	tr.stream.Seq = 1
+	tr.sent(1, "first", send([]byte("first")))
+	// a chunked message of three frames
+	tr.stream.Seq = 4
+	tr.sent(2, "second", send(make([]byte, 2*protocol.MaxChunkSize+1)))
+	tr.stream.Seq = 5
+	tr.sent(5, "third", send([]byte("third")))
+	tr.ack(1)
+
+	errCh := make(chan error, 1)
+	go func() {
+		// the agent holds frames up to 3, the middle of the second message
+		errCh <- tr.resume(&protocol.Conn{Conn: c1}, true, 3)
+	}()
+	recv := &protocol.Conn{Conn: c2}
+	for want := uint64(2); want <= 5; want++ {
+		m, err := recv.Expect(protocol.TypeData)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seq := m.(*protocol.Data).Seq; seq != want {
+			t.Fatalf("resent frame has seq %d, want %d", seq, want)
+		}
+	}
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	if tr.stream.Seq != 5 {
+		t.Fatalf("stream continues at seq %d, want 5", tr.stream.Seq)
+	}
+
+	// a new session starts over
+	if err := tr.resume(nil, false, 0); err != nil {
+		t.Fatal(err)
+	}
+	if tr.stream.Seq != 0 || tr.ackedSeq() != 0 || len(tr.pending) != 0 {
+		t.Fatalf("after a new session: seq %d, acked %d, pending %v", tr.stream.Seq, tr.ackedSeq(), tr.pending)
+	}
+}
+
+func TestCreditGate(t *testing.T) {
+	g := newCreditGate()
+	// not held back before the first credit
+	g.wait(100)
+
+	g.grant(2)
+	g.wait(2)
+	released := make(chan struct{})
+	go func() {
+		g.wait(3)
+		close(released)
+	}()
+	select {
+	case <-released:
+		t.Fatal("frame 3 went without credit")
+	case <-time.After(50 * time.Millisecond):
+	}
+	g.grant(3)
+	select {
+	case <-released:
+	case <-time.After(time.Second):
+		t.Fatal("frame 3 still held back after its credit")
+	}
+
+	// a new agent grants its own credits
+	g.reset()
+	g.wait(10)
+}
+
+func TestCreditGrants(t *testing.T) {
+	g := newCreditGrants(8)
+	if seq, ok := g.next("s1", 0); !ok || seq != 8 {
+		t.Fatalf("first grant %d %v, want 8", seq, ok)
+	}
+	// granted again once half the window is used up
+	for frame := uint64(1); frame < 4; frame++ {
+		if seq, ok := g.next("s1", frame); ok {
+			t.Fatalf("granted %d after frame %d", seq, frame)
+		}
+	}
+	if seq, ok := g.next("s1", 4); !ok || seq != 12 {
+		t.Fatalf("grant after frame 4 is %d %v, want 12", seq, ok)
+	}
+	if seq, ok := g.next("s2", 0); !ok || seq != 8 {
+		t.Fatalf("first grant of s2 %d %v, want 8", seq, ok)
+	}
+}
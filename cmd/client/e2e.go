@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"fmt"
+	"smart-agent/e2e"
+	"smart-agent/protocol"
+	"sync"
+)
+
+// e2eState is the key of a client running with -e2e and the channels it
+// opens frames of its senders with.
+type e2eState struct {
+	key   *e2e.KeyPair
+	peers *e2e.PeerKeys
+
+	mu       sync.Mutex
+	channels map[string]*e2e.Channel
+}
+
+// enableE2E loads the key of the client, or creates one when keyFile is
+// empty, and publishes its public key in the registry. The keys of peers are
+// pinned in peersFile, next to keyFile when it is empty.
+func (cli *AgentClient) enableE2E(keyFile, peersFile string) error {
+	var key *e2e.KeyPair
+	var err error
+	if keyFile == "" {
+		key, err = e2e.GenerateKey()
+	} else {
+		key, err = e2e.LoadOrCreateKey(keyFile)
+	}
+	if err != nil {
+		return err
+	}
+	if peersFile == "" && keyFile != "" {
+		peersFile = keyFile + ".peers"
+	}
+	peers, err := e2e.LoadPeerKeys(peersFile)
+	if err != nil {
+		return err
+	}
+	err = tryFunc(3, func() error {
+		return cli.k8sCli.EtcdPut(e2e.PublicKeyName(cli.clientId), key.PublicKey())
+	})
+	if err != nil {
+		return fmt.Errorf("publish public key: %w", err)
+	}
+	cli.e2e = &e2eState{key: key, peers: peers, channels: make(map[string]*e2e.Channel)}
+	return nil
+}
+
+func (cli *AgentClient) peerKey(clientId string) (*ecdh.PublicKey, error) {
+	pub, err := cli.k8sCli.EtcdGet(e2e.PublicKeyName(clientId))
+	if err != nil {
+		return nil, err
+	}
+	if pub == "" {
+		return nil, fmt.Errorf("%s has not published its public key, it has to run with -e2e", clientId)
+	}
+	// the registry is written by the agents too, a key is only taken once
+	if err := cli.e2e.peers.Check(clientId, pub); err != nil {
+		return nil, err
+	}
+	return e2e.ParsePublicKey(pub)
+}
+
+// ensureSeal makes the stream of a sender encrypt its frames for the
+// receiver once the receiver's public key is known.
+func (cli *AgentClient) ensureSeal() error {
+	if cli.e2e == nil || cli.delivery.stream.Seal != nil {
+		return nil
+	}
+	pub, err := cli.peerKey(cli.receiverId)
+	if err != nil {
+		return err
+	}
+	ch, err := e2e.NewChannel(cli.e2e.key, pub, cli.clientId, cli.receiverId)
+	if err != nil {
+		return err
+	}
+	cli.delivery.stream.Seal = ch.Seal
+	return nil
+}
+
+// openData decrypts a frame a receiver got. With -e2e only sealed frames of
+// senders are accepted.
+func (cli *AgentClient) openData(m *protocol.Data) error {
+	if !m.Encrypted {
+		if cli.e2e != nil && m.Sender != "" {
+			return fmt.Errorf("plaintext frame %d of %s, -e2e only accepts encrypted ones", m.Seq, m.Sender)
+		}
+		return nil
+	}
+	if cli.e2e == nil {
+		return fmt.Errorf("frame %d of %s is encrypted, run with -e2e", m.Seq, m.Sender)
+	}
+	ch, err := cli.e2e.channel(cli, m.Sender)
+	if err != nil {
+		return err
+	}
+	// the key of the sender is pinned, a frame it does not open was not
+	// sealed by it
+	return ch.Open(m)
+}
+
+func (s *e2eState) channel(cli *AgentClient, sender string) (*e2e.Channel, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ch, ok := s.channels[sender]; ok {
+		return ch, nil
+	}
+	pub, err := cli.peerKey(sender)
+	if err != nil {
+		return nil, err
+	}
+	ch, err := e2e.NewChannel(s.key, pub, sender, cli.clientId)
+	if err != nil {
+		return nil, err
+	}
+	s.channels[sender] = ch
+	return ch, nil
+}
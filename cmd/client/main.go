@@ -2,18 +2,22 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"k8s.io/client-go/util/homedir"
 	"math"
 	"net"
 	"os"
-	"os/exec"
 	"os/signal"
 	"path/filepath"
 	"regexp"
 	"smart-agent/config"
+	"smart-agent/mptcp"
+	"smart-agent/protocol"
 	"smart-agent/service"
+	"smart-agent/transport"
 	"smart-agent/util"
 	"strconv"
 	"strings"
@@ -32,7 +36,7 @@ type ServerInfo struct {
 
 type AgentClient struct {
 	clientId      string
-	conn          net.Conn
+	conn          *protocol.Conn
 	k8sCli        service.K8SClient
 	k8sSvc        []service.Service
 	serverInfo    []ServerInfo
@@ -43,6 +47,48 @@ type AgentClient struct {
 	receiverId    string
 	senderIds     []string
 	priority      int
+	// share of the receiver asked for against the other senders, 0 for
+	// the priority
+	weight   int
+	outDir   string
+	delivery *deliveryTracker
+	// credits of a sender from its receiver, and those a receiver grants
+	credits *creditGate
+	grants  *creditGrants
+	// messages from the agent other than acks, only used by senders
+	replies chan protocol.Message
+	// session issued by the agent, presented again when moving to another one
+	token string
+	// what a receiver has got so far, it outlives the connection to an agent
+	// so a message cut by a handover is completed by the next agent
+	cursors *receiveCursors
+	sink    *dataSink
+	// nil for a plaintext connection to the agent
+	tlsConfig *tls.Config
+	// proves the client owns clientId, checked by the agent at registration
+	credential string
+	// nil unless payloads are encrypted end to end
+	e2e *e2eState
+	// how the agent is dialed, agentAddr replaces the address found in the
+	// cluster when it is set
+	transport transport.Transport
+	agentAddr string
+	// transport profile asked from the agent, and the one it applied
+	profile       string
+	activeProfile string
+	// signalled when the agent of a sender shuts down, receivers see it in
+	// their receive loop
+	drains chan struct{}
+	// where the last .fetch of each client ended, the next one goes on
+	// from there
+	fetched map[string]fetchOffset
+}
+
+// fetchOffset is an offset in the storage of the agent at clusterIp, it
+// means nothing to any other agent.
+type fetchOffset struct {
+	clusterIp string
+	offset    string
 }
 
 type stringSlice []string
@@ -64,6 +110,22 @@ func main() {
 	flag.Var(&recvFroms, "recvfrom", "Sender Client IDs")
 	kubeConfig := flag.String("config", "", "Kubernetes Config Path")
 	flag.IntVar(&priority, "priority", 0, "Client Priority")
+	window := flag.Int("window", config.CreditWindow, "Frames a receiver lets each sender send ahead of what it has got")
+	weight := flag.Int("weight", 0, "Share of the receiver against its other senders under -sched wfq or drr of the agent, the priority when 0")
+	outDir := flag.String("outdir", "", "Directory to save received data into, one file per message")
+	tlsCA := flag.String("tls-ca", "", "CA certificate of the agents, enables TLS")
+	tlsCert := flag.String("tls-cert", "", "Client certificate presented to the agent")
+	tlsKey := flag.String("tls-key", "", "Key of -tls-cert, if it is not in the same file")
+	tlsServerName := flag.String("tls-server-name", config.AgentTLSName, "Name the agent certificates are issued for")
+	credential := flag.String("credential", "", "Credential proving the client id, a HMAC token or a Kubernetes token")
+	credentialFile := flag.String("credential-file", "", "File holding the credential")
+	useE2E := flag.Bool("e2e", false, "Encrypt payloads end to end, agents only see ciphertext")
+	e2eKey := flag.String("e2e-key", "", "File keeping the private key of -e2e, created if missing")
+	e2ePeers := flag.String("e2e-peers", "", "File pinning the public keys of peers on first use, -e2e-key with .peers appended when empty")
+	transportName := flag.String("transport", transport.NameMPTCP, "Transport to the agent: tcp, mptcp, unix or memory")
+	profile := flag.String("profile", "", "Transport profile asked from the agent: default, backup, fullmesh or redundant")
+	agentAddr := flag.String("agent-addr", "", "Address of the agent to use instead of the one found in the cluster, a socket path for -transport unix")
+	ttl := flag.Duration("ttl", 0, "How long a message sent is worth delivering, agents drop it after instead of replaying it, forever when 0")
 	flag.Parse()
 
 	// Check if the input file flag is provided
@@ -71,13 +133,55 @@ func main() {
 		fmt.Println("Client Id is required.")
 		return
 	}
+	if !config.ValidClientId(*clientId) {
+		fmt.Println("Client Id may only hold letters, digits, '-' and '_'.")
+		return
+	}
 	if *sendTo != "" && len(recvFroms) > 0 {
 		fmt.Println("Can not be sender and receiver at the same time")
 		return
 	}
 	cli := newAgentClient(*clientId, *kubeConfig, priority)
+	cli.outDir = *outDir
+	tr, err := transport.New(*transportName)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	cli.transport = tr
+	cli.agentAddr = *agentAddr
+	cli.profile = *profile
+	cli.weight = *weight
+	cli.grants = newCreditGrants(*window)
+	cli.delivery.stream.TTL = *ttl
+	if *tlsCA != "" {
+		m, err := util.LoadTLSFiles(*tlsCA, *tlsCert, *tlsKey)
+		if err != nil {
+			fmt.Println("Failed to load certificates:", err)
+			return
+		}
+		cli.tlsConfig = m.ClientConfig(*tlsServerName)
+	} else if *tlsCert != "" {
+		fmt.Println("-tls-cert needs -tls-ca")
+		return
+	}
+	cli.credential = *credential
+	if *credentialFile != "" {
+		content, err := os.ReadFile(*credentialFile)
+		if err != nil {
+			fmt.Println("Failed to read credential:", err)
+			return
+		}
+		cli.credential = strings.TrimSpace(string(content))
+	}
 	cli.updateServerInfo()
 	cli.etcdCleanup()
+	if *useE2E {
+		if err := cli.enableE2E(*e2eKey, *e2ePeers); err != nil {
+			fmt.Println("Failed to set up end-to-end encryption:", err)
+			return
+		}
+	}
 	if *sendTo != "" {
 		cli.setSender(*sendTo)
 	} else if len(recvFroms) > 0 {
@@ -114,7 +218,14 @@ func newAgentClient(clientId string, kubeconfig string, priority int) AgentClien
 		prevClusterIp: "",
 		k8sIp:         ip,
 		priority:      priority,
-	}
+		delivery:      newDeliveryTracker(clientId),
+		credits:       newCreditGate(),
+		grants:        newCreditGrants(config.CreditWindow),
+		cursors:       newReceiveCursors(),
+		transport:     transport.MPTCP{},
+		drains:        make(chan struct{}, 1),
+	}
+	cli.delivery.stream.Wait = cli.credits.wait
 	return cli
 }
 
@@ -135,18 +246,33 @@ func tryFunc(n int, f func() error) error {
 
 func repl(cli AgentClient, eofCh chan bool) {
 	fmt.Println("Welcome to Client REPL! Type '.help' for available commands.")
-	scanner := bufio.NewScanner(os.Stdin)
+	// lines are read aside so the client can move while nothing is typed
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
 
 	for {
 		fmt.Print("> ")
-		if !scanner.Scan() {
-			eofCh <- true
-			break
+		var command string
+		select {
+		case <-cli.drains:
+			cli.moveAway()
+			continue
+		case line, ok := <-lines:
+			if !ok {
+				eofCh <- true
+				return
+			}
+			command = line
 		}
-		command := scanner.Text()
 
 		tokens := strings.Split(command, " ")
-		if len(tokens) > 2 {
+		if len(tokens) > 2 && !(tokens[0] == ".trans" && len(tokens) == 3) {
 			fmt.Println("Invalid command. Type '.help' for available commands.")
 			continue
 		}
@@ -159,10 +285,18 @@ func repl(cli AgentClient, eofCh chan bool) {
 			eofCh <- true
 			return
 		case ".trans":
-			policyName := tokens[1]
-			cli.chTransPolicy(policyName)
+			policyName, iface := "show", ""
+			if len(tokens) > 1 {
+				policyName = tokens[1]
+			}
+			if len(tokens) > 2 {
+				iface = tokens[2]
+			}
+			cli.chTransPolicy(policyName, iface)
 		case ".service":
 			cli.showService()
+		case ".status":
+			cli.delivery.print()
 		case ".connect":
 			svcName := tokens[1]
 			cli.connectToService(svcName)
@@ -175,13 +309,16 @@ func repl(cli AgentClient, eofCh chan bool) {
 		case ".sendfileToNode":
 			cli.sendFileToNode(tokens[1])
 		case ".fetch":
-			var fetchClient string
+			var fetchClient, offset string
 			if len(tokens) == 1 {
 				fetchClient = cli.clientId
 			} else {
 				fetchClient = tokens[1]
 			}
-			cli.fetchClientData(fetchClient)
+			if len(tokens) > 2 {
+				offset = tokens[2]
+			}
+			cli.fetchClientData(fetchClient, offset)
 		default:
 			fmt.Println("Unknown command. Type '.help' for available commands.")
 		}
@@ -197,13 +334,14 @@ func printHelp(role string) {
 The commands and arguments are:
     .help
     .exit
-    .trans    [policyName]
+    .trans    [show|default|fullmesh|backup|redundant] [interface]
     .service
     .connect  [serviceName]
     .send     [data]
     .sendfile [filePath]
     .sendfileToNode [filePath]
-    .fetch    [clientId]
+    .fetch    [clientId] [offset]
+    .status
 `, os.Args[0])
 	} else if role == config.RoleReceiver {
 		help = fmt.Sprintf(
@@ -276,42 +414,23 @@ func (cli *AgentClient) updateServerInfo() {
 }
 
 // 新增传输策略选择
-func (cli *AgentClient) chTransPolicy(policyName string) {
-	switch policyName {
-	case "fullmesh":
-		cmd := exec.Command("sysctl", "-w", "net.mptcp.mptcp_path_manager=fullmesh")
-		err := cmd.Run()
+// chTransPolicy configures the MPTCP path manager of this host for
+// policyName, with the addresses of iface or of every interface, or shows it.
+func (cli *AgentClient) chTransPolicy(policyName string, iface string) {
+	if policyName == "show" {
+		state, err := mptcp.Show()
 		if err != nil {
-			fmt.Println("Error executing fullmesh command:", err)
-		}
-	case "backup":
-		cmd := exec.Command("ip", "link", "set", "dev", "ens33", "multipath", "backup")
-		err := cmd.Run()
-		if err != nil {
-			fmt.Println("Error executing backup command:", err)
-		}
-	case "redundant":
-		cmd := exec.Command("sysctl", "-w", "net.mptcp.mptcp_scheduler=redundant")
-		err := cmd.Run()
-		if err != nil {
-			fmt.Println("Error executing redundant command:", err)
-		}
-	case "default":
-		cmd1 := exec.Command("sysctl", "-w", "net.mptcp.mptcp_path_manager=default")
-		cmd2 := exec.Command("ip", "link", "set", "dev", "ens33", "multipath", "off")
-		cmd3 := exec.Command("sysctl", "-w", "net.mptcp.mptcp_scheduler=default")
-
-		err1 := cmd1.Run()
-		err2 := cmd2.Run()
-		err3 := cmd3.Run()
-
-		if err1 != nil || err2 != nil || err3 != nil {
-			fmt.Println("Error executing default command")
+			fmt.Println("Failed to read the path manager:", err)
+			return
 		}
-	default:
-		fmt.Println("The transport policy does not exist")
+		fmt.Print(state)
+		return
 	}
-
+	if err := mptcp.Apply(policyName, iface); err != nil {
+		fmt.Println("Failed to change the transport policy:", err)
+		return
+	}
+	fmt.Println("transport policy set to", policyName)
 }
 
 func (cli *AgentClient) showService() {
@@ -321,15 +440,51 @@ func (cli *AgentClient) showService() {
 	fmt.Println(strings.Repeat("-", 70))
 	for _, info := range cli.serverInfo {
 		// TODO ip地址修改
-		fmt.Printf("%-20s %-25s %-15s %-15s\n", info.serviceName, fmt.Sprintf("%s:%d", cli.k8sIp, info.proxyPort),
+		fmt.Printf("%-20s %-25s %-15s %-15s\n", info.serviceName, net.JoinHostPort(cli.k8sIp, strconv.Itoa(int(info.proxyPort))),
 			fmt.Sprintf("%.3fms", float64(info.delay.Abs().Microseconds())/1000), fmt.Sprintf("%.3f", cli.getPingDelayJitter(info.pingPort)))
 	}
 	fmt.Println(strings.Repeat("-", 70))
+	cli.showPath()
+}
+
+// showPath prints how the connection to the current agent is carried.
+func (cli *AgentClient) showPath() {
+	if cli.conn == nil {
+		return
+	}
+	info, err := transport.Inspect(cli.conn)
+	if err == transport.ErrNoInfo {
+		return
+	}
+	if err != nil {
+		fmt.Println("Failed to inspect connection to agent:", err)
+		return
+	}
+	fmt.Printf("connected to %s over %s, %d subflows, transport profile %s\n", cli.conn.RemoteAddr(), info.Protocol(), len(info.Subflows), cli.activeProfile)
+	for i, sf := range info.Subflows {
+		fmt.Printf("  subflow %d: rtt %.3fms, rttvar %.3fms, retransmits %d\n", i,
+			float64(sf.RTT.Microseconds())/1000, float64(sf.RTTVar.Microseconds())/1000, sf.Retransmits)
+	}
 }
 
 func (cli *AgentClient) sendData(data string) {
 	if cli.conn != nil {
-		util.SendNetMessage(cli.conn, config.ClientData, data)
+		if err := cli.ensureSeal(); err != nil {
+			fmt.Println("Failed to send data:", err)
+			return
+		}
+		payload := []byte(data)
+		resend := func(s *protocol.Stream, c *protocol.Conn) error {
+			return s.SendBytes(c, payload)
+		}
+		first := cli.delivery.stream.Seq + 1
+		err := resend(&cli.delivery.stream, cli.conn)
+		seq := cli.delivery.sent(first, data, resend)
+		if err != nil {
+			fmt.Println("Failed to send data, it is sent again on the next .connect:", err)
+			return
+		}
+		fmt.Printf("message %d sent\n", seq)
 	}
 }
 
@@ -364,7 +519,7 @@ func (cli *AgentClient) findPingPort(svcName string) int32 {
 }
 
 func (cli *AgentClient) getPingDelay(port int32) (time.Duration, error) {
-	serverAddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", cli.k8sIp, port))
+	serverAddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(cli.k8sIp, strconv.Itoa(int(port))))
 	if err != nil {
 		fmt.Println("Error resolving server address:", err)
 		return 0, err
@@ -447,6 +602,32 @@ func (cli *AgentClient) connectToService(svcName string) {
 	cli.connectToIpPort(cli.k8sIp, proxyPort) // 不一定是master节点，集群中任一节点都可以
 }
 
+// moveAway moves to the agent with the lowest delay other than the current
+// one, which is shutting down. The session goes along.
+func (cli *AgentClient) moveAway() {
+	if cli.agentAddr != "" {
+		fmt.Println("agent is shutting down, there is no other agent with -agent-addr")
+		return
+	}
+	cli.updateServerInfo()
+	var next *ServerInfo
+	for i, info := range cli.serverInfo {
+		if info.serviceName == "" || info.transferIp == cli.currClusterIp {
+			continue
+		}
+		if next == nil || info.delay < next.delay {
+			next = &cli.serverInfo[i]
+		}
+	}
+	if next == nil {
+		fmt.Println("agent is shutting down, there is no other agent to move to")
+		return
+	}
+	fmt.Printf("agent %s is shutting down, move to %s\n", cli.currClusterIp, next.serviceName)
+	// the agent publishes where the client is once it has registered there
+	cli.connectToService(next.serviceName)
+}
+
 // used for local debugging
 func (cli *AgentClient) debugConnect(ip string, port int32) {
 	cli.prevClusterIp = cli.currClusterIp
@@ -466,33 +647,58 @@ func (cli *AgentClient) etcdCleanup() {
 }
 
 func (cli *AgentClient) roleTask() {
-	err := tryFunc(3, func() error {
-		return cli.k8sCli.EtcdPut(cli.clientId, cli.currClusterIp)
-	})
-	if err != nil {
-		fmt.Println("failed to put cluster ip:", err)
-		os.Exit(1)
-	}
 	if cli.role == config.RoleSender {
-		util.SendNetMessage(cli.conn, config.ClientId, cli.receiverId)
+		// the receiver id has been sent in Register
 	} else if cli.role == config.RoleReceiver {
-		util.SendNetMessage(cli.conn, config.RecvfromNum, strconv.Itoa(len(cli.senderIds)))
-		for _, senderId := range cli.senderIds {
-			util.SendNetMessage(cli.conn, config.ClientId, senderId)
-		}
 		fmt.Println("receiving data:")
+		if cli.sink == nil {
+			cli.sink = newDataSink(cli.outDir)
+		}
+		sink := cli.sink
 		endCount := 0
 		for {
-			cmd, data := util.RecvNetMessage(cli.conn)
-			if cmd == config.ClientData {
-				fmt.Println("data:", data)
-			} else if cmd == config.TransferEnd {
-				endCount++
-				fmt.Println("receive all data from:", data)
-				if endCount >= len(cli.senderIds) {
-					fmt.Println("receiving data ends")
-					break
+			msg, err := cli.conn.Recv()
+			if err != nil {
+				fmt.Println("Failed to receive data:", err)
+				break
+			}
+			switch m := msg.(type) {
+			case *protocol.Data:
+				if m.Sender != "" {
+					cli.cursors.see(m.Sender, m.Seq)
+				}
+				if err := cli.openData(m); err != nil {
+					fmt.Println("Drop data:", err)
+					continue
+				}
+				if err := sink.write(m); err != nil {
+					fmt.Println("Failed to save data:", err)
+				}
+				if !m.More && m.Sender != "" {
+					// acks are cumulative, one per complete message is enough
+					if err := cli.conn.Send(&protocol.Ack{Sender: m.Sender, Seq: m.Seq}); err != nil {
+						fmt.Println("Failed to ack data:", err)
+					}
+				}
+				// the sender may go on once this frame is saved
+				if m.Sender != "" {
+					if seq, ok := cli.grants.next(m.Sender, m.Seq); ok {
+						if err := cli.conn.Send(&protocol.Credit{Sender: m.Sender, Seq: seq}); err != nil {
+							fmt.Println("Failed to grant credit:", err)
+						}
+					}
 				}
+			case *protocol.TransferEnd:
+				endCount++
+				fmt.Println("receive all data from:", m.ClientId)
+			case *protocol.Drain:
+				cli.moveAway()
+			}
+			if endCount >= len(cli.senderIds) {
+				fmt.Println("receiving data ends")
+				sink.close()
+				cli.sink = nil
+				break
 			}
 		}
 	} else {
@@ -502,36 +708,107 @@ func (cli *AgentClient) roleTask() {
 }
 
 func (cli *AgentClient) connectToIpPort(ip string, port int32) {
-	fmt.Printf("connect to %s:%d\n", ip, port)
+	addr := net.JoinHostPort(ip, strconv.Itoa(int(port)))
+	if cli.agentAddr != "" {
+		addr = cli.agentAddr
+	}
+	fmt.Println("connect to", addr)
 
-	sockfile, conn := util.CreateMptcpConnection(ip, port)
-	if conn == nil {
+	ctx, cancel := context.WithTimeout(context.Background(), protocol.HandshakeTimeout)
+	conn, err := cli.transport.Dial(ctx, addr)
+	cancel()
+	if err != nil {
+		fmt.Println("Failed to connect to agent:", err)
 		os.Exit(1)
 	}
-	// TODO: handle conn == nil
-	defer sockfile.Close()
 
-	if cli.conn != nil {
-		util.SendNetMessage(cli.conn, config.ClientExit, "")
-		cli.conn.Close()
+	if cli.tlsConfig != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), protocol.HandshakeTimeout)
+		tlsConn, err := util.TLSHandshake(ctx, tls.Client(conn, cli.tlsConfig))
+		cancel()
+		if err != nil {
+			fmt.Println("Failed to handshake with agent:", err)
+			os.Exit(1)
+		}
+		conn = tlsConn
 	}
-	util.SendNetMessage(conn, config.ClientId, cli.clientId)
-	util.SendNetMessage(conn, config.ClientType, cli.role)
-	util.SendNetMessage(conn, config.ClientPriority, strconv.Itoa(cli.priority))
-	util.SendNetMessage(conn, config.ClusterIp, cli.currClusterIp)
-	util.SendNetMessage(conn, config.ClusterIp, cli.prevClusterIp)
-	finished, _ := util.RecvNetMessage(conn)
-	if finished != config.TransferFinished {
-		fmt.Println("Fail to receive TransferFinished after sending ClientId")
+	pconn, err := protocol.Client(conn)
+	if err != nil {
+		fmt.Println("Failed to handshake with agent:", err)
+		os.Exit(1)
+	}
+	cli.leave(true)
+	err = pconn.Send(&protocol.Register{
+		ClientId:      cli.clientId,
+		Role:          cli.role,
+		Priority:      int32(cli.priority),
+		ClusterIp:     cli.currClusterIp,
+		PrevClusterIp: cli.prevClusterIp,
+		Receiver:      cli.receiverId,
+		Senders:       cli.senderIds,
+		Token:         cli.token,
+		Acked:         cli.delivery.ackedSeq(),
+		Cursors:       cli.cursors.list(),
+		Credential:    cli.credential,
+		Profile:       cli.profile,
+		Weight:        uint32(cli.weight),
+	})
+	if err != nil {
+		fmt.Println("Fail to register to agent:", err)
 		os.Exit(1)
 	}
+	msg, err := pconn.Expect(protocol.TypeRegistered)
+	if err != nil {
+		fmt.Println("Fail to register to agent:", err)
+		os.Exit(1)
+	}
+	registered := msg.(*protocol.Registered)
+	if registered.Resumed {
+		fmt.Println("session resumed")
+	}
+	cli.token = registered.Token
+	cli.activeProfile = registered.Profile
+	if cli.profile != "" && registered.Profile != cli.profile {
+		fmt.Printf("agent could not apply transport profile %s, using %s\n", cli.profile, registered.Profile)
+	}
 	fmt.Println("server has fetched old data")
-	cli.conn = conn
+	cli.conn = pconn
+	cli.showPath()
+	if cli.role == config.RoleSender {
+		// the credits of the last agent do not hold here
+		cli.credits.reset()
+		cli.replies = make(chan protocol.Message, 64)
+		go cli.readLoop(pconn, cli.replies)
+		if err := cli.delivery.resume(pconn, registered.Resumed, registered.Seq); err != nil {
+			fmt.Println("Failed to send pending messages again:", err)
+		}
+	} else {
+		// the senders may send a window ahead of what this receiver has got
+		cli.grants.reset()
+		for _, sender := range cli.senderIds {
+			seq, _ := cli.grants.next(sender, cli.cursors.get(sender))
+			if err := pconn.Send(&protocol.Credit{Sender: sender, Seq: seq}); err != nil {
+				fmt.Println("Failed to grant credit:", err)
+			}
+		}
+	}
 }
 
 func (cli *AgentClient) disconnect() {
+	cli.leave(false)
+}
+
+// leave closes the connection to the current agent. A moving client keeps
+// its session for the next agent, which the current one pushes its state to.
+func (cli *AgentClient) leave(moving bool) {
 	if cli.conn != nil {
-		util.SendNetMessage(cli.conn, config.ClientExit, "")
+		exit := &protocol.Exit{Moving: moving}
+		if moving {
+			exit.To = cli.currClusterIp
+		}
+		if err := cli.conn.Send(exit); err != nil {
+			fmt.Println("Failed to send exit:", err)
+		}
 		cli.conn.Close()
 	}
 }
@@ -548,14 +825,28 @@ func (cli *AgentClient) sendFile(filePath string) {
 	}
 	defer file.Close()
 
-	// Create a scanner to read the file line by line
-	scanner := bufio.NewScanner(file)
-
-	// Read the file line by line
-	for scanner.Scan() {
-		line := scanner.Text()
-		util.SendNetMessage(cli.conn, config.ClientData, line)
+	if err := cli.ensureSeal(); err != nil {
+		fmt.Println("Failed to send file:", err)
+		return
 	}
+	// Stream the whole file as one message, binary content is kept as is
+	first := cli.delivery.stream.Seq + 1
+	n, err := cli.delivery.stream.SendFrom(cli.conn, file)
+	// the file is read again if it has to be sent again
+	seq := cli.delivery.sent(first, filePath, func(s *protocol.Stream, c *protocol.Conn) error {
+		f, err := os.Open(filePath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = s.SendFrom(c, f)
+		return err
+	})
+	if err != nil {
+		fmt.Println("Failed to send file, it is sent again on the next .connect:", err)
+		return
+	}
+	fmt.Printf("message %d sent, %d bytes\n", seq, n)
 }
 
 func (cli *AgentClient) sendFileToNode(filePath string) {
@@ -574,37 +865,71 @@ func (cli *AgentClient) sendFileToNode(filePath string) {
 	scanner := bufio.NewScanner(file)
 
 	// Create a conn Between server and Node
-	util.SendNetMessage(cli.conn, config.CreateConnBetweenServerAndNode, "")
+	if err := cli.conn.Send(&protocol.NodeOpen{}); err != nil {
+		fmt.Println("Failed to send file to node:", err)
+		return
+	}
 
 	// Read the file line by line
 	for scanner.Scan() {
 		line := scanner.Text()
-		util.SendNetMessage(cli.conn, config.ClientDataToLocal, line)
-		util.SendNetMessage(cli.conn, config.ClientId, cli.clientId)
+		if err := cli.conn.Send(&protocol.NodeData{ClientId: cli.clientId, Payload: []byte(line)}); err != nil {
+			fmt.Println("Failed to send file to node:", err)
+			return
+		}
 	}
 	// disconn Between server and Node
-	util.SendNetMessage(cli.conn, config.DisconnBetweenServerAndNode, "")
+	if err := cli.conn.Send(&protocol.NodeClose{}); err != nil {
+		fmt.Println("Failed to send file to node:", err)
+	}
 }
 
-func (cli *AgentClient) fetchClientData(clientId string) {
+// fetchClientData prints the data stored for clientId after offset, after
+// where the last fetch of clientId ended when offset is empty; "0" fetches
+// everything.
+func (cli *AgentClient) fetchClientData(clientId, offset string) {
+	if cli.replies == nil {
+		fmt.Println("Fetch is only available to connected senders")
+		return
+	}
 	clusterIp, err := cli.k8sCli.EtcdGet(clientId)
 	if err != nil {
 		fmt.Printf("Failed to fetch %s's clusterIp: %v\n", clientId, err)
 		return
 	}
-	util.SendNetMessage(cli.conn, config.FetchClientData, clientId)
-	util.SendNetMessage(cli.conn, config.ClusterIp, clusterIp)
-	dataset := []string{}
-	for {
-		cmd, data := util.RecvNetMessage(cli.conn)
-		if cmd == config.TransferData {
-			dataset = append(dataset, data)
-		} else if cmd == config.TransferEnd {
-			break
-		}
+	if cli.fetched == nil {
+		cli.fetched = make(map[string]fetchOffset)
+	}
+	if offset == "0" {
+		offset = ""
+	} else if last, ok := cli.fetched[clientId]; ok && offset == "" && last.clusterIp == clusterIp {
+		offset = last.offset
+	}
+	if err := cli.conn.Send(&protocol.Fetch{ClientId: clientId, ClusterIp: clusterIp, After: offset}); err != nil {
+		fmt.Printf("Failed to fetch %s's data: %v\n", clientId, err)
+		return
 	}
 	fmt.Printf("%s data:\n", clientId)
-	for _, data := range dataset {
-		fmt.Println(data)
+	sink := newDataSink(cli.outDir)
+	defer sink.close()
+	for {
+		msg, ok := <-cli.replies
+		if !ok {
+			fmt.Printf("Failed to fetch %s's data: connection closed\n", clientId)
+			return
+		}
+		if m, ok := msg.(*protocol.Data); ok {
+			// only the receiver can read encrypted data, it is saved as is
+			if err := sink.write(m); err != nil {
+				fmt.Println("Failed to save data:", err)
+			}
+		} else if m, ok := msg.(*protocol.Error); ok {
+			fmt.Printf("Failed to fetch %s's data: %v\n", clientId, m)
+			return
+		} else if m, ok := msg.(*protocol.TransferEnd); ok {
+			cli.fetched[clientId] = fetchOffset{clusterIp: clusterIp, offset: m.Offset}
+			fmt.Printf("%s data up to offset %s\n", clientId, m.Offset)
+			return
+		}
 	}
 }
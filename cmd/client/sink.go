@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"smart-agent/protocol"
+)
+
+// dataSink writes received messages to stdout or, when outDir is set, to one
+// file per message. Chunks are written as they arrive, so a message never
+// has to fit in memory. Chunks of different senders may interleave.
+type dataSink struct {
+	outDir  string
+	writers map[string]io.WriteCloser
+	paths   map[string]string
+	sizes   map[string]int64
+	counts  map[string]int
+}
+
+func newDataSink(outDir string) *dataSink {
+	return &dataSink{
+		outDir:  outDir,
+		writers: make(map[string]io.WriteCloser),
+		paths:   make(map[string]string),
+		sizes:   make(map[string]int64),
+		counts:  make(map[string]int),
+	}
+}
+
+func (s *dataSink) write(m *protocol.Data) error {
+	w, ok := s.writers[m.Sender]
+	if !ok {
+		var err error
+		w, err = s.begin(m.Sender)
+		if err != nil {
+			return err
+		}
+	}
+	if _, err := w.Write(m.Payload); err != nil {
+		return err
+	}
+	s.sizes[m.Sender] += int64(len(m.Payload))
+	if m.More {
+		return nil
+	}
+	return s.end(m.Sender)
+}
+
+func (s *dataSink) begin(sender string) (io.WriteCloser, error) {
+	var w io.WriteCloser
+	if s.outDir == "" {
+		fmt.Print("data: ")
+		w = nopCloser{os.Stdout}
+	} else {
+		name := sender
+		if name == "" {
+			name = "node"
+		}
+		s.counts[sender]++
+		path := filepath.Join(s.outDir, fmt.Sprintf("%s-%d", name, s.counts[sender]))
+		f, err := os.Create(path)
+		if err != nil {
+			return nil, err
+		}
+		s.paths[sender] = path
+		w = f
+	}
+	s.writers[sender] = w
+	s.sizes[sender] = 0
+	return w, nil
+}
+
+func (s *dataSink) end(sender string) error {
+	err := s.writers[sender].Close()
+	if s.outDir == "" {
+		fmt.Println()
+	} else {
+		fmt.Printf("data: %d bytes from %s saved to %s\n", s.sizes[sender], sender, s.paths[sender])
+	}
+	delete(s.writers, sender)
+	delete(s.paths, sender)
+	return err
+}
+
+// close ends every message that is still in progress.
+func (s *dataSink) close() {
+	for sender := range s.writers {
+		s.end(sender)
+	}
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
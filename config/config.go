@@ -1,30 +1,13 @@
 package config
 
-const (
-	FetchClientData uint32 = iota
-	FetchOldData
-	SendFreshData
-	// client type
-	ClientType
-	ClientPriority
-	RecvfromNum
-	// client settings
-	ClientId
-	ClusterIp
-	TransferFinished
-	ClientData
-	ClientExit
-	// transfer settings
-	TransferData
-	TransferEnd
-	CreateConnBetweenServerAndNode
-	ClientDataToLocal
-	DisconnBetweenServerAndNode
+import "time"
 
+const (
 	ClientServePort  = 8081
 	DataTransferPort = 8082
 	PingPort         = 8083
 	ClientNode       = 40100
+	MetricsPort      = 9090
 
 	RoleSender   = "sender"
 	RoleReceiver = "receiver"
@@ -35,4 +18,43 @@ const (
 	ClusterServicePrefix = "cluster-service"
 
 	RedisPort = 7777
+	// where the log store keeps its segments, on the volume of the pod
+	StoreDir = "store"
+
+	// how long a terminating agent drains, below the
+	// terminationGracePeriodSeconds of the deployments
+	DrainTimeout = 25 * time.Second
+
+	// bytes of frames an agent holds in memory for a sender before it
+	// spills the next ones to its store
+	SessionBufferSize = 16 << 20
+	// frames a receiver grants each sender ahead of what it has got
+	CreditWindow = 64
+	// how often an agent evicts what its retention does not keep
+	RetentionInterval = time.Minute
+	// how long an agent that migrated a stream waits for the peer to
+	// commit it before it keeps the stream after all
+	MigrationTimeout = 10 * time.Second
+
+	// agents are dialed by ip, their certificates are issued for this name
+	AgentTLSName  = "smart-agent"
+	TLSSecretName = "smart-agent-tls"
+	TLSDir        = "tls"
 )
+
+// ValidClientId reports whether id may name a client. Client ids are keys of
+// the client map as they are, and the other keys of a client are the id after
+// a prefix ending in '.', so an id is made of letters, digits, '-' and '_'.
+func ValidClientId(id string) bool {
+	if id == "" {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
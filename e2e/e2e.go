@@ -0,0 +1,180 @@
+// Package e2e encrypts payloads end to end between a sender and a receiver
+// client, so agents only ever buffer, migrate and replay ciphertext.
+//
+// Every client has an X25519 key pair and publishes the public key in the
+// registry. Sender and receiver derive the same AES-256-GCM key from their
+// own private key and the peer's public key. Each Data frame is sealed on
+// its own with a random nonce, its sender, seq and More flag are
+// authenticated too, so an agent cannot reorder or cut frames unnoticed.
+package e2e
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"smart-agent/protocol"
+	"strings"
+)
+
+// Overhead is the number of bytes sealing adds to a payload.
+const Overhead = nonceSize + tagSize
+
+const (
+	nonceSize = 12
+	tagSize   = 16
+	kdfInfo   = "smart-agent e2e v1"
+)
+
+// ErrOpen is returned for a frame that was not sealed for this receiver or
+// has been tampered with.
+var ErrOpen = errors.New("e2e: message authentication failed")
+
+// PublicKeyName is the registry key a client publishes its public key under.
+func PublicKeyName(clientId string) string {
+	return "pubkey." + clientId
+}
+
+// KeyPair is the X25519 key of a client.
+type KeyPair struct {
+	priv *ecdh.PrivateKey
+}
+
+// GenerateKey creates a new key pair.
+func GenerateKey() (*KeyPair, error) {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyPair{priv: priv}, nil
+}
+
+// LoadOrCreateKey reads the private key stored at path, creating it when the
+// file does not exist yet. Keeping the key lets a client read messages sealed
+// for it before a restart.
+func LoadOrCreateKey(path string) (*KeyPair, error) {
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		k, err := GenerateKey()
+		if err != nil {
+			return nil, err
+		}
+		encoded := base64.StdEncoding.EncodeToString(k.priv.Bytes())
+		if err := os.WriteFile(path, []byte(encoded+"\n"), 0600); err != nil {
+			return nil, fmt.Errorf("e2e: store key: %w", err)
+		}
+		return k, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("e2e: read key: %w", err)
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil {
+		return nil, fmt.Errorf("e2e: decode key %s: %w", path, err)
+	}
+	priv, err := ecdh.X25519().NewPrivateKey(raw)
+	if err != nil {
+		return nil, fmt.Errorf("e2e: key %s: %w", path, err)
+	}
+	return &KeyPair{priv: priv}, nil
+}
+
+// PublicKey returns the public key in the form published in the registry.
+func (k *KeyPair) PublicKey() string {
+	return base64.StdEncoding.EncodeToString(k.priv.PublicKey().Bytes())
+}
+
+// ParsePublicKey parses a public key published in the registry.
+func ParsePublicKey(s string) (*ecdh.PublicKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("e2e: decode public key: %w", err)
+	}
+	pub, err := ecdh.X25519().NewPublicKey(raw)
+	if err != nil {
+		return nil, fmt.Errorf("e2e: public key: %w", err)
+	}
+	return pub, nil
+}
+
+// Channel seals the frames of one sender for one receiver. Both ends create
+// it with their own key and the peer's public key.
+type Channel struct {
+	sender string
+	aead   cipher.AEAD
+}
+
+// NewChannel returns the channel from sender to receiver, own is the key of
+// whichever of the two is calling.
+func NewChannel(own *KeyPair, peer *ecdh.PublicKey, sender, receiver string) (*Channel, error) {
+	shared, err := own.priv.ECDH(peer)
+	if err != nil {
+		return nil, fmt.Errorf("e2e: key agreement: %w", err)
+	}
+	// HKDF-SHA256 with the pair of ids as info, one block is a whole key
+	extract := hmac.New(sha256.New, []byte(kdfInfo))
+	extract.Write(shared)
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	fmt.Fprintf(expand, "%s\x00%s\x00%s", kdfInfo, sender, receiver)
+	expand.Write([]byte{1})
+	block, err := aes.NewCipher(expand.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Channel{sender: sender, aead: aead}, nil
+}
+
+// Seal encrypts the payload of m in place and marks it Encrypted. It suits
+// protocol.Stream.Seal.
+func (c *Channel) Seal(m *protocol.Data) error {
+	if m.Encrypted {
+		return errors.New("e2e: frame is sealed already")
+	}
+	out := make([]byte, nonceSize, nonceSize+len(m.Payload)+tagSize)
+	if _, err := rand.Read(out); err != nil {
+		return err
+	}
+	m.Payload = c.aead.Seal(out, out, m.Payload, c.additionalData(m))
+	m.Encrypted = true
+	return nil
+}
+
+// Open decrypts the payload of m in place.
+func (c *Channel) Open(m *protocol.Data) error {
+	if !m.Encrypted {
+		return errors.New("e2e: frame is not sealed")
+	}
+	if len(m.Payload) < Overhead || m.Sender != c.sender {
+		return ErrOpen
+	}
+	nonce, sealed := m.Payload[:nonceSize], m.Payload[nonceSize:]
+	plain, err := c.aead.Open(nil, nonce, sealed, c.additionalData(m))
+	if err != nil {
+		return ErrOpen
+	}
+	m.Payload = plain
+	m.Encrypted = false
+	return nil
+}
+
+func (c *Channel) additionalData(m *protocol.Data) []byte {
+	ad := make([]byte, 0, len(m.Sender)+10)
+	ad = append(ad, m.Sender...)
+	ad = append(ad, 0)
+	ad = binary.LittleEndian.AppendUint64(ad, m.Seq)
+	if m.More {
+		return append(ad, 1)
+	}
+	return append(ad, 0)
+}
@@ -0,0 +1,145 @@
+package e2e
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"smart-agent/protocol"
+	"testing"
+)
+
+func newPair(t *testing.T) (*Channel, *Channel) {
+	t.Helper()
+	sender, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// each side only knows the published public key of the other
+	receiverPub, err := ParsePublicKey(receiver.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	senderPub, err := ParsePublicKey(sender.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	seal, err := NewChannel(sender, receiverPub, "cli1", "cli2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	open, err := NewChannel(receiver, senderPub, "cli1", "cli2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return seal, open
+}
+
+func TestSealOpen(t *testing.T) {
+	seal, open := newPair(t)
+	plain := []byte("hello\x00world")
+	m := &protocol.Data{Sender: "cli1", Seq: 7, Payload: append([]byte(nil), plain...), More: true}
+	if err := seal.Seal(m); err != nil {
+		t.Fatal(err)
+	}
+	if !m.Encrypted || len(m.Payload) != len(plain)+Overhead || bytes.Contains(m.Payload, plain) {
+		t.Fatalf("payload not sealed: %x", m.Payload)
+	}
+	// agents store frames encoded, a sealed frame survives that as is
+	got, err := protocol.Unmarshal(protocol.TypeData, protocol.Marshal(m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := got.(*protocol.Data)
+	if err := open.Open(stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored.Encrypted || !bytes.Equal(stored.Payload, plain) {
+		t.Fatalf("opened %q", stored.Payload)
+	}
+}
+
+func TestOpenRejectsTampering(t *testing.T) {
+	seal, open := newPair(t)
+	for name, tamper := range map[string]func(*protocol.Data){
+		"seq":     func(m *protocol.Data) { m.Seq++ },
+		"more":    func(m *protocol.Data) { m.More = false },
+		"sender":  func(m *protocol.Data) { m.Sender = "cli3" },
+		"payload": func(m *protocol.Data) { m.Payload[len(m.Payload)-1] ^= 1 },
+		"cut":     func(m *protocol.Data) { m.Payload = m.Payload[:Overhead-1] },
+	} {
+		m := &protocol.Data{Sender: "cli1", Seq: 1, Payload: []byte("secret"), More: true}
+		if err := seal.Seal(m); err != nil {
+			t.Fatal(err)
+		}
+		tamper(m)
+		if err := open.Open(m); !errors.Is(err, ErrOpen) {
+			t.Errorf("%s: got %v", name, err)
+		}
+	}
+
+	// a channel of another receiver cannot open the frame either
+	_, other := newPair(t)
+	m := &protocol.Data{Sender: "cli1", Seq: 1, Payload: []byte("secret")}
+	if err := seal.Seal(m); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Open(m); !errors.Is(err, ErrOpen) {
+		t.Fatalf("other receiver: got %v", err)
+	}
+}
+
+func TestLoadOrCreateKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "key")
+	k1, err := LoadOrCreateKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k2, err := LoadOrCreateKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k1.PublicKey() != k2.PublicKey() {
+		t.Fatal("stored key not loaded again")
+	}
+}
+
+func TestPeerKeysPinned(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "peers")
+	first, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peers, err := LoadPeerKeys(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := peers.Check("cli1", first.PublicKey()); err != nil {
+		t.Fatalf("first use: %v", err)
+	}
+	if err := peers.Check("cli1", first.PublicKey()); err != nil {
+		t.Fatalf("same key: %v", err)
+	}
+	if err := peers.Check("cli1", second.PublicKey()); !errors.Is(err, ErrKeyChanged) {
+		t.Fatalf("changed key: got %v, want ErrKeyChanged", err)
+	}
+
+	// the pin outlives the run
+	peers, err = LoadPeerKeys(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := peers.Check("cli1", second.PublicKey()); !errors.Is(err, ErrKeyChanged) {
+		t.Fatalf("changed key after reload: got %v, want ErrKeyChanged", err)
+	}
+	if err := peers.Check("cli1", first.PublicKey()); err != nil {
+		t.Fatalf("pinned key after reload: %v", err)
+	}
+}
@@ -0,0 +1,101 @@
+package e2e
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// ErrKeyChanged is returned for a peer whose public key in the registry is
+// not the one pinned for it. Whoever can write the registry could have put
+// it there, so it is never taken on its own.
+var ErrKeyChanged = errors.New("e2e: public key changed")
+
+// PeerKeys pins the public key of every peer the first time it is used, a
+// key found in the registry later has to be the same. The pins are kept in a
+// file of "<client id> <public key>" lines, which can also be filled in
+// ahead with keys checked out of band.
+type PeerKeys struct {
+	// "" keeps the pins for the run only
+	path string
+
+	mu   sync.Mutex
+	keys map[string]string
+}
+
+// LoadPeerKeys reads the pins kept at path, none when it does not exist.
+// Without a path they are kept in memory.
+func LoadPeerKeys(path string) (*PeerKeys, error) {
+	p := &PeerKeys{path: path, keys: make(map[string]string)}
+	if path == "" {
+		return p, nil
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return p, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("e2e: read peer keys: %w", err)
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("e2e: %s:%d: want a client id and a public key", path, n)
+		}
+		if _, err := ParsePublicKey(fields[1]); err != nil {
+			return nil, fmt.Errorf("e2e: %s:%d: %w", path, n, err)
+		}
+		p.keys[fields[0]] = fields[1]
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("e2e: read peer keys: %w", err)
+	}
+	return p, nil
+}
+
+// Check pins pub for clientId if it has no key pinned yet, and fails with
+// ErrKeyChanged if it has another one.
+func (p *PeerKeys) Check(clientId, pub string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if pinned, ok := p.keys[clientId]; ok {
+		if pinned != pub {
+			return fmt.Errorf("%w: %s no longer has the key pinned in %s, remove its line if it was replaced", ErrKeyChanged, clientId, p.where())
+		}
+		return nil
+	}
+	if _, err := ParsePublicKey(pub); err != nil {
+		return err
+	}
+	if p.path != "" {
+		f, err := os.OpenFile(p.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return fmt.Errorf("e2e: pin key of %s: %w", clientId, err)
+		}
+		_, err = fmt.Fprintf(f, "%s %s\n", clientId, pub)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return fmt.Errorf("e2e: pin key of %s: %w", clientId, err)
+		}
+	}
+	p.keys[clientId] = pub
+	return nil
+}
+
+func (p *PeerKeys) where() string {
+	if p.path == "" {
+		return "this run"
+	}
+	return p.path
+}
@@ -0,0 +1,154 @@
+// Package mptcp controls the in-kernel MPTCP path manager through its
+// generic netlink family: the endpoints, addresses subflows are created
+// from, and the limits on subflows and announced addresses.
+package mptcp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// ErrUnsupported is returned where the kernel has no MPTCP path manager.
+var ErrUnsupported = errors.New("mptcp: path manager not supported")
+
+// Flags of an endpoint, from linux/mptcp.h.
+type Flags uint32
+
+const (
+	// FlagSignal announces the address to the peer.
+	FlagSignal Flags = 1 << iota
+	// FlagSubflow creates subflows from the address.
+	FlagSubflow
+	// FlagBackup marks subflows from the address as backup paths.
+	FlagBackup
+	// FlagFullmesh creates a subflow to every address of the peer.
+	FlagFullmesh
+	// FlagImplicit is set by the kernel on endpoints it created itself.
+	FlagImplicit
+)
+
+var flagNames = []struct {
+	flag Flags
+	name string
+}{
+	{FlagSignal, "signal"},
+	{FlagSubflow, "subflow"},
+	{FlagBackup, "backup"},
+	{FlagFullmesh, "fullmesh"},
+	{FlagImplicit, "implicit"},
+}
+
+func (f Flags) String() string {
+	var names []string
+	for _, fn := range flagNames {
+		if f&fn.flag != 0 {
+			names = append(names, fn.name)
+		}
+	}
+	if len(names) == 0 {
+		return "-"
+	}
+	return strings.Join(names, ",")
+}
+
+// MarshalText writes flags as String does, so they read well in JSON.
+func (f Flags) MarshalText() ([]byte, error) {
+	return []byte(f.String()), nil
+}
+
+// ParseFlags parses flags in the form String returns.
+func ParseFlags(s string) (Flags, error) {
+	var f Flags
+	if s == "" || s == "-" {
+		return 0, nil
+	}
+	for _, name := range strings.Split(s, ",") {
+		found := false
+		for _, fn := range flagNames {
+			if fn.name == name {
+				f |= fn.flag
+				found = true
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("mptcp: unknown endpoint flag %q", name)
+		}
+	}
+	return f, nil
+}
+
+// Endpoint is an address the path manager uses.
+type Endpoint struct {
+	// ID is picked by the kernel when 0 is added.
+	ID    uint8
+	Addr  net.IP
+	Port  uint16
+	Flags Flags
+	// Interface the subflows are bound to, empty for any.
+	Interface string
+}
+
+func (e Endpoint) String() string {
+	s := fmt.Sprintf("id %d %s", e.ID, e.Addr)
+	if e.Port != 0 {
+		s += fmt.Sprintf(" port %d", e.Port)
+	}
+	s += " " + e.Flags.String()
+	if e.Interface != "" {
+		s += " dev " + e.Interface
+	}
+	return s
+}
+
+// Limits bound what the path manager does per connection.
+type Limits struct {
+	// AddAddrAccepted is how many addresses announced by the peer are used.
+	AddAddrAccepted uint32
+	// Subflows is how many subflows beyond the first one are created.
+	Subflows uint32
+}
+
+// DefaultLimits are the limits of a freshly booted kernel.
+var DefaultLimits = Limits{AddAddrAccepted: 0, Subflows: 2}
+
+// MaxLimit is the highest value the kernel accepts for a limit.
+const MaxLimit = 8
+
+// State is the active configuration of the path manager.
+type State struct {
+	Limits    Limits
+	Endpoints []Endpoint
+}
+
+func (s State) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "limits: subflows %d, add_addr_accepted %d\n", s.Limits.Subflows, s.Limits.AddAddrAccepted)
+	if len(s.Endpoints) == 0 {
+		b.WriteString("no endpoints\n")
+	}
+	for _, e := range s.Endpoints {
+		b.WriteString(e.String() + "\n")
+	}
+	return b.String()
+}
+
+// Show reads the active configuration of the path manager.
+func Show() (State, error) {
+	pm, err := Open()
+	if err != nil {
+		return State{}, err
+	}
+	defer pm.Close()
+	var s State
+	if s.Limits, err = pm.Limits(); err != nil {
+		return State{}, err
+	}
+	if s.Endpoints, err = pm.Endpoints(); err != nil {
+		return State{}, err
+	}
+	sort.Slice(s.Endpoints, func(i, j int) bool { return s.Endpoints[i].ID < s.Endpoints[j].ID })
+	return s, nil
+}
@@ -0,0 +1,118 @@
+package mptcp
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+)
+
+func TestFlags(t *testing.T) {
+	for _, f := range []Flags{0, FlagSubflow, FlagSubflow | FlagFullmesh, FlagSignal | FlagBackup | FlagImplicit} {
+		got, err := ParseFlags(f.String())
+		if err != nil || got != f {
+			t.Fatalf("%v: got %v, %v", f, got, err)
+		}
+	}
+	if _, err := ParseFlags("subflow,teleport"); err == nil {
+		t.Fatal("unknown flag accepted")
+	}
+}
+
+func TestEndpointCodec(t *testing.T) {
+	for _, e := range []Endpoint{
+		{ID: 1, Addr: net.ParseIP("192.0.2.7").To4(), Flags: FlagSubflow | FlagBackup},
+		{ID: 200, Addr: net.ParseIP("2001:db8::7"), Port: 8081, Flags: FlagSignal},
+	} {
+		b, err := encodeEndpoint(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := decodeEndpoint(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.ID != e.ID || !got.Addr.Equal(e.Addr) || got.Port != e.Port || got.Flags != e.Flags {
+			t.Fatalf("got %v, want %v", got, e)
+		}
+	}
+	// truncated input is an error, not a panic
+	b, _ := encodeEndpoint(Endpoint{ID: 3, Addr: net.ParseIP("192.0.2.7")})
+	for n := 1; n < len(b); n++ {
+		decodeEndpoint(b[:n])
+	}
+}
+
+func TestLimitsCodec(t *testing.T) {
+	l := Limits{AddAddrAccepted: 3, Subflows: 8}
+	got, err := decodeLimits(encodeLimits(l))
+	if err != nil || got != l {
+		t.Fatalf("got %v, %v", got, err)
+	}
+}
+
+// TestPathManager changes the path manager of the test's network namespace
+// and puts it back. It needs CAP_NET_ADMIN and a kernel with MPTCP.
+func TestPathManager(t *testing.T) {
+	pm, err := Open()
+	if err != nil {
+		t.Skip("no path manager:", err)
+	}
+	defer pm.Close()
+	limits, err := pm.Limits()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pm.SetLimits(limits); errors.Is(err, os.ErrPermission) {
+		t.Skip("not allowed to change the path manager:", err)
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	defer pm.SetLimits(limits)
+
+	want := Limits{AddAddrAccepted: 1, Subflows: 3}
+	if err := pm.SetLimits(want); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := pm.Limits(); err != nil || got != want {
+		t.Fatalf("limits %v, %v", got, err)
+	}
+	if err := pm.SetLimits(Limits{Subflows: MaxLimit + 1}); err == nil {
+		t.Fatal("limit above the maximum accepted")
+	}
+
+	// an address of TEST-NET-1, not used by anything
+	addr := net.ParseIP("192.0.2.77")
+	if err := pm.AddEndpoint(Endpoint{ID: 77, Addr: addr, Flags: FlagSubflow}); err != nil {
+		t.Fatal(err)
+	}
+	defer pm.DeleteEndpoint(77)
+	if err := pm.SetFlags(77, FlagBackup); err != nil {
+		t.Fatal(err)
+	}
+	state, err := Show()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found *Endpoint
+	for i, e := range state.Endpoints {
+		if e.ID == 77 {
+			found = &state.Endpoints[i]
+		}
+	}
+	if found == nil || !found.Addr.Equal(addr) || found.Flags != FlagSubflow|FlagBackup {
+		t.Fatalf("endpoint not listed as added: %v", state)
+	}
+	if err := pm.DeleteEndpoint(77); err != nil {
+		t.Fatal(err)
+	}
+	endpoints, err := pm.Endpoints()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range endpoints {
+		if e.ID == 77 {
+			t.Fatal("endpoint still there after delete")
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package mptcp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"unsafe"
+)
+
+// generic netlink family of the path manager, from linux/mptcp.h
+const (
+	genlName    = "mptcp_pm"
+	genlVersion = 1
+
+	cmdAddAddr    = 1
+	cmdDelAddr    = 2
+	cmdGetAddr    = 3
+	cmdFlushAddrs = 4
+	cmdSetLimits  = 5
+	cmdGetLimits  = 6
+	cmdSetFlags   = 7
+
+	attrAddr        = 1
+	attrRcvAddAddrs = 2
+	attrSubflows    = 3
+
+	addrAttrFamily = 1
+	addrAttrID     = 2
+	addrAttrAddr4  = 3
+	addrAttrAddr6  = 4
+	addrAttrPort   = 5
+	addrAttrFlags  = 6
+	addrAttrIfIdx  = 7
+)
+
+// linux address families, netlink is only spoken there
+const (
+	afInet  = 2
+	afInet6 = 10
+)
+
+// netlink attribute header bits that are not part of the type
+const (
+	nlaFNested       = 1 << 15
+	nlaFNetByteorder = 1 << 14
+	nlaHdrLen        = 4
+)
+
+// netlink headers are in host byte order
+var nativeEndian binary.ByteOrder = func() binary.ByteOrder {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}()
+
+var errShortAttr = errors.New("mptcp: truncated netlink attribute")
+
+func nlaAlign(n int) int {
+	return (n + 3) &^ 3
+}
+
+// appendAttr appends attribute typ holding data to b.
+func appendAttr(b []byte, typ uint16, data []byte) []byte {
+	var hdr [nlaHdrLen]byte
+	nativeEndian.PutUint16(hdr[0:], uint16(nlaHdrLen+len(data)))
+	nativeEndian.PutUint16(hdr[2:], typ)
+	b = append(b, hdr[:]...)
+	b = append(b, data...)
+	for pad := nlaAlign(len(data)) - len(data); pad > 0; pad-- {
+		b = append(b, 0)
+	}
+	return b
+}
+
+func appendU8(b []byte, typ uint16, v uint8) []byte {
+	return appendAttr(b, typ, []byte{v})
+}
+
+func appendU16(b []byte, typ uint16, v uint16) []byte {
+	var d [2]byte
+	nativeEndian.PutUint16(d[:], v)
+	return appendAttr(b, typ, d[:])
+}
+
+func appendU32(b []byte, typ uint16, v uint32) []byte {
+	var d [4]byte
+	nativeEndian.PutUint32(d[:], v)
+	return appendAttr(b, typ, d[:])
+}
+
+// parseAttrs splits b into its attributes by type. The kernel never repeats
+// an attribute in the messages read here.
+func parseAttrs(b []byte) (map[uint16][]byte, error) {
+	attrs := make(map[uint16][]byte)
+	for len(b) >= nlaHdrLen {
+		l := int(nativeEndian.Uint16(b[0:]))
+		typ := nativeEndian.Uint16(b[2:]) &^ (nlaFNested | nlaFNetByteorder)
+		if l < nlaHdrLen || l > len(b) {
+			return nil, errShortAttr
+		}
+		attrs[typ] = b[nlaHdrLen:l]
+		if nlaAlign(l) >= len(b) {
+			break
+		}
+		b = b[nlaAlign(l):]
+	}
+	return attrs, nil
+}
+
+func attrU8(attrs map[uint16][]byte, typ uint16) (uint8, error) {
+	d, ok := attrs[typ]
+	if !ok {
+		return 0, nil
+	}
+	if len(d) < 1 {
+		return 0, errShortAttr
+	}
+	return d[0], nil
+}
+
+func attrU16(attrs map[uint16][]byte, typ uint16) (uint16, error) {
+	d, ok := attrs[typ]
+	if !ok {
+		return 0, nil
+	}
+	if len(d) < 2 {
+		return 0, errShortAttr
+	}
+	return nativeEndian.Uint16(d), nil
+}
+
+func attrU32(attrs map[uint16][]byte, typ uint16) (uint32, error) {
+	d, ok := attrs[typ]
+	if !ok {
+		return 0, nil
+	}
+	if len(d) < 4 {
+		return 0, errShortAttr
+	}
+	return nativeEndian.Uint32(d), nil
+}
+
+// encodeEndpoint encodes e as a nested MPTCP_PM_ATTR_ADDR. Only the ID is
+// written when e has no address, which is how endpoints are referred to.
+func encodeEndpoint(e Endpoint) ([]byte, error) {
+	var nested []byte
+	if e.Addr != nil {
+		if ip4 := e.Addr.To4(); ip4 != nil {
+			nested = appendU16(nested, addrAttrFamily, afInet)
+			// the address is in network byte order
+			nested = appendAttr(nested, addrAttrAddr4, ip4)
+		} else if ip6 := e.Addr.To16(); ip6 != nil {
+			nested = appendU16(nested, addrAttrFamily, afInet6)
+			nested = appendAttr(nested, addrAttrAddr6, ip6)
+		} else {
+			return nil, fmt.Errorf("mptcp: bad endpoint address %v", e.Addr)
+		}
+	}
+	if e.ID != 0 {
+		nested = appendU8(nested, addrAttrID, e.ID)
+	}
+	if e.Port != 0 {
+		nested = appendU16(nested, addrAttrPort, e.Port)
+	}
+	if e.Flags != 0 {
+		nested = appendU32(nested, addrAttrFlags, uint32(e.Flags))
+	}
+	if e.Interface != "" {
+		ifi, err := net.InterfaceByName(e.Interface)
+		if err != nil {
+			return nil, err
+		}
+		nested = appendU32(nested, addrAttrIfIdx, uint32(ifi.Index))
+	}
+	return appendAttr(nil, attrAddr|nlaFNested, nested), nil
+}
+
+// decodeEndpoint decodes the attributes of a MPTCP_PM_CMD_GET_ADDR reply.
+func decodeEndpoint(b []byte) (Endpoint, error) {
+	attrs, err := parseAttrs(b)
+	if err != nil {
+		return Endpoint{}, err
+	}
+	nested, ok := attrs[attrAddr]
+	if !ok {
+		return Endpoint{}, errors.New("mptcp: endpoint without address")
+	}
+	if attrs, err = parseAttrs(nested); err != nil {
+		return Endpoint{}, err
+	}
+	var e Endpoint
+	family, err := attrU16(attrs, addrAttrFamily)
+	if err != nil {
+		return Endpoint{}, err
+	}
+	switch family {
+	case afInet:
+		if d := attrs[addrAttrAddr4]; len(d) == net.IPv4len {
+			e.Addr = net.IPv4(d[0], d[1], d[2], d[3])
+		}
+	case afInet6:
+		if d := attrs[addrAttrAddr6]; len(d) == net.IPv6len {
+			e.Addr = append(net.IP(nil), d...)
+		}
+	}
+	if e.ID, err = attrU8(attrs, addrAttrID); err != nil {
+		return Endpoint{}, err
+	}
+	if e.Port, err = attrU16(attrs, addrAttrPort); err != nil {
+		return Endpoint{}, err
+	}
+	flags, err := attrU32(attrs, addrAttrFlags)
+	if err != nil {
+		return Endpoint{}, err
+	}
+	e.Flags = Flags(flags)
+	ifIdx, err := attrU32(attrs, addrAttrIfIdx)
+	if err != nil {
+		return Endpoint{}, err
+	}
+	if ifIdx != 0 {
+		if ifi, err := net.InterfaceByIndex(int(int32(ifIdx))); err == nil {
+			e.Interface = ifi.Name
+		} else {
+			e.Interface = fmt.Sprintf("if%d", ifIdx)
+		}
+	}
+	return e, nil
+}
+
+func encodeLimits(l Limits) []byte {
+	b := appendU32(nil, attrRcvAddAddrs, l.AddAddrAccepted)
+	return appendU32(b, attrSubflows, l.Subflows)
+}
+
+func decodeLimits(b []byte) (Limits, error) {
+	attrs, err := parseAttrs(b)
+	if err != nil {
+		return Limits{}, err
+	}
+	var l Limits
+	if l.AddAddrAccepted, err = attrU32(attrs, attrRcvAddAddrs); err != nil {
+		return Limits{}, err
+	}
+	if l.Subflows, err = attrU32(attrs, attrSubflows); err != nil {
+		return Limits{}, err
+	}
+	return l, nil
+}
@@ -0,0 +1,229 @@
+//go:build linux
+
+package mptcp
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// generic netlink controller, from linux/genetlink.h
+const (
+	genlIDCtrl          = 0x10
+	ctrlCmdGetFamily    = 3
+	ctrlAttrFamilyID    = 1
+	ctrlAttrFamilyName  = 2
+	ctrlVersion         = 2
+	genlHdrLen          = 4
+	netlinkRecvBufBytes = 1 << 16
+)
+
+// PathManager talks to the path manager of the kernel. Changing it needs
+// CAP_NET_ADMIN, reading it does not.
+type PathManager struct {
+	mu     sync.Mutex
+	fd     int
+	seq    uint32
+	family uint16
+}
+
+// Open connects to the path manager of the network namespace of the process.
+func Open() (*PathManager, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_GENERIC)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	pm := &PathManager{fd: fd}
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		pm.Close()
+		return nil, os.NewSyscallError("bind", err)
+	}
+	// a kernel that never answers does not hang the caller
+	tv := syscall.Timeval{Sec: 5}
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		pm.Close()
+		return nil, os.NewSyscallError("setsockopt", err)
+	}
+	if pm.family, err = pm.resolveFamily(); err != nil {
+		pm.Close()
+		return nil, err
+	}
+	return pm, nil
+}
+
+// Close closes the netlink socket.
+func (pm *PathManager) Close() error {
+	return syscall.Close(pm.fd)
+}
+
+func (pm *PathManager) resolveFamily() (uint16, error) {
+	name := append([]byte(genlName), 0)
+	replies, err := pm.execute(genlIDCtrl, ctrlCmdGetFamily, ctrlVersion, 0, appendAttr(nil, ctrlAttrFamilyName, name))
+	if err == syscall.ENOENT {
+		return 0, ErrUnsupported
+	}
+	if err != nil {
+		return 0, fmt.Errorf("mptcp: resolve netlink family: %w", err)
+	}
+	for _, r := range replies {
+		attrs, err := parseAttrs(r)
+		if err != nil {
+			return 0, err
+		}
+		if id, err := attrU16(attrs, ctrlAttrFamilyID); err == nil && id != 0 {
+			return id, nil
+		}
+	}
+	return 0, ErrUnsupported
+}
+
+// Endpoints lists the endpoints of the path manager.
+func (pm *PathManager) Endpoints() ([]Endpoint, error) {
+	replies, err := pm.do(cmdGetAddr, syscall.NLM_F_DUMP, nil)
+	if err != nil {
+		return nil, err
+	}
+	endpoints := make([]Endpoint, 0, len(replies))
+	for _, r := range replies {
+		e, err := decodeEndpoint(r)
+		if err != nil {
+			return nil, err
+		}
+		endpoints = append(endpoints, e)
+	}
+	return endpoints, nil
+}
+
+// AddEndpoint adds e, the kernel picks an ID when e.ID is 0.
+func (pm *PathManager) AddEndpoint(e Endpoint) error {
+	if e.Addr == nil {
+		return fmt.Errorf("mptcp: endpoint without address")
+	}
+	b, err := encodeEndpoint(e)
+	if err != nil {
+		return err
+	}
+	_, err = pm.do(cmdAddAddr, 0, b)
+	return err
+}
+
+// DeleteEndpoint removes the endpoint id.
+func (pm *PathManager) DeleteEndpoint(id uint8) error {
+	b, err := encodeEndpoint(Endpoint{ID: id})
+	if err != nil {
+		return err
+	}
+	_, err = pm.do(cmdDelAddr, 0, b)
+	return err
+}
+
+// FlushEndpoints removes every endpoint.
+func (pm *PathManager) FlushEndpoints() error {
+	_, err := pm.do(cmdFlushAddrs, 0, nil)
+	return err
+}
+
+// SetFlags changes the flags of endpoint id, the kernel only lets backup
+// and fullmesh change.
+func (pm *PathManager) SetFlags(id uint8, flags Flags) error {
+	b, err := encodeEndpoint(Endpoint{ID: id, Flags: flags})
+	if err != nil {
+		return err
+	}
+	_, err = pm.do(cmdSetFlags, 0, b)
+	return err
+}
+
+// Limits reads the limits of the path manager.
+func (pm *PathManager) Limits() (Limits, error) {
+	replies, err := pm.do(cmdGetLimits, 0, nil)
+	if err != nil {
+		return Limits{}, err
+	}
+	if len(replies) == 0 {
+		return Limits{}, fmt.Errorf("mptcp: no limits in reply")
+	}
+	return decodeLimits(replies[0])
+}
+
+// SetLimits sets the limits of the path manager.
+func (pm *PathManager) SetLimits(l Limits) error {
+	if l.AddAddrAccepted > MaxLimit || l.Subflows > MaxLimit {
+		return fmt.Errorf("mptcp: limits above %d", MaxLimit)
+	}
+	_, err := pm.do(cmdSetLimits, 0, encodeLimits(l))
+	return err
+}
+
+func (pm *PathManager) do(cmd uint8, flags uint16, attrs []byte) ([][]byte, error) {
+	replies, err := pm.execute(pm.family, cmd, genlVersion, flags, attrs)
+	if err != nil {
+		if errno, ok := err.(syscall.Errno); ok {
+			return nil, os.NewSyscallError(genlName, errno)
+		}
+		return nil, err
+	}
+	return replies, nil
+}
+
+// execute sends one generic netlink request and returns the attributes of
+// the replies, after the generic netlink header.
+func (pm *PathManager) execute(family uint16, cmd, version uint8, flags uint16, attrs []byte) ([][]byte, error) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	pm.seq++
+	seq := pm.seq
+
+	msg := make([]byte, syscall.NLMSG_HDRLEN+genlHdrLen, syscall.NLMSG_HDRLEN+genlHdrLen+len(attrs))
+	msg = append(msg, attrs...)
+	nativeEndian.PutUint32(msg[0:], uint32(len(msg)))
+	nativeEndian.PutUint16(msg[4:], family)
+	nativeEndian.PutUint16(msg[6:], syscall.NLM_F_REQUEST|syscall.NLM_F_ACK|flags)
+	nativeEndian.PutUint32(msg[8:], seq)
+	// pid 0, the kernel fills in the port of the socket
+	msg[syscall.NLMSG_HDRLEN] = cmd
+	msg[syscall.NLMSG_HDRLEN+1] = version
+	if err := syscall.Sendto(pm.fd, msg, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return nil, os.NewSyscallError("sendto", err)
+	}
+
+	var replies [][]byte
+	buf := make([]byte, netlinkRecvBufBytes)
+	for {
+		n, _, err := syscall.Recvfrom(pm.fd, buf, 0)
+		if err != nil {
+			return nil, os.NewSyscallError("recvfrom", err)
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range msgs {
+			if m.Header.Seq != seq {
+				// left over from an earlier request
+				continue
+			}
+			switch m.Header.Type {
+			case syscall.NLMSG_DONE:
+				return replies, nil
+			case syscall.NLMSG_ERROR:
+				if len(m.Data) < 4 {
+					return nil, errShortAttr
+				}
+				if errno := int32(nativeEndian.Uint32(m.Data)); errno != 0 {
+					return nil, syscall.Errno(-errno)
+				}
+				// the ack closing a request that is not a dump
+				return replies, nil
+			default:
+				if len(m.Data) < genlHdrLen {
+					return nil, errShortAttr
+				}
+				// buf is read into again, the reply has to outlive that
+				replies = append(replies, append([]byte(nil), m.Data[genlHdrLen:]...))
+			}
+		}
+	}
+}
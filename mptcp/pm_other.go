@@ -0,0 +1,27 @@
+//go:build !linux
+
+package mptcp
+
+// PathManager talks to the path manager of the kernel, only Linux has one.
+type PathManager struct{}
+
+// Open returns ErrUnsupported.
+func Open() (*PathManager, error) {
+	return nil, ErrUnsupported
+}
+
+func (pm *PathManager) Close() error { return nil }
+
+func (pm *PathManager) Endpoints() ([]Endpoint, error) { return nil, ErrUnsupported }
+
+func (pm *PathManager) AddEndpoint(e Endpoint) error { return ErrUnsupported }
+
+func (pm *PathManager) DeleteEndpoint(id uint8) error { return ErrUnsupported }
+
+func (pm *PathManager) FlushEndpoints() error { return ErrUnsupported }
+
+func (pm *PathManager) SetFlags(id uint8, flags Flags) error { return ErrUnsupported }
+
+func (pm *PathManager) Limits() (Limits, error) { return Limits{}, ErrUnsupported }
+
+func (pm *PathManager) SetLimits(l Limits) error { return ErrUnsupported }
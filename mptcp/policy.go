@@ -0,0 +1,135 @@
+package mptcp
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Transport policies, the ones of the client .trans command.
+const (
+	// PolicyDefault drops every endpoint and restores the default limits.
+	PolicyDefault = "default"
+	// PolicyFullmesh creates a subflow from every address of the interfaces
+	// to every address of the peer.
+	PolicyFullmesh = "fullmesh"
+	// PolicyBackup uses the addresses of the interfaces as backup paths only.
+	PolicyBackup = "backup"
+	// PolicyRedundant sends every packet on all subflows, it needs a kernel
+	// with the redundant scheduler.
+	PolicyRedundant = "redundant"
+)
+
+// sysctl of the packet scheduler of MPTCP connections
+const schedulerSysctl = "net/mptcp/scheduler"
+
+// Apply configures the path manager for policy. iface names the interface
+// whose addresses become endpoints, all interfaces are used when it is
+// empty, except for backup which needs one.
+func Apply(policy, iface string) error {
+	switch policy {
+	case PolicyDefault, PolicyFullmesh, PolicyBackup:
+	case PolicyRedundant:
+		return setSysctl(schedulerSysctl, "redundant")
+	default:
+		return fmt.Errorf("mptcp: unknown transport policy %q", policy)
+	}
+	pm, err := Open()
+	if err != nil {
+		return err
+	}
+	defer pm.Close()
+
+	switch policy {
+	case PolicyDefault:
+		if err := pm.FlushEndpoints(); err != nil {
+			return err
+		}
+		if err := pm.SetLimits(DefaultLimits); err != nil {
+			return err
+		}
+		if err := setSysctl(schedulerSysctl, "default"); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	case PolicyFullmesh:
+		if err := pm.SetLimits(Limits{AddAddrAccepted: MaxLimit, Subflows: MaxLimit}); err != nil {
+			return err
+		}
+		return addEndpoints(pm, iface, FlagSubflow|FlagFullmesh)
+	default:
+		if iface == "" {
+			return fmt.Errorf("mptcp: %s needs an interface", policy)
+		}
+		return addEndpoints(pm, iface, FlagSubflow|FlagBackup)
+	}
+}
+
+// addEndpoints makes an endpoint with flags of every address of iface, or
+// of every interface. Endpoints already there for an address are replaced.
+func addEndpoints(pm *PathManager, iface string, flags Flags) error {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return err
+	}
+	existing, err := pm.Endpoints()
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, ifi := range ifaces {
+		if iface != "" && ifi.Name != iface {
+			continue
+		}
+		if iface == "" && (ifi.Flags&net.FlagLoopback != 0 || ifi.Flags&net.FlagUp == 0) {
+			continue
+		}
+		found = true
+		addrs, err := ifi.Addrs()
+		if err != nil {
+			return err
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || ipNet.IP.IsLinkLocalUnicast() || ipNet.IP.IsLoopback() {
+				continue
+			}
+			for _, e := range existing {
+				if e.Addr.Equal(ipNet.IP) {
+					if err := pm.DeleteEndpoint(e.ID); err != nil {
+						return err
+					}
+				}
+			}
+			err := pm.AddEndpoint(Endpoint{Addr: ipNet.IP, Flags: flags, Interface: ifi.Name})
+			if err != nil {
+				return fmt.Errorf("mptcp: add endpoint %s dev %s: %w", ipNet.IP, ifi.Name, err)
+			}
+		}
+	}
+	if iface != "" && !found {
+		return fmt.Errorf("mptcp: no interface %s", iface)
+	}
+	return nil
+}
+
+// Scheduler returns the packet scheduler new MPTCP connections get.
+func Scheduler() (string, error) {
+	b, err := os.ReadFile(filepath.Join("/proc/sys", schedulerSysctl))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// SetScheduler sets the packet scheduler of new MPTCP connections, as
+// Scheduler returned it.
+func SetScheduler(name string) error {
+	return setSysctl(schedulerSysctl, name)
+}
+
+func setSysctl(name, value string) error {
+	return os.WriteFile(filepath.Join("/proc/sys", name), []byte(value), 0644)
+}
@@ -0,0 +1,152 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var errShortPayload = errors.New("protocol: payload too short")
+
+// writer appends little-endian fields to a message payload. Strings and byte
+// slices are prefixed with their uint32 length.
+type writer struct {
+	buf []byte
+}
+
+func (w *writer) putUint8(v uint8) {
+	w.buf = append(w.buf, v)
+}
+
+func (w *writer) putBool(v bool) {
+	if v {
+		w.putUint8(1)
+	} else {
+		w.putUint8(0)
+	}
+}
+
+func (w *writer) putUint16(v uint16) {
+	w.buf = binary.LittleEndian.AppendUint16(w.buf, v)
+}
+
+func (w *writer) putUint32(v uint32) {
+	w.buf = binary.LittleEndian.AppendUint32(w.buf, v)
+}
+
+func (w *writer) putUint64(v uint64) {
+	w.buf = binary.LittleEndian.AppendUint64(w.buf, v)
+}
+
+func (w *writer) putBytes(v []byte) {
+	w.putUint32(uint32(len(v)))
+	w.buf = append(w.buf, v...)
+}
+
+func (w *writer) putString(v string) {
+	w.putUint32(uint32(len(v)))
+	w.buf = append(w.buf, v...)
+}
+
+func (w *writer) putStrings(v []string) {
+	w.putUint32(uint32(len(v)))
+	for _, s := range v {
+		w.putString(s)
+	}
+}
+
+// reader consumes fields written by writer. The first failure is sticky so
+// decoders can read every field and check err once at the end. Trailing bytes
+// are ignored, which lets newer peers append fields to existing messages.
+type reader struct {
+	buf []byte
+	err error
+}
+
+func (r *reader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || len(r.buf) < n {
+		r.err = errShortPayload
+		return nil
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+// done reports whether the payload ends here. Fields are only ever appended
+// to a message, the ones a peer of an older build or a frame stored by one
+// leaves out are read as zero values.
+func (r *reader) done() bool {
+	return r.err == nil && len(r.buf) == 0
+}
+
+func (r *reader) uint8() uint8 {
+	b := r.next(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (r *reader) bool() bool {
+	return r.uint8() != 0
+}
+
+func (r *reader) uint16() uint16 {
+	b := r.next(2)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint16(b)
+}
+
+func (r *reader) uint32() uint32 {
+	b := r.next(4)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(b)
+}
+
+func (r *reader) uint64() uint64 {
+	b := r.next(8)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint64(b)
+}
+
+func (r *reader) bytes() []byte {
+	n := r.uint32()
+	b := r.next(int(n))
+	if b == nil {
+		return nil
+	}
+	out := make([]byte, len(b))
+	copy(out, b)
+	return out
+}
+
+func (r *reader) string() string {
+	n := r.uint32()
+	return string(r.next(int(n)))
+}
+
+func (r *reader) strings() []string {
+	n := r.uint32()
+	if r.err != nil {
+		return nil
+	}
+	// every string costs at least its length prefix
+	if int(n) > len(r.buf)/4 {
+		r.err = errShortPayload
+		return nil
+	}
+	out := make([]string, 0, n)
+	for i := uint32(0); i < n; i++ {
+		out = append(out, r.string())
+	}
+	return out
+}
@@ -0,0 +1,592 @@
+package protocol
+
+import "fmt"
+
+// Message types carried in the cmd field of every frame.
+const (
+	TypeRegister uint32 = iota + 1
+	TypeRegistered
+	TypeData
+	TypeExit
+	TypeFetch
+	TypeTransferEnd
+	TypeNodeOpen
+	TypeNodeData
+	TypeNodeClose
+	TypeMigrate
+	TypeRelay
+	TypeError
+	TypeAck
+	TypeDrain
+	TypeCredit
+	TypeBusy
+	TypeCommit
+	TypeHandover
+)
+
+// Message is a typed protocol message. Every message knows its frame type and
+// how to encode itself into a frame payload.
+type Message interface {
+	Type() uint32
+	encode(w *writer)
+	decode(r *reader)
+}
+
+// Register is the first message a client sends after the handshake.
+type Register struct {
+	ClientId      string
+	Role          string
+	Priority      int32
+	ClusterIp     string
+	PrevClusterIp string
+	// Receiver is set for senders, Senders for receivers.
+	Receiver string
+	Senders  []string
+	// Token resumes the session issued by an earlier Registered, an empty
+	// or unknown token starts a new session.
+	Token string
+	// Acked is the last seq a sender has seen acked.
+	Acked uint64
+	// Cursors hold the last seq a receiver has seen from each sender.
+	Cursors []Cursor
+	// Credential proves the client owns ClientId, see package auth.
+	Credential string
+	// Profile is the transport profile the client asks the agent to use
+	// for its session: default, backup, fullmesh or redundant. Empty leaves
+	// the agent as it is.
+	Profile string
+	// Weight is the share of the receiver a sender asks for against the
+	// other senders to it, 0 weighs its priority.
+	Weight uint32
+}
+
+// Cursor is the position of a receiver in the stream of one sender.
+type Cursor struct {
+	Sender string
+	Seq    uint64
+}
+
+// Registered acknowledges Register once the agent has fetched old data.
+type Registered struct {
+	// Token identifies the session, the client presents it when it moves.
+	Token string
+	// Resumed reports whether Register resumed an existing session.
+	Resumed bool
+	// Seq is the last frame of a sender the agents hold, the sender sends
+	// again whatever it sent after Seq.
+	Seq uint64
+	// Profile is the transport profile in effect for the session, which is
+	// not the one asked for when the agent could not apply it, or none when
+	// the connection is not MPTCP.
+	Profile string
+}
+
+// Data carries one client payload between clients and agents. Messages
+// longer than MaxChunkSize are sent as several Data chunks: every chunk but
+// the last has More set, and the last one ends the message.
+//
+// Seq numbers the frames of one sender→receiver stream, starting at 1.
+type Data struct {
+	Sender  string
+	Seq     uint64
+	Payload []byte
+	More    bool
+	// Encrypted is set when Payload is sealed for the receiver, see package
+	// e2e. Agents handle such payloads as opaque bytes.
+	Encrypted bool
+	// Expires is when the message stops being worth delivering, in unix
+	// milliseconds, 0 for never. Agents do not migrate or replay it after.
+	Expires int64
+}
+
+// Exit tells the agent that a client is leaving. A client that is moving to
+// another agent sets Moving, its session is then kept for the new agent, and
+// To to the cluster ip of that agent, which the agent pushes the state of the
+// client to.
+type Exit struct {
+	Moving bool
+	To     string
+}
+
+// Fetch asks the agent for the data stored for ClientId on ClusterIp. The
+// agent answers with the frames stored after offset After, all of them when
+// it is empty, and a TransferEnd holding the offset to fetch after next.
+type Fetch struct {
+	ClientId  string
+	ClusterIp string
+	After     string
+}
+
+// TransferEnd closes a stream of Data messages. Moving is set when the
+// stream only stops because the agent sending it shuts down, the sender is
+// not done and its stream goes on from another agent.
+type TransferEnd struct {
+	ClientId string
+	Moving   bool
+	// Offset is where the frames sent end in the storage of the agent, the
+	// After of the next Fetch
+	Offset string
+}
+
+// NodeOpen asks the agent to connect to the node bridge.
+type NodeOpen struct{}
+
+// NodeData is forwarded by the agent to the node bridge.
+type NodeData struct {
+	ClientId string
+	Payload  []byte
+}
+
+// NodeClose closes the node bridge connection.
+type NodeClose struct{}
+
+// Migrate asks a peer agent for the data it stores for ClientId, or for the
+// frames of sender ClientId not acked yet when Pending is set. The peer
+// skips the frames up to offset After, and unless Keep is set drops what it
+// sent once the asking agent answers its TransferEnd with a Commit.
+type Migrate struct {
+	ClientId string
+	Pending  bool
+	Keep     bool
+	After    string
+}
+
+// Commit tells the agent that answered a Migrate that the frames it sent,
+// up to and including the one at Offset, are stored by the peer. Only then
+// does it drop them, a Migrate that is never committed leaves them where
+// they were.
+type Commit struct {
+	ClientId string
+	Offset   string
+}
+
+// Handover pushes the state of client ClientId to the agent it moves to,
+// ahead of the client: its session, and the stored stream of Sender, or the
+// pending frames of sender Sender when Pending is set. The frames follow as
+// Data messages and a TransferEnd, the peer answers with a Commit like the
+// agent asking with a Migrate.
+type Handover struct {
+	ClientId string
+	Role     string
+	Priority int32
+	Weight   uint32
+	Receiver string
+	Senders  []string
+	Sender   string
+	Pending  bool
+}
+
+// Relay opens a stream of fresh Data from sender ClientId to a peer agent.
+// The peer answers with an Ack holding the last seq the receiver has, so
+// only frames after it need to be sent.
+type Relay struct {
+	ClientId string
+	// Token is the session of the sender, a new session restarts its seqs.
+	Token string
+}
+
+// Ack acknowledges every Data frame of Sender up to and including Seq. It
+// travels from the receiving client back through both agents to the sender.
+type Ack struct {
+	Sender string
+	Seq    uint64
+}
+
+// Credit lets Sender send every Data frame up to and including Seq. The
+// receiving client grants it ahead of what it has got, and it travels like
+// Ack back through both agents to the sender, which sends no frame past it.
+// A sender that never got a Credit is not held back.
+type Credit struct {
+	Sender string
+	Seq    uint64
+}
+
+// Busy tells a sender its agent holds more of its frames than the receiver
+// has taken and keeps the ones from Seq on in storage only. The sender
+// should wait for the next Credit before it sends more.
+type Busy struct {
+	Seq uint64
+}
+
+// Drain tells a client its agent is shutting down. The client moves to
+// another agent, keeping its session, before the agent's grace period ends.
+type Drain struct{}
+
+// Error reports a protocol failure to the peer.
+type Error struct {
+	Code    uint16
+	Message string
+}
+
+// Codes of Error.
+const (
+	// the credential of a client is missing or wrong
+	ErrCodeUnauthenticated uint16 = iota + 1
+	// the client may not send to, receive from or fetch a peer
+	ErrCodeForbidden
+	// another client with the same id is connected
+	ErrCodeDuplicateClient
+	// the request breaks the protocol, e.g. an unknown role or a message
+	// out of place
+	ErrCodeBadRequest
+	// something the agent depends on failed: the registry, the storage, the
+	// node or a peer agent
+	ErrCodeUnavailable
+	// the agent failed on its own, the conn was ended instead of the agent
+	ErrCodeInternal
+)
+
+func (*Register) Type() uint32    { return TypeRegister }
+func (*Registered) Type() uint32  { return TypeRegistered }
+func (*Data) Type() uint32        { return TypeData }
+func (*Exit) Type() uint32        { return TypeExit }
+func (*Fetch) Type() uint32       { return TypeFetch }
+func (*TransferEnd) Type() uint32 { return TypeTransferEnd }
+func (*NodeOpen) Type() uint32    { return TypeNodeOpen }
+func (*NodeData) Type() uint32    { return TypeNodeData }
+func (*NodeClose) Type() uint32   { return TypeNodeClose }
+func (*Migrate) Type() uint32     { return TypeMigrate }
+func (*Relay) Type() uint32       { return TypeRelay }
+func (*Error) Type() uint32       { return TypeError }
+func (*Ack) Type() uint32         { return TypeAck }
+func (*Drain) Type() uint32       { return TypeDrain }
+func (*Credit) Type() uint32      { return TypeCredit }
+func (*Busy) Type() uint32        { return TypeBusy }
+func (*Commit) Type() uint32      { return TypeCommit }
+func (*Handover) Type() uint32    { return TypeHandover }
+
+func (m *Register) encode(w *writer) {
+	w.putString(m.ClientId)
+	w.putString(m.Role)
+	w.putUint32(uint32(m.Priority))
+	w.putString(m.ClusterIp)
+	w.putString(m.PrevClusterIp)
+	w.putString(m.Receiver)
+	w.putStrings(m.Senders)
+	w.putString(m.Token)
+	w.putUint64(m.Acked)
+	w.putUint32(uint32(len(m.Cursors)))
+	for _, c := range m.Cursors {
+		w.putString(c.Sender)
+		w.putUint64(c.Seq)
+	}
+	w.putString(m.Credential)
+	w.putString(m.Profile)
+	w.putUint32(m.Weight)
+}
+
+func (m *Register) decode(r *reader) {
+	m.ClientId = r.string()
+	m.Role = r.string()
+	m.Priority = int32(r.uint32())
+	m.ClusterIp = r.string()
+	m.PrevClusterIp = r.string()
+	m.Receiver = r.string()
+	m.Senders = r.strings()
+	if r.done() {
+		return
+	}
+	m.Token = r.string()
+	m.Acked = r.uint64()
+	n := r.uint32()
+	// every cursor costs at least a length prefix and a seq
+	if r.err == nil && int(n) > len(r.buf)/12 {
+		r.err = errShortPayload
+	}
+	if r.err != nil {
+		return
+	}
+	m.Cursors = make([]Cursor, 0, n)
+	for i := uint32(0); i < n; i++ {
+		m.Cursors = append(m.Cursors, Cursor{Sender: r.string(), Seq: r.uint64()})
+	}
+	if r.done() {
+		return
+	}
+	m.Credential = r.string()
+	if r.done() {
+		return
+	}
+	m.Profile = r.string()
+	if r.done() {
+		return
+	}
+	m.Weight = r.uint32()
+}
+
+func (m *Registered) encode(w *writer) {
+	w.putString(m.Token)
+	w.putBool(m.Resumed)
+	w.putUint64(m.Seq)
+	w.putString(m.Profile)
+}
+
+func (m *Registered) decode(r *reader) {
+	if r.done() {
+		return
+	}
+	m.Token = r.string()
+	m.Resumed = r.bool()
+	m.Seq = r.uint64()
+	if r.done() {
+		return
+	}
+	m.Profile = r.string()
+}
+
+func (m *Data) encode(w *writer) {
+	w.putString(m.Sender)
+	w.putUint64(m.Seq)
+	w.putBytes(m.Payload)
+	w.putBool(m.More)
+	w.putBool(m.Encrypted)
+	w.putUint64(uint64(m.Expires))
+}
+
+func (m *Data) decode(r *reader) {
+	m.Sender = r.string()
+	m.Seq = r.uint64()
+	m.Payload = r.bytes()
+	m.More = r.bool()
+	if r.done() {
+		return
+	}
+	m.Encrypted = r.bool()
+	if r.done() {
+		return
+	}
+	m.Expires = int64(r.uint64())
+}
+
+func (m *Exit) encode(w *writer) {
+	w.putBool(m.Moving)
+	w.putString(m.To)
+}
+
+func (m *Exit) decode(r *reader) {
+	if r.done() {
+		return
+	}
+	m.Moving = r.bool()
+	if r.done() {
+		return
+	}
+	m.To = r.string()
+}
+
+func (m *Fetch) encode(w *writer) {
+	w.putString(m.ClientId)
+	w.putString(m.ClusterIp)
+	w.putString(m.After)
+}
+
+func (m *Fetch) decode(r *reader) {
+	m.ClientId = r.string()
+	m.ClusterIp = r.string()
+	if r.done() {
+		return
+	}
+	m.After = r.string()
+}
+
+func (m *TransferEnd) encode(w *writer) {
+	w.putString(m.ClientId)
+	w.putBool(m.Moving)
+	w.putString(m.Offset)
+}
+
+func (m *TransferEnd) decode(r *reader) {
+	m.ClientId = r.string()
+	if r.done() {
+		return
+	}
+	m.Moving = r.bool()
+	if r.done() {
+		return
+	}
+	m.Offset = r.string()
+}
+
+func (m *NodeOpen) encode(w *writer) {}
+func (m *NodeOpen) decode(r *reader) {}
+
+func (m *NodeData) encode(w *writer) {
+	w.putString(m.ClientId)
+	w.putBytes(m.Payload)
+}
+
+func (m *NodeData) decode(r *reader) {
+	m.ClientId = r.string()
+	m.Payload = r.bytes()
+}
+
+func (m *NodeClose) encode(w *writer) {}
+func (m *NodeClose) decode(r *reader) {}
+
+func (m *Migrate) encode(w *writer) {
+	w.putString(m.ClientId)
+	w.putBool(m.Pending)
+	w.putBool(m.Keep)
+	w.putString(m.After)
+}
+
+func (m *Migrate) decode(r *reader) {
+	m.ClientId = r.string()
+	if r.done() {
+		return
+	}
+	m.Pending = r.bool()
+	if r.done() {
+		return
+	}
+	m.Keep = r.bool()
+	m.After = r.string()
+}
+
+func (m *Relay) encode(w *writer) {
+	w.putString(m.ClientId)
+	w.putString(m.Token)
+}
+
+func (m *Relay) decode(r *reader) {
+	m.ClientId = r.string()
+	if r.done() {
+		return
+	}
+	m.Token = r.string()
+}
+
+func (m *Error) encode(w *writer) {
+	w.putUint16(m.Code)
+	w.putString(m.Message)
+}
+
+func (m *Error) decode(r *reader) {
+	m.Code = r.uint16()
+	m.Message = r.string()
+}
+
+func (m *Ack) encode(w *writer) {
+	w.putString(m.Sender)
+	w.putUint64(m.Seq)
+}
+
+func (m *Ack) decode(r *reader) {
+	m.Sender = r.string()
+	m.Seq = r.uint64()
+}
+
+func (m *Drain) encode(w *writer) {}
+func (m *Drain) decode(r *reader) {}
+
+func (m *Credit) encode(w *writer) {
+	w.putString(m.Sender)
+	w.putUint64(m.Seq)
+}
+
+func (m *Credit) decode(r *reader) {
+	m.Sender = r.string()
+	m.Seq = r.uint64()
+}
+
+func (m *Busy) encode(w *writer) { w.putUint64(m.Seq) }
+func (m *Busy) decode(r *reader) { m.Seq = r.uint64() }
+
+func (m *Commit) encode(w *writer) {
+	w.putString(m.ClientId)
+	w.putString(m.Offset)
+}
+
+func (m *Commit) decode(r *reader) {
+	m.ClientId = r.string()
+	m.Offset = r.string()
+}
+
+func (m *Handover) encode(w *writer) {
+	w.putString(m.ClientId)
+	w.putString(m.Role)
+	w.putUint32(uint32(m.Priority))
+	w.putUint32(m.Weight)
+	w.putString(m.Receiver)
+	w.putStrings(m.Senders)
+	w.putString(m.Sender)
+	w.putBool(m.Pending)
+}
+
+func (m *Handover) decode(r *reader) {
+	m.ClientId = r.string()
+	m.Role = r.string()
+	m.Priority = int32(r.uint32())
+	m.Weight = r.uint32()
+	m.Receiver = r.string()
+	m.Senders = r.strings()
+	m.Sender = r.string()
+	m.Pending = r.bool()
+}
+
+func (m *Error) Error() string {
+	return fmt.Sprintf("protocol error %d: %s", m.Code, m.Message)
+}
+
+func newMessage(typ uint32) Message {
+	switch typ {
+	case TypeRegister:
+		return &Register{}
+	case TypeRegistered:
+		return &Registered{}
+	case TypeData:
+		return &Data{}
+	case TypeExit:
+		return &Exit{}
+	case TypeFetch:
+		return &Fetch{}
+	case TypeTransferEnd:
+		return &TransferEnd{}
+	case TypeNodeOpen:
+		return &NodeOpen{}
+	case TypeNodeData:
+		return &NodeData{}
+	case TypeNodeClose:
+		return &NodeClose{}
+	case TypeMigrate:
+		return &Migrate{}
+	case TypeRelay:
+		return &Relay{}
+	case TypeError:
+		return &Error{}
+	case TypeAck:
+		return &Ack{}
+	case TypeDrain:
+		return &Drain{}
+	case TypeCredit:
+		return &Credit{}
+	case TypeBusy:
+		return &Busy{}
+	case TypeCommit:
+		return &Commit{}
+	case TypeHandover:
+		return &Handover{}
+	}
+	return nil
+}
+
+// Marshal encodes the payload of m. The frame type is m.Type().
+func Marshal(m Message) []byte {
+	w := &writer{}
+	m.encode(w)
+	return w.buf
+}
+
+// Unmarshal decodes a frame payload of the given type.
+func Unmarshal(typ uint32, payload []byte) (Message, error) {
+	m := newMessage(typ)
+	if m == nil {
+		return nil, fmt.Errorf("protocol: unknown message type %d", typ)
+	}
+	r := &reader{buf: payload}
+	m.decode(r)
+	if r.err != nil {
+		return nil, fmt.Errorf("protocol: decode message type %d: %w", typ, r.err)
+	}
+	return m, nil
+}
@@ -0,0 +1,220 @@
+// Package protocol implements the wire protocol spoken between clients and
+// agents on ClientServePort and between agents on DataTransferPort.
+//
+// A connection starts with a fixed preface in both directions:
+//
+//	[magic uint32][min version uint16][max version uint16]
+//
+// Both sides then use the highest version they have in common and exchange
+// typed messages framed as [len uint32][type uint32][payload].
+//
+// Within a version, fields are only appended to the payload of a message. A
+// decoder reads the fields an older build leaves out as zero values and
+// skips the ones a newer build adds, so mixed builds and frames stored by
+// an older build can be read.
+package protocol
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"smart-agent/util"
+	"time"
+)
+
+// Magic opens every connection so that stray traffic on the agent ports is
+// rejected before any frame is parsed. It reads "SMAG" on the wire.
+const Magic uint32 = 0x47414d53
+
+const (
+	// Version is the newest protocol version spoken by this build.
+	Version uint16 = 1
+	// MinVersion is the oldest protocol version this build still accepts.
+	MinVersion uint16 = 1
+)
+
+const prefaceLen = 8
+
+const (
+	// DefaultMaxFrameSize bounds the frames a Conn accepts unless MaxFrameSize
+	// is set.
+	DefaultMaxFrameSize = 1 << 20
+	// HandshakeTimeout bounds the preface exchange.
+	HandshakeTimeout = 10 * time.Second
+	// DefaultWriteTimeout bounds Send unless WriteTimeout is set.
+	DefaultWriteTimeout = 30 * time.Second
+)
+
+var ErrBadMagic = errors.New("protocol: bad magic, peer is not a smart-agent endpoint")
+
+// VersionError is returned by the handshake when both sides have no protocol
+// version in common.
+type VersionError struct {
+	LocalMin, LocalMax uint16
+	PeerMin, PeerMax   uint16
+}
+
+func (e *VersionError) Error() string {
+	return fmt.Sprintf("protocol: unsupported version, local speaks %d-%d, peer speaks %d-%d",
+		e.LocalMin, e.LocalMax, e.PeerMin, e.PeerMax)
+}
+
+// Conn is a net.Conn that has completed the handshake.
+type Conn struct {
+	net.Conn
+	// MaxFrameSize bounds incoming frames, 0 means DefaultMaxFrameSize.
+	MaxFrameSize uint32
+	// WriteTimeout bounds Send, 0 means DefaultWriteTimeout and a negative
+	// value disables the timeout.
+	WriteTimeout time.Duration
+
+	version uint16
+}
+
+// Client performs the client side of the handshake on c.
+func Client(c net.Conn) (*Conn, error) {
+	c.SetDeadline(time.Now().Add(HandshakeTimeout))
+	defer c.SetDeadline(time.Time{})
+	if err := writePreface(c); err != nil {
+		return nil, err
+	}
+	peerMin, peerMax, err := readPreface(c)
+	if err != nil {
+		return nil, err
+	}
+	version, err := negotiate(peerMin, peerMax)
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{Conn: c, version: version}, nil
+}
+
+// Server performs the server side of the handshake on c. A peer with a bad
+// magic gets no reply; a peer with no common version gets our preface so it
+// can report the mismatch, and the handshake fails.
+func Server(c net.Conn) (*Conn, error) {
+	c.SetDeadline(time.Now().Add(HandshakeTimeout))
+	defer c.SetDeadline(time.Time{})
+	peerMin, peerMax, err := readPreface(c)
+	if err != nil {
+		return nil, err
+	}
+	if err := writePreface(c); err != nil {
+		return nil, err
+	}
+	version, err := negotiate(peerMin, peerMax)
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{Conn: c, version: version}, nil
+}
+
+// Version returns the negotiated protocol version.
+func (c *Conn) Version() uint16 {
+	return c.version
+}
+
+// NetConn returns the conn the handshake ran on.
+func (c *Conn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// Send writes m as one frame within WriteTimeout.
+func (c *Conn) Send(m Message) error {
+	timeout := c.WriteTimeout
+	if timeout == 0 {
+		timeout = DefaultWriteTimeout
+	}
+	if timeout < 0 {
+		return c.SendContext(context.Background(), m)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return c.SendContext(ctx, m)
+}
+
+// SendContext writes m as one frame, giving up when ctx is done.
+func (c *Conn) SendContext(ctx context.Context, m Message) error {
+	if err := util.WriteFrame(ctx, c.Conn, m.Type(), Marshal(m)); err != nil {
+		return fmt.Errorf("protocol: send message type %d: %w", m.Type(), err)
+	}
+	return nil
+}
+
+// Recv reads and decodes the next frame, waiting as long as it takes.
+func (c *Conn) Recv() (Message, error) {
+	return c.RecvContext(context.Background())
+}
+
+// RecvContext reads and decodes the next frame, giving up when ctx is done.
+func (c *Conn) RecvContext(ctx context.Context) (Message, error) {
+	maxSize := c.MaxFrameSize
+	if maxSize == 0 {
+		maxSize = DefaultMaxFrameSize
+	}
+	typ, payload, err := util.ReadFrame(ctx, c.Conn, maxSize)
+	if err != nil {
+		return nil, fmt.Errorf("protocol: receive: %w", err)
+	}
+	return Unmarshal(typ, payload)
+}
+
+// Expect reads the next message and fails unless it has the given type. An
+// Error message from the peer is returned as the error.
+func (c *Conn) Expect(typ uint32) (Message, error) {
+	return c.ExpectContext(context.Background(), typ)
+}
+
+// ExpectContext is Expect bounded by ctx.
+func (c *Conn) ExpectContext(ctx context.Context, typ uint32) (Message, error) {
+	m, err := c.RecvContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if m.Type() != typ {
+		if perr, ok := m.(*Error); ok {
+			return nil, perr
+		}
+		return nil, fmt.Errorf("protocol: expected message type %d, got %d", typ, m.Type())
+	}
+	return m, nil
+}
+
+func writePreface(w io.Writer) error {
+	buf := make([]byte, prefaceLen)
+	binary.LittleEndian.PutUint32(buf, Magic)
+	binary.LittleEndian.PutUint16(buf[4:], MinVersion)
+	binary.LittleEndian.PutUint16(buf[6:], Version)
+	_, err := w.Write(buf)
+	return err
+}
+
+func readPreface(r io.Reader) (uint16, uint16, error) {
+	buf := make([]byte, prefaceLen)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return 0, 0, fmt.Errorf("protocol: read preface: %w", err)
+	}
+	if binary.LittleEndian.Uint32(buf) != Magic {
+		return 0, 0, ErrBadMagic
+	}
+	return binary.LittleEndian.Uint16(buf[4:]), binary.LittleEndian.Uint16(buf[6:]), nil
+}
+
+func negotiate(peerMin, peerMax uint16) (uint16, error) {
+	version := Version
+	if peerMax < version {
+		version = peerMax
+	}
+	if version < MinVersion || version < peerMin {
+		return 0, &VersionError{
+			LocalMin: MinVersion,
+			LocalMax: Version,
+			PeerMin:  peerMin,
+			PeerMax:  peerMax,
+		}
+	}
+	return version, nil
+}
@@ -0,0 +1,248 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestMessageRoundTrip(t *testing.T) {
+	msgs := []Message{
+		&Register{
+			ClientId:      "sender",
+			Role:          "sender",
+			Priority:      80,
+			ClusterIp:     "10.0.0.1",
+			PrevClusterIp: "10.0.0.2",
+			Receiver:      "receiver",
+			Senders:       []string{},
+			Token:         "token",
+			Acked:         7,
+			Cursors:       []Cursor{{Sender: "sender1", Seq: 3}, {Sender: "sender2", Seq: 9}},
+			Credential:    "secret",
+			Profile:       "fullmesh",
+			Weight:        3,
+		},
+		&Registered{Token: "token", Resumed: true, Seq: 7, Profile: "none"},
+		&Exit{Moving: true, To: "10.0.0.4"},
+		&Migrate{ClientId: "sender", Pending: true, Keep: true, After: "1700000000000-0"},
+		&Relay{ClientId: "sender", Token: "token"},
+		&Data{Sender: "sender", Seq: 42, Payload: []byte{0, 1, 2, '\n', 0xff}, More: true, Encrypted: true, Expires: 1700000000000},
+		&Ack{Sender: "sender", Seq: 42},
+		&Fetch{ClientId: "receiver", ClusterIp: "10.0.0.3", After: "1700000000000-0"},
+		&TransferEnd{ClientId: "sender", Moving: true, Offset: "1700000000000-1"},
+		&Drain{},
+		&Credit{Sender: "sender", Seq: 106},
+		&Busy{Seq: 43},
+		&Commit{ClientId: "sender", Offset: "1700000000000-1"},
+		&Handover{ClientId: "sender", Role: "sender", Priority: 80, Weight: 3, Receiver: "receiver", Senders: []string{}, Sender: "sender", Pending: true},
+		&Error{Code: 3, Message: "denied"},
+	}
+	for _, m := range msgs {
+		got, err := Unmarshal(m.Type(), Marshal(m))
+		if err != nil {
+			t.Fatalf("unmarshal %T: %v", m, err)
+		}
+		if !reflect.DeepEqual(got, m) {
+			t.Fatalf("round trip %T: got %+v, want %+v", m, got, m)
+		}
+	}
+}
+
+func TestUnmarshalRejectsBadPayload(t *testing.T) {
+	if _, err := Unmarshal(0xffff, nil); err == nil {
+		t.Fatal("expected error for unknown message type")
+	}
+	payload := Marshal(&Data{Sender: "sender", Payload: []byte("hello")})
+	if _, err := Unmarshal(TypeData, payload[:len(payload)-1]); err == nil {
+		t.Fatal("expected error for truncated payload")
+	}
+}
+
+func TestUnmarshalOlderLayouts(t *testing.T) {
+	// a frame of a build before Encrypted and Expires, as a peer one build
+	// behind sends it or an older agent stored it
+	w := &writer{}
+	w.putString("sender")
+	w.putUint64(42)
+	w.putBytes([]byte("hello"))
+	w.putBool(true)
+	msg, err := Unmarshal(TypeData, w.buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := msg.(*Data); d.Seq != 42 || string(d.Payload) != "hello" || !d.More || d.Encrypted || d.Expires != 0 {
+		t.Fatalf("old data decoded as %+v", d)
+	}
+
+	// a register of a build before credentials, profiles and weights
+	full := &Register{ClientId: "c", Role: "sender", Priority: 1, Receiver: "r", Senders: []string{}, Token: "t", Acked: 3, Cursors: []Cursor{}}
+	w = &writer{}
+	w.putString(full.ClientId)
+	w.putString(full.Role)
+	w.putUint32(uint32(full.Priority))
+	w.putString(full.ClusterIp)
+	w.putString(full.PrevClusterIp)
+	w.putString(full.Receiver)
+	w.putStrings(full.Senders)
+	w.putString(full.Token)
+	w.putUint64(full.Acked)
+	w.putUint32(0)
+	msg, err = Unmarshal(TypeRegister, w.buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(msg, full) {
+		t.Fatalf("old register decoded as %+v", msg)
+	}
+
+	for typ, payload := range map[uint32][]byte{
+		TypeExit:        nil,
+		TypeRegistered:  nil,
+		TypeTransferEnd: Marshal(&TransferEnd{ClientId: "c"})[:4+1],
+	} {
+		if _, err := Unmarshal(typ, payload); err != nil {
+			t.Fatalf("type %d of an older build: %v", typ, err)
+		}
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	errCh := make(chan error, 1)
+	go func() {
+		conn, err := Server(c2)
+		if err == nil {
+			var msg Message
+			msg, err = conn.Recv()
+			if err == nil {
+				err = conn.Send(msg)
+			}
+		}
+		errCh <- err
+	}()
+	conn, err := Client(c1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn.Version() != Version {
+		t.Fatalf("negotiated version %d, want %d", conn.Version(), Version)
+	}
+	want := &Data{Sender: "sender", Payload: []byte("hello")}
+	if err := conn.Send(want); err != nil {
+		t.Fatal(err)
+	}
+	got, err := conn.Expect(TypeData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHandshakeRejectsUnknownVersion(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := Server(c2)
+		errCh <- err
+	}()
+	preface := make([]byte, prefaceLen)
+	binary.LittleEndian.PutUint32(preface, Magic)
+	binary.LittleEndian.PutUint16(preface[4:], Version+1)
+	binary.LittleEndian.PutUint16(preface[6:], Version+2)
+	if _, err := c1.Write(preface); err != nil {
+		t.Fatal(err)
+	}
+	peerMin, peerMax, err := readPreface(c1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if peerMin != MinVersion || peerMax != Version {
+		t.Fatalf("server advertised %d-%d", peerMin, peerMax)
+	}
+	var verr *VersionError
+	if err := <-errCh; !errors.As(err, &verr) {
+		t.Fatalf("expected VersionError, got %v", err)
+	}
+}
+
+func TestHandshakeRejectsBadMagic(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := Server(c2)
+		errCh <- err
+	}()
+	if _, err := c1.Write([]byte("GET / HT")); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errCh; !errors.Is(err, ErrBadMagic) {
+		t.Fatalf("expected ErrBadMagic, got %v", err)
+	}
+}
+
+func TestSendStreamChunksLargeMessages(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	payload := make([]byte, 2*MaxChunkSize+17)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	errCh := make(chan error, 1)
+	var waited []uint64
+	go func() {
+		stream := &Stream{Sender: "sender", Wait: func(seq uint64) { waited = append(waited, seq) }}
+		_, err := stream.SendFrom(&Conn{Conn: c1}, bytes.NewReader(payload))
+		errCh <- err
+	}()
+	recv := &Conn{Conn: c2}
+	var got []byte
+	chunks := 0
+	for {
+		m, err := recv.Expect(TypeData)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := m.(*Data)
+		if len(data.Payload) > MaxChunkSize {
+			t.Fatalf("chunk of %d bytes exceeds MaxChunkSize", len(data.Payload))
+		}
+		got = append(got, data.Payload...)
+		chunks++
+		if data.Seq != uint64(chunks) {
+			t.Fatalf("chunk %d has seq %d", chunks, data.Seq)
+		}
+		if !data.More {
+			break
+		}
+	}
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	if chunks != 3 || !bytes.Equal(got, payload) {
+		t.Fatalf("got %d bytes in %d chunks", len(got), chunks)
+	}
+	// every chunk waited for credit before it was sent
+	if !reflect.DeepEqual(waited, []uint64{1, 2, 3}) {
+		t.Fatalf("waited for %v", waited)
+	}
+}
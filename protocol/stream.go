@@ -0,0 +1,95 @@
+package protocol
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// MaxChunkSize is the largest payload carried by one Data frame.
+const MaxChunkSize = 256 << 10
+
+// Stream numbers the Data frames a sender sends to its receiver.
+type Stream struct {
+	Sender string
+	// Seq is the sequence number of the last frame sent, 0 before the first.
+	Seq uint64
+	// Seal, if set, encrypts every frame before it is sent.
+	Seal func(*Data) error
+	// Wait, if set, is called before frame seq is sent and blocks while
+	// the receiver has no credit for it.
+	Wait func(seq uint64)
+	// TTL, if set, is how long a message is worth delivering after it is
+	// sent, see Data.Expires.
+	TTL time.Duration
+}
+
+// SendFrom sends everything read from r as one message, split into Data
+// chunks of at most MaxChunkSize bytes. Only one chunk is held in memory at a
+// time, so r may be larger than memory. It returns the number of payload
+// bytes sent; s.Seq is then the sequence number of the last chunk.
+func (s *Stream) SendFrom(c *Conn, r io.Reader) (int64, error) {
+	var total int64
+	expires := s.expires()
+	cur := make([]byte, MaxChunkSize)
+	next := make([]byte, MaxChunkSize)
+	n, err := io.ReadFull(r, cur)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return 0, fmt.Errorf("protocol: read stream: %w", err)
+	}
+	for {
+		// read one chunk ahead so the last chunk can be flagged as such
+		var m int
+		if err == nil {
+			m, err = io.ReadFull(r, next)
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				return total, fmt.Errorf("protocol: read stream: %w", err)
+			}
+		}
+		more := m > 0
+		if err := s.send(c, cur[:n], more, expires); err != nil {
+			return total, err
+		}
+		total += int64(n)
+		if !more {
+			return total, nil
+		}
+		cur, next = next, cur
+		n = m
+	}
+}
+
+// SendBytes sends payload as one message, chunked if needed.
+func (s *Stream) SendBytes(c *Conn, payload []byte) error {
+	expires := s.expires()
+	for len(payload) > MaxChunkSize {
+		if err := s.send(c, payload[:MaxChunkSize], true, expires); err != nil {
+			return err
+		}
+		payload = payload[MaxChunkSize:]
+	}
+	return s.send(c, payload, false, expires)
+}
+
+// expires returns the Expires of a message sent now, every chunk of it gets
+// the same.
+func (s *Stream) expires() int64 {
+	if s.TTL <= 0 {
+		return 0
+	}
+	return time.Now().Add(s.TTL).UnixMilli()
+}
+
+func (s *Stream) send(c *Conn, payload []byte, more bool, expires int64) error {
+	s.Seq++
+	if s.Wait != nil {
+		s.Wait(s.Seq)
+	}
+	m := &Data{Sender: s.Sender, Seq: s.Seq, Payload: payload, More: more, Expires: expires}
+	if s.Seal != nil {
+		if err := s.Seal(m); err != nil {
+			return err
+		}
+	}
+	return c.Send(m)
+}
@@ -7,6 +7,9 @@ SELECTOR_APP="proxy-app"
 NAMESPACE="smart-agent"
 CONFIGMAP="client-map"
 CLUSTERROLE="configmap-reader"
+TLS_SECRET="smart-agent-tls"
+TLS_NAME="smart-agent"
+TLS_DIR="tls"
 use_k8s=0
 if command -v kubectl >/dev/null 2>&1; then
 	K="kubectl"
@@ -53,6 +56,38 @@ createResourceNeeded() {
         echo "apply role binding policy"
         $K apply -f clusterrolebinding.yaml
     fi
+    secret_cnt=$($K get secret -n ${NAMESPACE} | grep ${TLS_SECRET} | wc -l)
+    if [[ $secret_cnt -eq 0 ]]; then
+        genCerts
+        echo "create secret ${TLS_SECRET}"
+        $K create secret generic ${TLS_SECRET} -n ${NAMESPACE} \
+            --from-file=ca.crt=${TLS_DIR}/ca.crt \
+            --from-file=tls.crt=${TLS_DIR}/tls.crt \
+            --from-file=tls.key=${TLS_DIR}/tls.key
+    fi
+}
+
+# genCerts creates a CA, the certificate shared by all agents and a client
+# certificate in ${TLS_DIR}, unless they exist already. Only the agents'
+# certificate is issued for ${TLS_NAME}, the transfer port refuses any other
+genCerts() {
+    [[ -f ${TLS_DIR}/ca.crt ]] && return
+    echo "generate certificates in ${TLS_DIR}"
+    mkdir -p ${TLS_DIR}
+    openssl req -x509 -newkey rsa:2048 -nodes -days 3650 -subj "/CN=smart-agent-ca" \
+        -keyout ${TLS_DIR}/ca.key -out ${TLS_DIR}/ca.crt
+    issueCert tls ${TLS_NAME} serverAuth,clientAuth
+    issueCert client ${TLS_NAME}-client clientAuth
+}
+
+# issueCert <file> <name> <usages> issues ${TLS_DIR}/<file>.crt for name
+issueCert() {
+    openssl req -newkey rsa:2048 -nodes -subj "/CN=$2" \
+        -keyout ${TLS_DIR}/$1.key -out ${TLS_DIR}/$1.csr
+    openssl x509 -req -in ${TLS_DIR}/$1.csr -CA ${TLS_DIR}/ca.crt -CAkey ${TLS_DIR}/ca.key \
+        -CAcreateserial -days 3650 -out ${TLS_DIR}/$1.crt \
+        -extfile <(printf "subjectAltName=DNS:$2\nextendedKeyUsage=$3")
+    rm ${TLS_DIR}/$1.csr
 }
 
 build() {
@@ -61,7 +96,7 @@ build() {
         eval $(minikube docker-env)
 	fi
     echo "build server..."
-    go build -o server cmd/server/main.go
+    go build -o server ./cmd/server
     echo "build docker image..."
     docker build -t my-agent .
 }
@@ -98,6 +133,8 @@ clean() {
     done <<< $running_services
     echo "delete configmaps..."
     $K delete configmap ${CONFIGMAP} -n ${NAMESPACE}
+    echo "delete tls secret..."
+    $K delete secret ${TLS_SECRET} -n ${NAMESPACE}
 }
 
 if [[ "$1" == "build" ]]; then
@@ -2,13 +2,17 @@ package service
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"os"
 	"smart-agent/config"
 	"strings"
 
+	authv1 "k8s.io/api/authentication/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
@@ -98,12 +102,11 @@ func (k8s *K8SClient) GetNamespaceServices(namespace string) []Service {
 	return ret
 }
 
-func (k8s *K8SClient) GetNameSpacePods(namespace string) []Pod {
+func (k8s *K8SClient) GetNameSpacePods(namespace string) ([]Pod, error) {
 	var ret []Pod
 	pods, err := k8s.cli.CoreV1().Pods(namespace).List(context.Background(), metav1.ListOptions{})
 	if err != nil {
-		log.Fatalln("Error getting pods: ", err)
-		os.Exit(1)
+		return nil, fmt.Errorf("list pods: %w", err)
 	}
 	prefix := "proxy-deployment" //匹配前缀
 	templateName := "proxy-service"
@@ -117,7 +120,7 @@ func (k8s *K8SClient) GetNameSpacePods(namespace string) []Pod {
 			ret = append(ret, cur)
 		}
 	}
-	return ret
+	return ret, nil
 }
 
 func (k8s *K8SClient) createConfigMap(data map[string]string) error {
@@ -161,6 +164,51 @@ func (k8s *K8SClient) EtcdGet(key string) (string, error) {
 	return data, nil
 }
 
+// EtcdWatch sends the value of key and then every value it is put with,
+// "" once it is deleted. The channel is closed once ctx is done or the
+// watch of the ConfigMap ends.
+func (k8s *K8SClient) EtcdWatch(ctx context.Context, key string) (<-chan string, error) {
+	w, err := k8s.cli.CoreV1().ConfigMaps(config.Namespace).Watch(ctx, metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("metadata.name", config.EtcdClientMapName).String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan string)
+	go func() {
+		defer close(ch)
+		defer w.Stop()
+		// the ConfigMap comes first as added when it exists
+		sent := false
+		last := ""
+		for ev := range w.ResultChan() {
+			var value string
+			switch ev.Type {
+			case watch.Added, watch.Modified:
+				cm, ok := ev.Object.(*corev1.ConfigMap)
+				if !ok {
+					return
+				}
+				value = cm.Data[key]
+			case watch.Deleted:
+			default:
+				log.Printf("watch of %s ended: %v\n", config.EtcdClientMapName, ev.Object)
+				return
+			}
+			if sent && value == last {
+				continue
+			}
+			select {
+			case ch <- value:
+				sent, last = true, value
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
 func (k8s *K8SClient) EtcdDelete(key string) error {
 	cm, err := k8s.cli.CoreV1().ConfigMaps(config.Namespace).Get(context.TODO(), config.EtcdClientMapName, metav1.GetOptions{})
 	if err != nil {
@@ -170,3 +218,22 @@ func (k8s *K8SClient) EtcdDelete(key string) error {
 	_, err = k8s.cli.CoreV1().ConfigMaps(config.Namespace).Update(context.TODO(), cm, metav1.UpdateOptions{})
 	return err
 }
+
+// GetSecret returns the data of the Secret name in the agent namespace.
+func (k8s *K8SClient) GetSecret(name string) (map[string][]byte, error) {
+	secret, err := k8s.cli.CoreV1().Secrets(config.Namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return secret.Data, nil
+}
+
+// ReviewToken asks the API server who token belongs to.
+func (k8s *K8SClient) ReviewToken(ctx context.Context, token string) (string, bool, error) {
+	review := &authv1.TokenReview{Spec: authv1.TokenReviewSpec{Token: token}}
+	review, err := k8s.cli.AuthenticationV1().TokenReviews().Create(ctx, review, metav1.CreateOptions{})
+	if err != nil {
+		return "", false, err
+	}
+	return review.Status.User.Username, review.Status.Authenticated, nil
+}
@@ -0,0 +1,64 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// ErrNoInfo is returned by Inspect for connections that are not carried by
+// TCP or MPTCP, such as Unix sockets and in-memory pipes.
+var ErrNoInfo = errors.New("transport: no path information for this connection")
+
+// ConnInfo is what the kernel reports about the path of a connection.
+type ConnInfo struct {
+	// MPTCP is true when MPTCP was negotiated with the peer.
+	MPTCP bool
+	// Fallback is true for an MPTCP socket that fell back to plain TCP,
+	// because the peer or a middlebox does not speak MPTCP.
+	Fallback bool
+	// Subflows of the connection, a TCP connection has exactly one.
+	Subflows []Subflow
+}
+
+// Subflow is one TCP path of a connection.
+type Subflow struct {
+	RTT         time.Duration
+	RTTVar      time.Duration
+	Retransmits uint32
+}
+
+// Protocol names how the connection is carried: mptcp, tcp, or tcp
+// (mptcp fallback).
+func (i ConnInfo) Protocol() string {
+	switch {
+	case i.MPTCP:
+		return NameMPTCP
+	case i.Fallback:
+		return NameTCP + " (" + NameMPTCP + " fallback)"
+	}
+	return NameTCP
+}
+
+func (i ConnInfo) String() string {
+	rtts := make([]string, len(i.Subflows))
+	for n, sf := range i.Subflows {
+		rtts[n] = fmt.Sprintf("%.3fms", float64(sf.RTT.Microseconds())/1000)
+	}
+	return fmt.Sprintf("%s, %d subflows, rtt %s", i.Protocol(), len(i.Subflows), strings.Join(rtts, "/"))
+}
+
+// Inspect asks the kernel about the path of conn. Wrappers such as TLS
+// conns are looked through by their NetConn method.
+func Inspect(conn net.Conn) (ConnInfo, error) {
+	for {
+		u, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			break
+		}
+		conn = u.NetConn()
+	}
+	return inspect(conn)
+}
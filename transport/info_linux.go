@@ -0,0 +1,133 @@
+//go:build linux && !386
+
+package transport
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// from linux/mptcp.h
+const (
+	solMPTCP     = 284
+	mptcpInfo    = 1
+	mptcpTCPInfo = 2
+
+	// subflows asked for beyond the ones MPTCP_INFO counts, they may come
+	// and go between the two calls
+	subflowSlack = 4
+)
+
+// struct mptcp_subflow_data heading the MPTCP_TCPINFO reply
+type subflowData struct {
+	sizeSubflowData uint32
+	numSubflows     uint32
+	sizeKernel      uint32
+	sizeUser        uint32
+}
+
+var (
+	subflowDataSize = int(unsafe.Sizeof(subflowData{}))
+	tcpInfoSize     = int(unsafe.Sizeof(syscall.TCPInfo{}))
+)
+
+func inspect(conn net.Conn) (ConnInfo, error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return ConnInfo{}, ErrNoInfo
+	}
+	if _, ok := conn.LocalAddr().(*net.TCPAddr); !ok {
+		return ConnInfo{}, ErrNoInfo
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return ConnInfo{}, err
+	}
+	var info ConnInfo
+	var infoErr error
+	err = rc.Control(func(fd uintptr) {
+		info, infoErr = inspectFd(int(fd))
+	})
+	if err != nil {
+		return ConnInfo{}, err
+	}
+	return info, infoErr
+}
+
+func inspectFd(fd int) (ConnInfo, error) {
+	proto, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_PROTOCOL)
+	if err != nil {
+		return ConnInfo{}, os.NewSyscallError("getsockopt", err)
+	}
+	if proto == ipprotoMPTCP {
+		// MPTCP_INFO fails once the socket fell back to TCP, the options of
+		// the one subflow left are then reached at the TCP level
+		buf := make([]byte, 64)
+		if _, err := getsockopt(fd, solMPTCP, mptcpInfo, buf); err == nil {
+			// mptcpi_subflows counts the subflows beyond the first one
+			subflows, err := mptcpSubflows(fd, int(buf[0])+1+subflowSlack)
+			return ConnInfo{MPTCP: true, Subflows: subflows}, err
+		}
+		sf, err := tcpSubflow(fd)
+		return ConnInfo{Fallback: true, Subflows: []Subflow{sf}}, err
+	}
+	sf, err := tcpSubflow(fd)
+	return ConnInfo{Subflows: []Subflow{sf}}, err
+}
+
+func tcpSubflow(fd int) (Subflow, error) {
+	var ti syscall.TCPInfo
+	buf := (*[1 << 10]byte)(unsafe.Pointer(&ti))[:tcpInfoSize:tcpInfoSize]
+	if _, err := getsockopt(fd, syscall.SOL_TCP, syscall.TCP_INFO, buf); err != nil {
+		return Subflow{}, err
+	}
+	return subflowOf(&ti), nil
+}
+
+// mptcpSubflows reads the tcp_info of up to max subflows.
+func mptcpSubflows(fd int, max int) ([]Subflow, error) {
+	buf := make([]byte, subflowDataSize+max*tcpInfoSize)
+	hdr := (*subflowData)(unsafe.Pointer(&buf[0]))
+	// num_subflows and size_kernel are filled in by the kernel
+	hdr.sizeSubflowData = uint32(subflowDataSize)
+	hdr.sizeUser = uint32(tcpInfoSize)
+	n, err := getsockopt(fd, solMPTCP, mptcpTCPInfo, buf)
+	if err != nil {
+		return nil, err
+	}
+	count := int(hdr.numSubflows)
+	if fit := (n - subflowDataSize) / tcpInfoSize; count > fit {
+		count = fit
+	}
+	subflows := make([]Subflow, 0, count)
+	for i := 0; i < count; i++ {
+		var ti syscall.TCPInfo
+		dst := (*[1 << 10]byte)(unsafe.Pointer(&ti))[:tcpInfoSize:tcpInfoSize]
+		copy(dst, buf[subflowDataSize+i*tcpInfoSize:])
+		subflows = append(subflows, subflowOf(&ti))
+	}
+	return subflows, nil
+}
+
+func subflowOf(ti *syscall.TCPInfo) Subflow {
+	return Subflow{
+		RTT:         time.Duration(ti.Rtt) * time.Microsecond,
+		RTTVar:      time.Duration(ti.Rttvar) * time.Microsecond,
+		Retransmits: ti.Total_retrans,
+	}
+}
+
+// getsockopt reads option opt of level into buf and returns the length the
+// kernel wrote.
+func getsockopt(fd, level, opt int, buf []byte) (int, error) {
+	n := uint32(len(buf))
+	_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, uintptr(fd), uintptr(level), uintptr(opt),
+		uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&n)), 0)
+	if errno != 0 {
+		return 0, os.NewSyscallError("getsockopt", errno)
+	}
+	return int(n), nil
+}
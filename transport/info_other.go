@@ -0,0 +1,11 @@
+//go:build !linux || 386
+
+package transport
+
+import "net"
+
+// Path information is only read from the Linux kernel.
+
+func inspect(conn net.Conn) (ConnInfo, error) {
+	return ConnInfo{}, ErrNoInfo
+}
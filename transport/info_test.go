@@ -0,0 +1,85 @@
+package transport
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// dialPair connects over server and client and returns the dialed conn.
+func dialPair(t *testing.T, server, client Transport, addr string) net.Conn {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	l, err := server.Listen(ctx, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	echoOnce(t, l)
+	c, err := client.Dial(ctx, l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	// one round trip, so the kernel has measured an rtt
+	if _, err := c.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Read(make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestInspect(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("path information is only read on linux")
+	}
+	t.Run(NameTCP, func(t *testing.T) {
+		info, err := Inspect(dialPair(t, TCP{}, TCP{}, "127.0.0.1:0"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.MPTCP || info.Fallback || len(info.Subflows) != 1 {
+			t.Fatalf("got %+v", info)
+		}
+	})
+	t.Run("fallback", func(t *testing.T) {
+		if !MPTCPSupported() {
+			t.Skip("kernel without mptcp")
+		}
+		// the listener speaks plain TCP, so MPTCP is not negotiated
+		info, err := Inspect(dialPair(t, TCP{}, MPTCP{}, "127.0.0.1:0"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.MPTCP || !info.Fallback || len(info.Subflows) != 1 {
+			t.Fatalf("got %+v", info)
+		}
+	})
+	t.Run(NameMPTCP, func(t *testing.T) {
+		if !MPTCPSupported() {
+			t.Skip("kernel without mptcp")
+		}
+		info, err := Inspect(dialPair(t, MPTCP{}, MPTCP{}, "127.0.0.1:0"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !info.MPTCP || len(info.Subflows) == 0 {
+			t.Fatalf("got %+v", info)
+		}
+		if info.Subflows[0].RTT <= 0 {
+			t.Fatalf("no rtt measured: %+v", info)
+		}
+	})
+	t.Run(NameUnix, func(t *testing.T) {
+		c := dialPair(t, Unix{}, Unix{}, filepath.Join(t.TempDir(), "agent.sock"))
+		if _, err := Inspect(c); err != ErrNoInfo {
+			t.Fatalf("got %v", err)
+		}
+	})
+}
@@ -0,0 +1,88 @@
+package transport
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+)
+
+// Memory connects dialers and listeners of one process through net.Pipe.
+// Addresses are plain names.
+type Memory struct {
+	mu        sync.Mutex
+	listeners map[string]*memListener
+}
+
+// NewMemory returns a Memory transport with no listeners.
+func NewMemory() *Memory {
+	return &Memory{listeners: make(map[string]*memListener)}
+}
+
+func (m *Memory) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	m.mu.Lock()
+	l, ok := m.listeners[addr]
+	m.mu.Unlock()
+	if !ok {
+		return nil, &net.OpError{Op: "dial", Net: NameMemory, Addr: memAddr(addr), Err: syscall.ECONNREFUSED}
+	}
+	c1, c2 := net.Pipe()
+	select {
+	case l.conns <- c2:
+		return c1, nil
+	case <-l.done:
+		c1.Close()
+		c2.Close()
+		return nil, &net.OpError{Op: "dial", Net: NameMemory, Addr: memAddr(addr), Err: syscall.ECONNREFUSED}
+	case <-ctx.Done():
+		c1.Close()
+		c2.Close()
+		return nil, ctx.Err()
+	}
+}
+
+func (m *Memory) Listen(ctx context.Context, addr string) (net.Listener, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.listeners[addr]; ok {
+		return nil, fmt.Errorf("transport: memory address %s in use", addr)
+	}
+	l := &memListener{m: m, addr: memAddr(addr), conns: make(chan net.Conn), done: make(chan struct{})}
+	m.listeners[addr] = l
+	return l, nil
+}
+
+type memListener struct {
+	m     *Memory
+	addr  memAddr
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func (l *memListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *memListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+		l.m.mu.Lock()
+		delete(l.m.listeners, string(l.addr))
+		l.m.mu.Unlock()
+	})
+	return nil
+}
+
+func (l *memListener) Addr() net.Addr { return l.addr }
+
+type memAddr string
+
+func (a memAddr) Network() string { return NameMemory }
+func (a memAddr) String() string  { return string(a) }
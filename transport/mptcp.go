@@ -0,0 +1,33 @@
+package transport
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+// MPTCP is Multipath TCP. Where the kernel cannot create MPTCP sockets it
+// falls back to plain TCP, so it is always safe to pick.
+type MPTCP struct{}
+
+func (MPTCP) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	return dialMPTCP(ctx, addr)
+}
+
+func (MPTCP) Listen(ctx context.Context, addr string) (net.Listener, error) {
+	return listenMPTCP(ctx, addr)
+}
+
+// MPTCPSupported reports whether the kernel creates MPTCP sockets. It is
+// probed once, by creating one.
+func MPTCPSupported() bool {
+	mptcpProbe.Do(func() {
+		mptcpOK = probeMPTCP()
+	})
+	return mptcpOK
+}
+
+var (
+	mptcpProbe sync.Once
+	mptcpOK    bool
+)
@@ -0,0 +1,237 @@
+//go:build linux
+
+package transport
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+// IPPROTO_MPTCP of linux/in.h, missing from package syscall
+const ipprotoMPTCP = 262
+
+// mptcpSocket creates an MPTCP socket of family. ok is false when the kernel
+// does not support MPTCP, the caller then falls back to TCP.
+func mptcpSocket(family int) (fd int, ok bool, err error) {
+	fd, err = syscall.Socket(family, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC|syscall.SOCK_NONBLOCK, ipprotoMPTCP)
+	if err == nil {
+		return fd, true, nil
+	}
+	switch err {
+	case syscall.EPROTONOSUPPORT, syscall.EINVAL, syscall.ENOPROTOOPT, syscall.EAFNOSUPPORT:
+		return -1, false, nil
+	}
+	return -1, false, os.NewSyscallError("socket", err)
+}
+
+func probeMPTCP() bool {
+	fd, ok, err := mptcpSocket(syscall.AF_INET)
+	if err != nil || !ok {
+		return false
+	}
+	syscall.Close(fd)
+	return true
+}
+
+func dialMPTCP(ctx context.Context, addr string) (net.Conn, error) {
+	raddrs, err := resolve(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	// addresses are tried in the order the resolver returned them, as
+	// net.Dialer does without a fallback delay
+	var firstErr error
+	for _, raddr := range raddrs {
+		c, err := dialMPTCPAddr(ctx, raddr)
+		if err == nil {
+			return c, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, firstErr
+}
+
+func dialMPTCPAddr(ctx context.Context, raddr *net.TCPAddr) (net.Conn, error) {
+	family, sa := sockaddr(raddr)
+	fd, ok, err := mptcpSocket(family)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return TCP{}.Dial(ctx, raddr.String())
+	}
+	// the file owns fd from here on, closing it closes the socket
+	f := os.NewFile(uintptr(fd), "mptcp")
+	defer f.Close()
+	if err := syscall.Connect(fd, sa); err != nil {
+		if err != syscall.EINPROGRESS {
+			return nil, &net.OpError{Op: "dial", Net: NameMPTCP, Addr: raddr, Err: os.NewSyscallError("connect", err)}
+		}
+		if err := waitConnected(ctx, f); err != nil {
+			return nil, &net.OpError{Op: "dial", Net: NameMPTCP, Addr: raddr, Err: err}
+		}
+	}
+	return net.FileConn(f)
+}
+
+// waitConnected waits until the non-blocking connect on f is done.
+func waitConnected(ctx context.Context, f *os.File) error {
+	if d, ok := ctx.Deadline(); ok {
+		f.SetWriteDeadline(d)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			f.SetWriteDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var soErr int
+	var optErr error
+	// the connect may be done before the poller looks, so the socket is
+	// asked first, like net does, and only waited for while in progress
+	err = rc.Write(func(fd uintptr) bool {
+		soErr, optErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_ERROR)
+		if optErr != nil {
+			return true
+		}
+		switch syscall.Errno(soErr) {
+		case syscall.EINPROGRESS, syscall.EALREADY, syscall.EINTR:
+			return false
+		case 0:
+			// no error yet is connected only once there is a peer
+			if _, err := syscall.Getpeername(int(fd)); err == syscall.ENOTCONN {
+				return false
+			}
+		}
+		return true
+	})
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil {
+		return err
+	}
+	if optErr != nil {
+		return os.NewSyscallError("getsockopt", optErr)
+	}
+	if soErr != 0 {
+		return os.NewSyscallError("connect", syscall.Errno(soErr))
+	}
+	return nil
+}
+
+func listenMPTCP(ctx context.Context, addr string) (net.Listener, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	laddrs, err := resolve(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	if host == "" {
+		// any address: one IPv6 socket taking IPv4 too, or IPv4 alone on a
+		// host without IPv6
+		l, err := listenMPTCPAddr(ctx, laddrs[0], addr)
+		if err == nil {
+			return l, nil
+		}
+		if len(laddrs) == 1 {
+			return nil, err
+		}
+		laddrs = laddrs[1:]
+	}
+	return listenMPTCPAddr(ctx, laddrs[0], addr)
+}
+
+func listenMPTCPAddr(ctx context.Context, laddr *net.TCPAddr, addr string) (net.Listener, error) {
+	family, sa := sockaddr(laddr)
+	fd, ok, err := mptcpSocket(family)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		if family == syscall.AF_INET6 && laddr.IP.IsUnspecified() {
+			// no IPv6 at all, let the caller try IPv4
+			return nil, &net.OpError{Op: "listen", Net: NameMPTCP, Addr: laddr, Err: syscall.EAFNOSUPPORT}
+		}
+		return TCP{}.Listen(ctx, addr)
+	}
+	f := os.NewFile(uintptr(fd), "mptcp")
+	defer f.Close()
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+		return nil, os.NewSyscallError("setsockopt", err)
+	}
+	if family == syscall.AF_INET6 && laddr.IP.IsUnspecified() {
+		if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_V6ONLY, 0); err != nil {
+			return nil, os.NewSyscallError("setsockopt", err)
+		}
+	}
+	if err := syscall.Bind(fd, sa); err != nil {
+		return nil, &net.OpError{Op: "listen", Net: NameMPTCP, Addr: laddr, Err: os.NewSyscallError("bind", err)}
+	}
+	if err := syscall.Listen(fd, syscall.SOMAXCONN); err != nil {
+		return nil, &net.OpError{Op: "listen", Net: NameMPTCP, Addr: laddr, Err: os.NewSyscallError("listen", err)}
+	}
+	return net.FileListener(f)
+}
+
+// resolve turns host:port into the addresses to try. An empty host is any
+// address, IPv6 first so one socket serves both families.
+func resolve(ctx context.Context, addr string) ([]*net.TCPAddr, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := net.DefaultResolver.LookupPort(ctx, "tcp", portStr)
+	if err != nil {
+		return nil, err
+	}
+	if host == "" {
+		return []*net.TCPAddr{{IP: net.IPv6unspecified, Port: port}, {IP: net.IPv4zero, Port: port}}, nil
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, errors.New("transport: no address for " + host)
+	}
+	addrs := make([]*net.TCPAddr, len(ips))
+	for i, ip := range ips {
+		addrs[i] = &net.TCPAddr{IP: ip.IP, Port: port, Zone: ip.Zone}
+	}
+	return addrs, nil
+}
+
+func sockaddr(addr *net.TCPAddr) (int, syscall.Sockaddr) {
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		sa := &syscall.SockaddrInet4{Port: addr.Port}
+		copy(sa.Addr[:], ip4)
+		return syscall.AF_INET, sa
+	}
+	sa := &syscall.SockaddrInet6{Port: addr.Port}
+	copy(sa.Addr[:], addr.IP.To16())
+	if addr.Zone != "" {
+		if ifi, err := net.InterfaceByName(addr.Zone); err == nil {
+			sa.ZoneId = uint32(ifi.Index)
+		}
+	}
+	return syscall.AF_INET6, sa
+}
@@ -0,0 +1,22 @@
+//go:build !linux
+
+package transport
+
+import (
+	"context"
+	"net"
+)
+
+// MPTCP sockets are only created on Linux, everywhere else it is plain TCP.
+
+func probeMPTCP() bool {
+	return false
+}
+
+func dialMPTCP(ctx context.Context, addr string) (net.Conn, error) {
+	return TCP{}.Dial(ctx, addr)
+}
+
+func listenMPTCP(ctx context.Context, addr string) (net.Listener, error) {
+	return TCP{}.Listen(ctx, addr)
+}
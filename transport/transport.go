@@ -0,0 +1,56 @@
+// Package transport opens the stream connections clients and agents talk
+// over. A Transport is picked by name, so the server and the client can run
+// over MPTCP, plain TCP, Unix domain sockets or, in tests, in-memory pipes.
+package transport
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+// Names of the transports New knows.
+const (
+	NameTCP    = "tcp"
+	NameMPTCP  = "mptcp"
+	NameUnix   = "unix"
+	NameMemory = "memory"
+)
+
+// Transport dials and listens on addresses of one kind: host:port for TCP
+// and MPTCP, a socket path for Unix and any name for Memory.
+type Transport interface {
+	Dial(ctx context.Context, addr string) (net.Conn, error)
+	Listen(ctx context.Context, addr string) (net.Listener, error)
+}
+
+// process wide, so a server and a client in one process can meet
+var defaultMemory = NewMemory()
+
+// New returns the transport called name.
+func New(name string) (Transport, error) {
+	switch name {
+	case NameTCP:
+		return TCP{}, nil
+	case NameMPTCP:
+		return MPTCP{}, nil
+	case NameUnix:
+		return Unix{}, nil
+	case NameMemory:
+		return defaultMemory, nil
+	}
+	return nil, fmt.Errorf("transport: unknown transport %q", name)
+}
+
+// TCP is plain TCP.
+type TCP struct{}
+
+func (TCP) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, "tcp", addr)
+}
+
+func (TCP) Listen(ctx context.Context, addr string) (net.Listener, error) {
+	var lc net.ListenConfig
+	return lc.Listen(ctx, "tcp", addr)
+}
@@ -0,0 +1,152 @@
+package transport
+
+import (
+	"context"
+	"io"
+	"net"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// echoOnce serves one connection of l, echoing what it reads.
+func echoOnce(t *testing.T, l net.Listener) {
+	t.Helper()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.Copy(c, c)
+	}()
+}
+
+func testRoundTrip(t *testing.T, tr Transport, listenAddr string, dialAddr func(net.Listener) string) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	l, err := tr.Listen(ctx, listenAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	echoOnce(t, l)
+	c, err := tr.Dial(ctx, dialAddr(l))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("echo %q: %v", buf, err)
+	}
+}
+
+func TestTransports(t *testing.T) {
+	byAddr := func(l net.Listener) string { return l.Addr().String() }
+	t.Run(NameTCP, func(t *testing.T) {
+		testRoundTrip(t, TCP{}, "127.0.0.1:0", byAddr)
+	})
+	t.Run(NameMPTCP, func(t *testing.T) {
+		// falls back to TCP where the kernel has no MPTCP
+		testRoundTrip(t, MPTCP{}, "127.0.0.1:0", byAddr)
+	})
+	t.Run(NameUnix, func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "agent.sock")
+		testRoundTrip(t, Unix{}, path, byAddr)
+		// a socket left behind does not block the next listener
+		testRoundTrip(t, Unix{}, path, byAddr)
+	})
+	t.Run(NameMemory, func(t *testing.T) {
+		testRoundTrip(t, NewMemory(), "agent", byAddr)
+	})
+}
+
+func TestNew(t *testing.T) {
+	for _, name := range []string{NameTCP, NameMPTCP, NameUnix, NameMemory} {
+		if _, err := New(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := New("carrier-pigeon"); err == nil {
+		t.Fatal("unknown transport accepted")
+	}
+}
+
+func TestDialRefused(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemory()
+	if _, err := m.Dial(ctx, "nobody"); err == nil {
+		t.Fatal("dial without listener succeeded")
+	}
+	l, err := m.Listen(ctx, "agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Listen(ctx, "agent"); err == nil {
+		t.Fatal("second listener on one address")
+	}
+	l.Close()
+	if _, err := m.Dial(ctx, "agent"); err == nil {
+		t.Fatal("dial after close succeeded")
+	}
+
+	// nothing listens on this port once the listener is closed
+	tl, err := TCP{}.Listen(ctx, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := tl.Addr().String()
+	tl.Close()
+	if c, err := (MPTCP{}).Dial(ctx, addr); err == nil {
+		c.Close()
+		t.Fatal("mptcp dial to a closed port succeeded")
+	}
+}
+
+func TestDialHonorsContext(t *testing.T) {
+	m := NewMemory()
+	l, err := m.Listen(context.Background(), "agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	// nobody accepts, the dial gives up with the context
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := m.Dial(ctx, "agent"); err != context.DeadlineExceeded {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestDualStack(t *testing.T) {
+	if l, err := net.Listen("tcp6", "[::1]:0"); err != nil {
+		t.Skip("no IPv6 loopback:", err)
+	} else {
+		l.Close()
+	}
+	for _, tr := range []struct {
+		name string
+		Transport
+	}{{NameTCP, TCP{}}, {NameMPTCP, MPTCP{}}} {
+		t.Run(tr.name, func(t *testing.T) {
+			// an IPv6 literal on both ends
+			testRoundTrip(t, tr, "[::1]:0", func(l net.Listener) string { return l.Addr().String() })
+			// any address takes both families
+			for _, host := range []string{"127.0.0.1", "::1"} {
+				testRoundTrip(t, tr, ":0", func(l net.Listener) string {
+					return net.JoinHostPort(host, strconv.Itoa(l.Addr().(*net.TCPAddr).Port))
+				})
+			}
+			// a name resolving to several addresses
+			testRoundTrip(t, tr, "127.0.0.1:0", func(l net.Listener) string {
+				return net.JoinHostPort("localhost", strconv.Itoa(l.Addr().(*net.TCPAddr).Port))
+			})
+		})
+	}
+}
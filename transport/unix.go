@@ -0,0 +1,30 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+)
+
+// Unix connects processes on the same node over a Unix domain socket, addr
+// is the path of the socket.
+type Unix struct{}
+
+func (Unix) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, "unix", addr)
+}
+
+// Listen removes a socket file left behind by an earlier run first.
+func (Unix) Listen(ctx context.Context, addr string) (net.Listener, error) {
+	if fi, err := os.Stat(addr); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(addr); err != nil {
+			return nil, err
+		}
+	} else if err == nil {
+		return nil, errors.New("transport: " + addr + " exists and is not a socket")
+	}
+	var lc net.ListenConfig
+	return lc.Listen(ctx, "unix", addr)
+}
@@ -3,8 +3,8 @@ package util
 import (
 	"fmt"
 	"io/ioutil"
+	"net/url"
 	"os"
-	"regexp"
 
 	"gopkg.in/yaml.v3"
 )
@@ -34,9 +34,23 @@ func GetServerIpFromYaml(filepath string) string {
 		fmt.Println("Failed to parse yaml file:", err)
 		os.Exit(1)
 	}
-	urlStr := cfg.Clusters[0].Cluster.Server
-	ipPattern := `((?:\d{1,3}\.){3}\d{1,3})`
-	regex := regexp.MustCompile(ipPattern)
-	ip := regex.FindString(urlStr)
-	return ip
+	if len(cfg.Clusters) == 0 {
+		fmt.Println("No cluster in yaml file:", filepath)
+		os.Exit(1)
+	}
+	return ServerHost(cfg.Clusters[0].Cluster.Server)
+}
+
+// ServerHost returns the host of the API server url of a kubeconfig, an IPv4
+// or IPv6 address or a name, without brackets or port.
+func ServerHost(server string) string {
+	u, err := url.Parse(server)
+	if err != nil || u.Host == "" {
+		// a bare host[:port] without scheme
+		u, err = url.Parse("https://" + server)
+		if err != nil {
+			return ""
+		}
+	}
+	return u.Hostname()
 }
@@ -0,0 +1,35 @@
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestServerHost(t *testing.T) {
+	for server, want := range map[string]string{
+		"https://192.168.49.2:8443":            "192.168.49.2",
+		"https://[fd00:10:96::1]:6443":         "fd00:10:96::1",
+		"https://[2001:db8::1]":                "2001:db8::1",
+		"https://k8s.example.com:6443":         "k8s.example.com",
+		"https://k8s.example.com/prefix":       "k8s.example.com",
+		"10.0.0.1:6443":                        "10.0.0.1",
+		"[fe80::1%25eth0]:6443":                "fe80::1%eth0",
+		"https://kubernetes.default.svc:443/x": "kubernetes.default.svc",
+	} {
+		if got := ServerHost(server); got != want {
+			t.Errorf("ServerHost(%q) = %q, want %q", server, got, want)
+		}
+	}
+}
+
+func TestGetServerIpFromYaml(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config")
+	cfg := "clusters:\n- cluster:\n    server: https://[fd00::10]:6443\n  name: dual\n"
+	if err := os.WriteFile(path, []byte(cfg), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if got := GetServerIpFromYaml(path); got != "fd00::10" {
+		t.Fatalf("got %q", got)
+	}
+}
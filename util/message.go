@@ -1,48 +1,109 @@
 package util
 
 import (
+	"context"
 	"encoding/binary"
-	"log"
+	"errors"
+	"fmt"
+	"io"
 	"net"
+	"time"
 )
 
-func SendNetMessage(conn net.Conn, cmd uint32, data string) {
+// frame layout: [len uint32][cmd uint32][data], len counts cmd and data
+const frameHeaderLen = 4
+
+var ErrFrameTooLarge = errors.New("frame exceeds maximum size")
+
+// WriteFrame writes one frame to conn. The write is aborted when ctx is done
+// or its deadline passes.
+func WriteFrame(ctx context.Context, conn net.Conn, cmd uint32, data []byte) error {
 	if conn == nil {
-		log.Panicln("conn cannot be nil")
-	}
-	totalLength := 4 + 4
-	if data != "" {
-		totalLength += len(data)
+		return errors.New("conn cannot be nil")
 	}
-	buf := make([]byte, totalLength)
-	binary.LittleEndian.PutUint32(buf, uint32(totalLength-4))
+	stop := watchContext(ctx, conn.SetWriteDeadline)
+	defer stop()
+
+	buf := make([]byte, frameHeaderLen+4+len(data))
+	binary.LittleEndian.PutUint32(buf, uint32(4+len(data)))
 	binary.LittleEndian.PutUint32(buf[4:], cmd)
-	if data != "" {
-		copy(buf[8:], data)
+	copy(buf[8:], data)
+	if _, err := conn.Write(buf); err != nil {
+		return contextError(ctx, err)
 	}
-	conn.Write(buf)
+	return nil
 }
 
-func RecvNetMessage(conn net.Conn) (uint32, string) {
+// ReadFrame reads one frame from conn. Frames whose cmd and data are longer
+// than maxSize bytes are rejected before anything is allocated, so a forged
+// length prefix cannot exhaust memory.
+func ReadFrame(ctx context.Context, conn net.Conn, maxSize uint32) (uint32, []byte, error) {
 	if conn == nil {
-		log.Panicln("conn cannot be nil")
-	}
-	readConn := func(total uint32) []byte {
-		buffer := make([]byte, total)
-		var totalRead uint32 = 0
-		for totalRead < total {
-			n, err := conn.Read(buffer[totalRead:])
-			if err != nil {
-				log.Panicln("Failed to read data from conn:", err)
-			}
-			totalRead += uint32(n)
+		return 0, nil, errors.New("conn cannot be nil")
+	}
+	stop := watchContext(ctx, conn.SetReadDeadline)
+	defer stop()
+
+	var header [frameHeaderLen + 4]byte
+	if _, err := io.ReadFull(conn, header[:frameHeaderLen]); err != nil {
+		return 0, nil, contextError(ctx, err)
+	}
+	length := binary.LittleEndian.Uint32(header[:])
+	if length < 4 {
+		return 0, nil, fmt.Errorf("invalid frame length %d", length)
+	}
+	if length > maxSize {
+		return 0, nil, fmt.Errorf("%w: %d > %d", ErrFrameTooLarge, length, maxSize)
+	}
+	if _, err := io.ReadFull(conn, header[frameHeaderLen:]); err != nil {
+		return 0, nil, contextError(ctx, err)
+	}
+	cmd := binary.LittleEndian.Uint32(header[frameHeaderLen:])
+	data := make([]byte, length-4)
+	if _, err := io.ReadFull(conn, data); err != nil {
+		return 0, nil, contextError(ctx, err)
+	}
+	return cmd, data, nil
+}
+
+// watchContext applies the deadline of ctx through setDeadline and interrupts
+// the pending I/O when ctx is cancelled. The returned func must be called once
+// the I/O has finished; it clears the deadline again.
+func watchContext(ctx context.Context, setDeadline func(time.Time) error) func() {
+	if deadline, ok := ctx.Deadline(); ok {
+		setDeadline(deadline)
+	}
+	if ctx.Done() == nil {
+		return func() {
+			setDeadline(time.Time{})
+		}
+	}
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		select {
+		case <-ctx.Done():
+			// a deadline in the past unblocks the pending read or write
+			setDeadline(time.Unix(1, 0))
+		case <-done:
 		}
-		return buffer
-	}
-	lenBuffer := readConn(4)
-	dataLength := binary.LittleEndian.Uint32(lenBuffer)
-	dataBuffer := readConn(dataLength)
-	cmd := binary.LittleEndian.Uint32(dataBuffer)
-	data := string(dataBuffer[4:])
-	return cmd, data
+	}()
+	return func() {
+		close(done)
+		<-finished
+		setDeadline(time.Time{})
+	}
+}
+
+func contextError(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return fmt.Errorf("%w (%v)", ctxErr, err)
+	}
+	// the conn deadline may fire just before ctx notices its own deadline
+	var netErr net.Error
+	if _, ok := ctx.Deadline(); ok && errors.As(err, &netErr) && netErr.Timeout() {
+		return fmt.Errorf("%w (%v)", context.DeadlineExceeded, err)
+	}
+	return err
 }
@@ -0,0 +1,61 @@
+package util
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	go WriteFrame(context.Background(), c1, 7, []byte("hello"))
+	cmd, data, err := ReadFrame(context.Background(), c2, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cmd != 7 || string(data) != "hello" {
+		t.Fatalf("got cmd %d data %q", cmd, data)
+	}
+}
+
+func TestReadFrameRejectsOversizedFrame(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	go func() {
+		header := make([]byte, 4)
+		binary.LittleEndian.PutUint32(header, 0xffffffff)
+		c1.Write(header)
+	}()
+	_, _, err := ReadFrame(context.Background(), c2, 1024)
+	if !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("expected ErrFrameTooLarge, got %v", err)
+	}
+}
+
+func TestReadFrameHonorsContext(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, _, err := ReadFrame(ctx, c2, 1024)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline error, got %v", err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	_, _, err = ReadFrame(ctx, c2, 1024)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected canceled error, got %v", err)
+	}
+}
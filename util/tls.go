@@ -0,0 +1,156 @@
+package util
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+// Names of the certificate files in a TLS directory, the same as the keys of
+// a kubernetes.io/tls Secret with the CA added.
+const (
+	TLSCAFile   = "ca.crt"
+	TLSCertFile = "tls.crt"
+	TLSKeyFile  = "tls.key"
+)
+
+// the first byte of a TLS connection, a handshake record
+const tlsRecordHandshake = 0x16
+
+// TLSMaterial is the certificate of an agent or client together with the CA
+// that signs the certificates of its peers.
+type TLSMaterial struct {
+	// Certificate is nil for a client without a certificate of its own
+	Certificate *tls.Certificate
+	RootCAs     *x509.CertPool
+}
+
+// LoadTLSDir loads ca.crt, tls.crt and tls.key from dir.
+func LoadTLSDir(dir string) (*TLSMaterial, error) {
+	return LoadTLSFiles(filepath.Join(dir, TLSCAFile), filepath.Join(dir, TLSCertFile), filepath.Join(dir, TLSKeyFile))
+}
+
+// LoadTLSFiles loads TLS material from PEM files. certFile and keyFile may be
+// empty for a peer without a certificate, or the same file holding both.
+func LoadTLSFiles(caFile, certFile, keyFile string) (*TLSMaterial, error) {
+	caPEM, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("tls: read ca: %w", err)
+	}
+	var certPEM, keyPEM []byte
+	if certFile != "" {
+		if keyFile == "" {
+			keyFile = certFile
+		}
+		if certPEM, err = os.ReadFile(certFile); err != nil {
+			return nil, fmt.Errorf("tls: read certificate: %w", err)
+		}
+		if keyPEM, err = os.ReadFile(keyFile); err != nil {
+			return nil, fmt.Errorf("tls: read key: %w", err)
+		}
+	}
+	return ParseTLSMaterial(caPEM, certPEM, keyPEM)
+}
+
+// ParseTLSMaterial parses PEM encoded TLS material, certPEM and keyPEM may be
+// empty for a peer without a certificate.
+func ParseTLSMaterial(caPEM, certPEM, keyPEM []byte) (*TLSMaterial, error) {
+	m := &TLSMaterial{RootCAs: x509.NewCertPool()}
+	if !m.RootCAs.AppendCertsFromPEM(caPEM) {
+		return nil, errors.New("tls: no certificate found in ca")
+	}
+	if len(certPEM) > 0 {
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return nil, fmt.Errorf("tls: load key pair: %w", err)
+		}
+		m.Certificate = &cert
+	}
+	return m, nil
+}
+
+// ServerConfig returns the config of a listener, clientAuth decides whether
+// peers have to present a certificate signed by the CA.
+func (m *TLSMaterial) ServerConfig(clientAuth tls.ClientAuthType) *tls.Config {
+	cfg := &tls.Config{
+		ClientCAs:  m.RootCAs,
+		ClientAuth: clientAuth,
+		MinVersion: tls.VersionTLS12,
+	}
+	if m.Certificate != nil {
+		cfg.Certificates = []tls.Certificate{*m.Certificate}
+	}
+	return cfg
+}
+
+// PeerConfig returns the config of a listener only peers issued for
+// peerName get through, clients holding a certificate of the same CA under
+// another name are rejected.
+func (m *TLSMaterial) PeerConfig(peerName string) *tls.Config {
+	cfg := m.ServerConfig(tls.RequireAndVerifyClientCert)
+	cfg.VerifyPeerCertificate = func(_ [][]byte, chains [][]*x509.Certificate) error {
+		if len(chains) == 0 || len(chains[0]) == 0 {
+			return errors.New("tls: no verified peer certificate")
+		}
+		if err := chains[0][0].VerifyHostname(peerName); err != nil {
+			return fmt.Errorf("tls: peer is not %s: %w", peerName, err)
+		}
+		return nil
+	}
+	return cfg
+}
+
+// ClientConfig returns the config of a dialer. Agents are reached by ip, so
+// their certificates are checked against serverName instead.
+func (m *TLSMaterial) ClientConfig(serverName string) *tls.Config {
+	cfg := &tls.Config{
+		RootCAs:    m.RootCAs,
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if m.Certificate != nil {
+		cfg.Certificates = []tls.Certificate{*m.Certificate}
+	}
+	return cfg
+}
+
+// TLSHandshake runs the TLS handshake of conn and returns it as a net.Conn.
+// conn is closed if the handshake fails.
+func TLSHandshake(ctx context.Context, conn *tls.Conn) (net.Conn, error) {
+	if err := conn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("tls handshake with %s: %w", conn.RemoteAddr(), err)
+	}
+	return conn, nil
+}
+
+// SniffTLS reports whether the peer of conn starts with a TLS handshake. The
+// byte looked at is not lost, it is read again from the returned conn.
+func SniffTLS(conn net.Conn) (net.Conn, bool, error) {
+	br := bufio.NewReader(conn)
+	b, err := br.Peek(1)
+	if err != nil {
+		return conn, false, err
+	}
+	return &sniffedConn{Conn: conn, r: br}, b[0] == tlsRecordHandshake, nil
+}
+
+type sniffedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *sniffedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// NetConn returns the sniffed conn.
+func (c *sniffedConn) NetConn() net.Conn {
+	return c.Conn
+}
@@ -0,0 +1,195 @@
+package util
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+const testServerName = "smart-agent"
+
+// newTestCA returns the PEM of a self signed CA and a function issuing leaf
+// certificates, as PEM cert and key, signed by it.
+func newTestCA(t *testing.T) ([]byte, func(name string) ([]byte, []byte)) {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial := int64(1)
+	issue := func(name string) ([]byte, []byte) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		serial++
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: name},
+			DNSNames:     []string{name},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, caCert, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyDER, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+			pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}), issue
+}
+
+func newTestMaterial(t *testing.T, caPEM, certPEM, keyPEM []byte) *TLSMaterial {
+	t.Helper()
+	m, err := ParseTLSMaterial(caPEM, certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// handshake runs both sides of a TLS handshake over loopback and returns
+// the errors of the server and the client. A pipe does not do, the alert of
+// a server rejecting the client's certificate blocks on the client's last
+// flight.
+func handshake(t *testing.T, server *tls.Config, client *tls.Config) (error, error) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	c1, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+	c2, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+
+	errCh := make(chan error, 1)
+	go func() {
+		conn, err := TLSHandshake(context.Background(), tls.Server(c2, server))
+		if err == nil {
+			// let the client finish reading the server's last flight
+			_, err = conn.Write([]byte{0})
+		}
+		errCh <- err
+	}()
+	conn, err := TLSHandshake(context.Background(), tls.Client(c1, client))
+	if err == nil {
+		_, err = conn.Read(make([]byte, 1))
+	} else {
+		c1.Close()
+	}
+	return <-errCh, err
+}
+
+func TestMutualTLS(t *testing.T) {
+	caPEM, issue := newTestCA(t)
+	certPEM, keyPEM := issue(testServerName)
+	agent := newTestMaterial(t, caPEM, certPEM, keyPEM)
+	server := agent.ServerConfig(tls.RequireAndVerifyClientCert)
+
+	if serr, cerr := handshake(t, server, agent.ClientConfig(testServerName)); serr != nil || cerr != nil {
+		t.Fatalf("mutual tls between agents: server %v, client %v", serr, cerr)
+	}
+
+	// a peer without a certificate is rejected
+	anonymous := newTestMaterial(t, caPEM, nil, nil)
+	if serr, _ := handshake(t, server, anonymous.ClientConfig(testServerName)); serr == nil {
+		t.Fatal("server accepted a peer without certificate")
+	}
+
+	// so is a peer whose certificate is signed by another CA
+	otherCA, otherIssue := newTestCA(t)
+	certPEM, keyPEM = otherIssue(testServerName)
+	stranger := newTestMaterial(t, otherCA, certPEM, keyPEM)
+	if serr, _ := handshake(t, server, stranger.ClientConfig(testServerName)); serr == nil {
+		t.Fatal("server accepted a certificate of another ca")
+	}
+}
+
+func TestPeerConfig(t *testing.T) {
+	caPEM, issue := newTestCA(t)
+	certPEM, keyPEM := issue(testServerName)
+	agent := newTestMaterial(t, caPEM, certPEM, keyPEM)
+	server := agent.PeerConfig(testServerName)
+
+	if serr, cerr := handshake(t, server, agent.ClientConfig(testServerName)); serr != nil || cerr != nil {
+		t.Fatalf("tls between agents: server %v, client %v", serr, cerr)
+	}
+
+	// a client certificate of the same CA does not make its holder an agent
+	certPEM, keyPEM = issue(testServerName + "-client")
+	client := newTestMaterial(t, caPEM, certPEM, keyPEM)
+	if serr, _ := handshake(t, server, client.ClientConfig(testServerName)); serr == nil {
+		t.Fatal("agent port accepted a client certificate")
+	}
+}
+
+func TestSniffTLS(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	go c1.Write([]byte("SMAG"))
+	conn, isTLS, err := SniffTLS(c2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if isTLS {
+		t.Fatal("plaintext preface taken for tls")
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "SMAG" {
+		t.Fatalf("read %q after sniffing: %v", buf, err)
+	}
+
+	caPEM, _ := newTestCA(t)
+	client := newTestMaterial(t, caPEM, nil, nil)
+	c3, c4 := net.Pipe()
+	defer c3.Close()
+	defer c4.Close()
+	go tls.Client(c3, client.ClientConfig(testServerName)).Handshake()
+	if _, isTLS, err := SniffTLS(c4); err != nil || !isTLS {
+		t.Fatalf("tls client hello not detected: %v", err)
+	}
+}